@@ -32,6 +32,19 @@ Some misc info:
     If set, then we return errors as a json string, as opposed to showing the
     user friendly, and browser friendly, error view page.
     RPC, Testing, etc will set this on their requests.
+  - Otherwise, the format of an error response is negotiated from the Accept header:
+    html (the apperror view, if defined), json (application/json),
+    RFC 7807 json (application/problem+json) or plain text.
+  - The status code of an error response comes from the type of the error
+    e.g. BadRequestError (400), UnauthorizedError (401), ForbiddenError (403),
+    PageNotFoundError (404), MethodNotAllowedError (405), ConflictError (409).
+  - A handler can return an HTTPError (e.g. via NotFound, BadRequest, etc)
+    to set the status code, the message shown to the user, and response headers.
+    Its internal cause is only shown when the Tier is not PRODUCTION.
+    In PRODUCTION, typed errors only show their own text (not that of errors wrapping them),
+    and other errors are shown as "Internal Server Error".
+  - CtxCtx carries the deadline and cancellation of the request, as set by
+    a web.TimeoutPipe or the Timeout Middleware (for a route and its descendants).
 
 */
 package app
@@ -44,6 +57,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ugorji/go-common/errorutil"
 	"github.com/ugorji/go-common/safestore"
 	"github.com/ugorji/go-common/vfs"
 )
@@ -55,6 +69,10 @@ const (
 	//this way, testing, rpc, etc do not have to deal with the error view for browsers.
 	UseJsonOnErrHttpHeaderKey = "Z-App-Json-Response-On-Error"
 
+	//key in the Store of a Context, for the context.Context of its request.
+	//CtxCtx derives from it, so it carries the deadline and cancellation of the request.
+	RequestContextKey = "app_request_context"
+
 	//Used for shared cache contents, etc
 	//SharedNsPfx = "_shared::"
 )
@@ -278,6 +296,47 @@ type LowLevelDriver interface {
 	//BlobUploadURL(c Context, successPath string) (*url.URL, error)
 }
 
+// TransactionalDriver is implemented by a LowLevelDriver which supports transactions.
+type TransactionalDriver interface {
+	// RunInTransaction runs fn within a single attempt of a transaction.
+	// The datastore calls made with the TxContext passed to fn are part of the transaction.
+	//
+	// If fn returns an error, the transaction is rolled back. Else it is committed.
+	// If the commit fails because of a concurrent change, a TxConflictError is returned.
+	RunInTransaction(ctx Context, fn func(tctx *TxContext) error) error
+}
+
+// TxContext is the Context passed into a function run within a transaction.
+// It must not be used after the function returns, or by many goroutines at once.
+type TxContext struct {
+	Context
+	// Tx is the transaction state of the driver.
+	Tx interface{}
+	// Keys are the keys which were put or deleted within the transaction.
+	// Their cache entries are removed after the transaction commits.
+	Keys []Key
+}
+
+// TxConflictError is returned when a transaction cannot commit,
+// because of a concurrent change to the entities within it.
+type TxConflictError string
+
+func (e TxConflictError) Error() string {
+	return string(e)
+}
+
+// IsTxConflict returns true if err is a TxConflictError.
+func IsTxConflict(err error) bool {
+	_, ok := errorutil.Base(err).(TxConflictError)
+	return ok
+}
+
+// TxFrom returns the TxContext if ctx is within a transaction, or nil otherwise.
+func TxFrom(ctx Context) *TxContext {
+	tctx, _ := ctx.(*TxContext)
+	return tctx
+}
+
 func (c *BasicContext) Store() safestore.I {
 	return c.SafeStore
 }
@@ -0,0 +1,98 @@
+package app_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db/memdb"
+	"github.com/ugorji/go-serverapp/internal/apptest"
+)
+
+// newErrorApp returns an app whose route "fail" returns a 404 with a cause,
+// and which has an apperror view if withTmpl.
+func newErrorApp(t *testing.T, withTmpl bool) app.HTTPHandler {
+	gapp := apptest.NewApp(t, memdb.New())
+	gapp.Tier = app.DEVELOPMENT
+	app.NewRouteFunc(gapp.Root, "landing", nil).Path("/")
+	app.NewRouteFunc(gapp.Root, "fail", func(c app.Context, w http.ResponseWriter, r *http.Request) error {
+		return app.NotFound("no such user", errors.New("sql: no rows"))
+	}).Path("/fail")
+	if withTmpl {
+		tmpl := template.New("apperror")
+		template.Must(tmpl.New("content").Parse(`<p>{{.Code}} {{.Error}} ({{.Cause}}) at {{.Path}}, see {{.LandingPageURL}}</p>`))
+		gapp.Views.Views["apperror"] = tmpl
+	}
+	return app.HTTPHandler{App: gapp}
+}
+
+func TestErrorNegotiation(t *testing.T) {
+	const (
+		html    = "<p>404 no such user (sql: no rows) at /fail, see /</p>"
+		text    = "404 Not Found\nno such user\n"
+		jsonMsg = `"Message": "no such user"`
+		problem = `"title": "Not Found"`
+	)
+	for _, x := range []struct {
+		withTmpl    bool
+		accept      string
+		useJson     bool
+		ctype, body string
+	}{
+		{true, "", false, "", html},
+		{true, "text/html,application/xhtml+xml,*/*;q=0.8", false, "", html},
+		{true, "application/json", false, "application/json; charset=utf-8", jsonMsg},
+		{true, "application/problem+json, application/json;q=0.9", false, "application/problem+json", problem},
+		{true, "text/plain", false, "text/plain; charset=utf-8", text},
+		{true, "text/*", false, "", html},
+		{true, "text/*, text/html;q=0", false, "text/plain; charset=utf-8", text},
+		{true, "text/html", true, "application/json; charset=utf-8", jsonMsg},
+		// html is refused, and nothing else is acceptable
+		{true, "text/html;q=0", false, "application/json; charset=utf-8", jsonMsg},
+		{true, "*/*;q=0", false, "text/plain; charset=utf-8", text},
+		// without an apperror template, html is not offered
+		{false, "", false, "application/json; charset=utf-8", jsonMsg},
+		{false, "text/html", false, "application/json; charset=utf-8", jsonMsg},
+		{false, "text/html, text/plain;q=0.5", false, "text/plain; charset=utf-8", text},
+	} {
+		req := httptest.NewRequest("GET", "/fail", nil)
+		if x.accept != "" {
+			req.Header.Set("Accept", x.accept)
+		}
+		if x.useJson {
+			req.Header.Set(app.UseJsonOnErrHttpHeaderKey, "true")
+		}
+		w := httptest.NewRecorder()
+		newErrorApp(t, x.withTmpl).ServeHTTP(w, req)
+		if w.Code != 404 || w.Header().Get("Content-Type") != x.ctype || !strings.Contains(w.Body.String(), x.body) {
+			t.Errorf("template: %v, accept: %q, json: %v: expected: 404 %q %q, got: %d %q %q",
+				x.withTmpl, x.accept, x.useJson, x.ctype, x.body, w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+	}
+
+	// the json formats are complete
+	for ctype, exp := range map[string]map[string]interface{}{
+		"application/json": {"Code": 404.0, "Path": "/fail", "Message": "no such user", "Cause": "sql: no rows"},
+		"application/problem+json": {"type": "about:blank", "title": "Not Found", "status": 404.0,
+			"detail": "no such user", "instance": "/fail", "cause": "sql: no rows"},
+	} {
+		req := httptest.NewRequest("GET", "/fail", nil)
+		req.Header.Set("Accept", ctype)
+		w := httptest.NewRecorder()
+		newErrorApp(t, false).ServeHTTP(w, req)
+		var m map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil || len(m) != len(exp) {
+			t.Fatalf("%s: expected: %v, got: %s (error: %v)", ctype, exp, w.Body.String(), err)
+		}
+		for k, v := range exp {
+			if m[k] != v {
+				t.Errorf("%s: expected %s: %v, got: %v", ctype, k, v, m[k])
+			}
+		}
+	}
+}
@@ -29,6 +29,12 @@ This package expects the following:
    - Define views called "error", "notfound" so we can show something when either is encountered from code
    - Also define view called "apperror", and we just show its content when there's an error
      without inheriting or depending on anyone else.
+
+Many apps can run in one process. Each is created with its own resources and
+templates (see NewAppIn) and UUID, and can be mounted under a route of another
+app (see Mount), with a path prefix and optionally a host (compared without its port,
+and ignoring case). A mounted app keeps its own Driver, Views and error views, and
+the urls it generates start with its prefix.
 */
 package app
 
@@ -39,11 +45,13 @@ import (
 	"io"
 	"net/http"
 	"net/http/httputil"
+	"path/filepath"
 	"reflect"
 	"regexp"
 
 	// "runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic" //"runtime/debug"
 	"time"
@@ -92,6 +100,36 @@ func (e PageNotFoundError) Error() string {
 	return string(e)
 }
 
+type MethodNotAllowedError string
+
+func (e MethodNotAllowedError) Error() string {
+	return string(e)
+}
+
+type BadRequestError string
+
+func (e BadRequestError) Error() string {
+	return string(e)
+}
+
+type UnauthorizedError string
+
+func (e UnauthorizedError) Error() string {
+	return string(e)
+}
+
+type ForbiddenError string
+
+func (e ForbiddenError) Error() string {
+	return string(e)
+}
+
+type ConflictError string
+
+func (e ConflictError) Error() string {
+	return string(e)
+}
+
 type BaseDriver struct {
 	AppInfo
 	Views       *web.Views // = web.NewViews()
@@ -116,21 +154,59 @@ type myResponseError struct {
 	Code    int
 	Path    string
 	Message string
+	Cause   string `json:",omitempty"`
 	// Trace   string
 }
 
+// problemDetails is an error response in the format of RFC 7807 (application/problem+json).
+type problemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Cause    string `json:"cause,omitempty"`
+}
+
+// errContentTypes are the formats of an error response, in order of preference.
+var errContentTypes = []string{"text/html", "application/json", "application/problem+json", "text/plain"}
+
 func CtxCtx(c Context) context.Context { return ctxctx(c) }
 
 func ctxctx(c Context) context.Context {
-	return context.WithValue(context.TODO(), logging.AppContextKey, c)
+	parent := context.TODO()
+	if c != nil {
+		if ctx, ok := c.Store().Get(RequestContextKey).(context.Context); ok {
+			parent = ctx
+		}
+	}
+	return context.WithValue(parent, logging.AppContextKey, c)
+}
+
+// tlld is the Driver of a BaseApp, combining its BaseDriver with the LowLevelDriver.
+type tlld struct {
+	*BaseDriver
+	LowLevelDriver
+}
+
+// RunInTransaction forwards to the LowLevelDriver, if it is a TransactionalDriver.
+func (x tlld) RunInTransaction(ctx Context, fn func(tctx *TxContext) error) error {
+	tdr, ok := x.LowLevelDriver.(TransactionalDriver)
+	if !ok {
+		return fmt.Errorf("RunInTransaction: transactions not supported by driver: %s", x.DriverName())
+	}
+	return tdr.RunInTransaction(ctx, fn)
 }
 
 func NewApp(devServer bool, uuid string, viewsCfgPath string, lld LowLevelDriver) (gapp *BaseApp, err error) {
+	return NewAppIn(devServer, uuid, "", viewsCfgPath, lld)
+}
+
+// NewAppIn creates an app whose resources and templates are in dir
+// (in resources.zip or resources/, and templates.zip or templates/).
+// It allows many apps run in one process (see Mount).
+func NewAppIn(devServer bool, uuid string, dir string, viewsCfgPath string, lld LowLevelDriver) (gapp *BaseApp, err error) {
 	defer errorutil.OnError(&err)
-	type tlld struct {
-		*BaseDriver
-		LowLevelDriver
-	}
 	gapp = new(BaseApp)
 	gapp.AppDriver = tlld{&gapp.BaseDriver, lld}
 	gapp.UUID = uuid
@@ -141,11 +217,14 @@ func NewApp(devServer bool, uuid string, viewsCfgPath string, lld LowLevelDriver
 
 	gapp.Views = web.NewViews()
 	gapp.Root = NewRoot("Root")
+	if devServer {
+		NewRouteFunc(gapp.Root, "_dev_routes", RoutesHandler(gapp.Root)).Path(DevRoutesPath)
+	}
 	// uuid, err = util.Uuid(16)
 	// anId, err := rand.Int(rand.Reader, big.NewInt(8998))
 	// gapp.UUID = strconv.FormatInt(anId.Int64()+1001, 10)
 	gapp.ResVfs = new(vfs.Vfs)
-	if err = gapp.ResVfs.Adds(false, "resources.zip", "resources"); err != nil {
+	if err = gapp.ResVfs.Adds(false, filepath.Join(dir, "resources.zip"), filepath.Join(dir, "resources")); err != nil {
 		return
 	}
 
@@ -154,7 +233,7 @@ func NewApp(devServer bool, uuid string, viewsCfgPath string, lld LowLevelDriver
 	defer tmplVfs.Close()
 
 	//if err = tmplVfs.AddIfExist("templates.zip"); err != nil { return err }
-	if err = tmplVfs.Adds(false, "templates.zip", "templates"); err != nil {
+	if err = tmplVfs.Adds(false, filepath.Join(dir, "templates.zip"), filepath.Join(dir, "templates")); err != nil {
 		return
 	}
 	vcn := new(web.ViewConfigNode)
@@ -171,14 +250,30 @@ func NewApp(devServer bool, uuid string, viewsCfgPath string, lld LowLevelDriver
 	// vcfg := web.NodeToMap(vcn)
 	// log.Debug(nil, "VCN: %v =======> VCFG: %v", vcn, vcfg)
 
-	toUrlLink := func(ctx Context, route string, params ...interface{}) (string, error) {
+	// Link takes name/value pairs for the parameters of the route. A name starting
+	// with ? adds a query value (e.g. "?page", 2), and the name # sets the fragment.
+	toUrlLink := func(ctx Context, route string, params ...interface{}) (s string, err error) {
 		log.Debug(ctxctx(ctx), "Getting Link for: route: %v, params: %v", route, params)
-		sparams := make([]string, len(params))
-		for i, p := range params {
-			sparams[i] = fmt.Sprint(p)
+		rt := gapp.Root.FindByName(route)
+		if rt == nil {
+			return "", fmt.Errorf("Link: no route: %s", route)
+		}
+		if len(params)%2 != 0 {
+			return "", fmt.Errorf("Link: odd number of params: %d for route: %s", len(params), route)
+		}
+		b := rt.URL()
+		for i := 0; i < len(params); i += 2 {
+			switch name := fmt.Sprint(params[i]); {
+			case name == "#":
+				b.Fragment(fmt.Sprint(params[i+1]))
+			case strings.HasPrefix(name, "?"):
+				b.Query(name[1:], fmt.Sprint(params[i+1]))
+			default:
+				b.Param(name, params[i+1])
+			}
 		}
 		// log.Debug(ctx, "Calling Route: %v, with params: %v", route, params)
-		url0, err := gapp.Root.FindByName(route).ToURL(sparams...)
+		url0, err := b.Build(ctx)
 		if err == nil {
 			return url0.String(), nil
 		}
@@ -207,7 +302,12 @@ func (gapp *BaseApp) newContext(r *http.Request) (c Context, err error) {
 	// if i % 1000 == 0 {
 	// 	runtime.GC()
 	// }
-	return gapp.AppDriver.NewContext(r, gapp.UUID, i)
+	if c, err = gapp.AppDriver.NewContext(r, gapp.UUID, i); err != nil {
+		return
+	}
+	// so CtxCtx carries the deadline and cancellation of the request
+	c.Store().Put(RequestContextKey, r.Context(), 0)
+	return
 }
 
 func (gapp *BaseDriver) Info() *AppInfo {
@@ -247,6 +347,46 @@ func (gapp *BaseDriver) Render(ctx Context, view string, data map[string]interfa
 	return nil
 }
 
+// Mount serves the app of h under a new child route of parent, which matches requests
+// whose path is pathPrefix or starts with pathPrefix/ (and whose host is host, if not "").
+// The host of a request is compared without its port, and ignoring case.
+//
+// The app gets the request with pathPrefix removed from its path, and handles it as
+// if it was the only app: with its own Context, Driver, Views and error views.
+// The urls it generates for its routes (e.g. via Link) start with pathPrefix
+// (and have the host, if not declared by the route).
+func Mount(parent *Route, name string, pathPrefix string, host string, h HTTPHandler) (rt *Route) {
+	pathPrefix = strings.TrimSuffix(pathPrefix, "/")
+	h.App.Root.mountPath, h.App.Root.mountHost = pathPrefix, host
+	rt = NewRouteFunc(parent, name, func(c Context, w http.ResponseWriter, r *http.Request) error {
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		if u.Path = strings.TrimPrefix(u.Path, pathPrefix); u.Path == "" {
+			u.Path = "/"
+		}
+		u.RawPath = ""
+		r2.URL = &u
+		h.ServeHTTP(w, r2)
+		return nil
+	})
+	log.Debug(nil, "Mounting app: %v at: %v%v as Route: %v", h.App.UUID, host, pathPrefix, name)
+	if host != "" {
+		// match the host as sent by the client (e.g. in the Host header), not a regexp
+		rt.url.Host = host
+		rt.addMatcher(matcherDesc{kind: "Host", arg: host}, func(store safestore.I, req *http.Request) (bool, error) {
+			return strings.EqualFold(requestHost(req), host), nil
+		})
+	}
+	rt.url.Path = pathPrefix + "/"
+	rt.setPathIndex(pathPrefix, false)
+	rt.addMatcher(matcherDesc{kind: "Mount", arg: pathPrefix}, func(store safestore.I, req *http.Request) (bool, error) {
+		p := req.URL.Path
+		return p == pathPrefix || strings.HasPrefix(p, pathPrefix+"/"), nil
+	})
+	return
+}
+
 func (gapp *BaseDriver) LandingPageURL(ctx Context, includeHost bool) (s string, err error) {
 	defer errorutil.OnError(&err)
 	u, err := gapp.Root.FindByName("landing").ToURL()
@@ -429,57 +569,58 @@ func (gapp *BaseApp) derr(
 	if errTmpl != nil {
 		errTmpl = errTmpl.Lookup("content")
 	}
-	useJsonOnErr = useJsonOnErr || errTmpl == nil
-	log.Debug(ctxctx(c), "&&&&&&&&&&&&&&&&: useJsonOnErr: %v", useJsonOnErr)
-	var (
-		data     map[string]interface{}
-		jsondata *myResponseError
-		err2     error
-	)
-	fnErr := func(view string, code int) {
-		log.Debug(ctxctx(c), "fnErr: view: %v, code: %v", view, code)
-		w.WriteHeader(code)
-		if useJsonOnErr {
-			jsondata.Code = code
-			var buf2 []byte
-			buf2, err2 = json.MarshalIndent(jsondata, "  ", "  ")
-			if err2 == nil {
-				//fmt.Printf("(%s)\n", string(buf2))
-				_, err2 = w.Write(buf2)
-			}
-		} else {
-			//Shouldn't call Render fullstack when Render just threw a nasty exception.
-			//Use a simple template execute instead.
-			//err2 = c.Render(c, view, data, w)
-			err2 = errTmpl.Execute(w, data)
+	//negotiate the format of the error from the Accept header.
+	//html is preferred if the apperror template exists, else json.
+	var ctype string
+	if useJsonOnErr {
+		ctype = errContentTypes[1]
+	} else if errTmpl == nil {
+		ctype = negotiateContentType(r.Header.Get("Accept"), errContentTypes[1:]...)
+	} else {
+		ctype = negotiateContentType(r.Header.Get("Accept"), errContentTypes...)
+	}
+	code := errorStatusCode(err)
+	msg, cause := gapp.errorMessage(err, code)
+	if herr, ok := asHTTPError(err); ok {
+		for k, v := range herr.Headers() {
+			w.Header()[k] = v
 		}
 	}
 	//http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
-	log.Debug(ctxctx(c), "err: %v", err)
-	if useJsonOnErr {
-		w.Header().Set("Content-Type", "text/plain")
-		jsondata = new(myResponseError)
-		if err != nil {
-			jsondata.Message = fmt.Sprintf("%v", err)
-			//jsondata.Trace = errTrace
-		}
-		jsondata.Path = r.URL.Path
-	} else {
+	log.Debug(ctxctx(c), "err: %v, code: %v, content-type: %v", err, code, ctype)
+	var err2 error
+	switch ctype {
+	case "text/html":
 		//Don't set Content-Type, so that browser auto-discovers it based on content.
 		//This helps support our development mode error reporting (just plain text file)
 		//w.Header().Set("Content-Type", "text/html")
-		data = make(map[string]interface{})
-		data["Error"] = fmt.Sprintf("%v", err)
+		data := make(map[string]interface{})
+		data["Error"] = msg
+		data["Cause"] = cause
 		data["LandingPageURL"], _ = gapp.AppDriver.LandingPageURL(c, false)
 		data["Path"] = r.URL.Path
+		data["Code"] = code
 		//data["Trace"] = errTrace
-	}
-	//check if a wrapped util.Error, since we need the real error for disambiguation
-
-	if _, ok9 := err.(PageNotFoundError); ok9 {
-		fnErr("notfound", http.StatusNotFound)
-	} else {
-		fnErr("error", http.StatusInternalServerError)
+		w.WriteHeader(code)
+		//Shouldn't call Render fullstack when Render just threw a nasty exception.
+		//Use a simple template execute instead.
+		//err2 = c.Render(c, view, data, w)
+		err2 = errTmpl.Execute(w, data)
+	case "application/json":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		err2 = writeErrJson(w, code, &myResponseError{Code: code, Path: r.URL.Path, Message: msg, Cause: cause})
+	case "application/problem+json":
+		w.Header().Set("Content-Type", "application/problem+json")
+		err2 = writeErrJson(w, code, &problemDetails{
+			Type: "about:blank", Title: http.StatusText(code), Status: code, Detail: msg, Instance: r.URL.Path, Cause: cause,
+		})
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		_, err2 = fmt.Fprintf(w, "%d %s\n%s\n", code, http.StatusText(code), msg)
+		if err2 == nil && cause != "" {
+			_, err2 = fmt.Fprintf(w, "%s\n", cause)
+		}
 	}
 
 	if err2 != nil && err != err2 {
@@ -487,6 +628,80 @@ func (gapp *BaseApp) derr(
 	}
 }
 
+//errorStatusCode returns the http status code for an error (or panic value) from a dispatch.
+func errorStatusCode(err interface{}) int {
+	if herr, ok := asHTTPError(err); ok {
+		return herr.StatusCode()
+	}
+	if e, ok := err.(error); ok {
+		err = errorutil.Base(e)
+	}
+	switch err.(type) {
+	case BadRequestError:
+		return http.StatusBadRequest
+	case UnauthorizedError:
+		return http.StatusUnauthorized
+	case ForbiddenError:
+		return http.StatusForbidden
+	case PageNotFoundError:
+		return http.StatusNotFound
+	case MethodNotAllowedError:
+		return http.StatusMethodNotAllowed
+	case ConflictError, TxConflictError:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+//errorMessage returns the message shown to the user for an error (or panic value)
+//from a dispatch, and its internal cause (only shown if the Tier is not PRODUCTION).
+//
+//An HTTPError shows its public message. Other errors show their text, except in PRODUCTION,
+//where the typed errors (e.g. PageNotFoundError) only show their own text (not that of
+//the errors wrapping them), and other errors show the status text.
+func (gapp *BaseApp) errorMessage(err interface{}, code int) (msg, cause string) {
+	if err == nil {
+		return
+	}
+	if herr, ok := asHTTPError(err); ok {
+		msg = herr.PublicMessage()
+		if e := herr.Cause(); e != nil && gapp.Tier != PRODUCTION {
+			cause = e.Error()
+		}
+		return
+	}
+	if gapp.Tier != PRODUCTION {
+		msg = fmt.Sprintf("%v", err)
+		return
+	}
+	if e, ok := err.(error); ok && code != http.StatusInternalServerError {
+		return errorutil.Base(e).Error(), ""
+	}
+	return http.StatusText(code), ""
+}
+
+//asHTTPError returns the HTTPError in an error (or panic value), possibly wrapped.
+func asHTTPError(err interface{}) (herr HTTPError, ok bool) {
+	if herr, ok = err.(HTTPError); ok {
+		return
+	}
+	if e, ok2 := err.(error); ok2 {
+		herr, ok = errorutil.Base(e).(HTTPError)
+	}
+	return
+}
+
+func writeErrJson(w http.ResponseWriter, code int, v interface{}) (err error) {
+	buf2, err := json.MarshalIndent(v, "  ", "  ")
+	if err != nil {
+		return
+	}
+	w.WriteHeader(code)
+	//fmt.Printf("(%s)\n", string(buf2))
+	_, err = w.Write(buf2)
+	return
+}
+
 func DumpRequest(c Context, r *http.Request) (err error) {
 	dump, err := httputil.DumpRequest(r, true)
 	if err != nil {
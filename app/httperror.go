@@ -0,0 +1,99 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// HTTPError is an error which determines the http response for it.
+//
+// The public message is shown to the user. The internal cause is logged,
+// and only shown to the user when the Tier is not PRODUCTION.
+type HTTPError interface {
+	error
+	StatusCode() int
+	PublicMessage() string
+	Cause() error
+	Headers() http.Header
+}
+
+// StatusError is the builtin HTTPError. It is typically created via the constructors
+// e.g. BadRequest, NotFound, etc.
+type StatusError struct {
+	Code    int
+	Message string      // public message (if "", the status text for the Code)
+	Err     error       // internal cause
+	Header  http.Header // headers to set on the response
+}
+
+// NewHTTPError returns an HTTPError with the status code, public message and internal cause.
+func NewHTTPError(code int, message string, cause error) *StatusError {
+	return &StatusError{Code: code, Message: message, Err: cause}
+}
+
+func BadRequest(message string, cause error) *StatusError {
+	return NewHTTPError(http.StatusBadRequest, message, cause)
+}
+
+func Unauthorized(message string, cause error) *StatusError {
+	return NewHTTPError(http.StatusUnauthorized, message, cause)
+}
+
+func Forbidden(message string, cause error) *StatusError {
+	return NewHTTPError(http.StatusForbidden, message, cause)
+}
+
+func NotFound(message string, cause error) *StatusError {
+	return NewHTTPError(http.StatusNotFound, message, cause)
+}
+
+func Conflict(message string, cause error) *StatusError {
+	return NewHTTPError(http.StatusConflict, message, cause)
+}
+
+func TooManyRequests(message string, cause error) *StatusError {
+	return NewHTTPError(http.StatusTooManyRequests, message, cause)
+}
+
+func InternalError(message string, cause error) *StatusError {
+	return NewHTTPError(http.StatusInternalServerError, message, cause)
+}
+
+func ServiceUnavailable(message string, cause error) *StatusError {
+	return NewHTTPError(http.StatusServiceUnavailable, message, cause)
+}
+
+// WithHeader adds a header to set on the response (e.g. WWW-Authenticate, Retry-After).
+func (e *StatusError) WithHeader(key, value string) *StatusError {
+	if e.Header == nil {
+		e.Header = make(http.Header)
+	}
+	e.Header.Add(key, value)
+	return e
+}
+
+func (e *StatusError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%d %s", e.Code, e.PublicMessage())
+	}
+	return fmt.Sprintf("%d %s: %v", e.Code, e.PublicMessage(), e.Err)
+}
+
+func (e *StatusError) StatusCode() int {
+	return e.Code
+}
+
+func (e *StatusError) PublicMessage() string {
+	if e.Message == "" {
+		return http.StatusText(e.Code)
+	}
+	return e.Message
+}
+
+func (e *StatusError) Cause() error {
+	return e.Err
+}
+
+func (e *StatusError) Headers() http.Header {
+	return e.Header
+}
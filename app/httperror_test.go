@@ -0,0 +1,39 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ugorji/go-common/errorutil"
+)
+
+func TestErrorMessage(t *testing.T) {
+	wrap := func(e error) (err error) {
+		defer errorutil.OnError(&err)
+		return e
+	}
+	for _, x := range []struct {
+		tier       Tier
+		err        interface{}
+		code       int
+		msg, cause string
+	}{
+		{PRODUCTION, wrap(PageNotFoundError("no such page")), 404, "no such page", ""},
+		{PRODUCTION, wrap(BadRequestError("bad id")), 400, "bad id", ""},
+		{PRODUCTION, wrap(errors.New("db: bad password")), 500, "Internal Server Error", ""},
+		{PRODUCTION, "panic: db: bad password", 500, "Internal Server Error", ""},
+		{PRODUCTION, wrap(NotFound("no such user", errors.New("sql: no rows"))), 404, "no such user", ""},
+		{DEVELOPMENT, wrap(NotFound("no such user", errors.New("sql: no rows"))), 404, "no such user", "sql: no rows"},
+		{DEVELOPMENT, PageNotFoundError("no such page"), 404, "no such page", ""},
+		{DEVELOPMENT, errors.New("db: bad password"), 500, "db: bad password", ""},
+	} {
+		gapp := new(BaseApp)
+		gapp.Tier = x.tier
+		code := errorStatusCode(x.err)
+		msg, cause := gapp.errorMessage(x.err, code)
+		if code != x.code || msg != x.msg || cause != x.cause {
+			t.Errorf("tier: %v, error: %v: expected: %d, %q, %q, got: %d, %q, %q",
+				x.tier, x.err, x.code, x.msg, x.cause, code, msg, cause)
+		}
+	}
+}
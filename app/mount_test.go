@@ -0,0 +1,61 @@
+package app_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db/memdb"
+	"github.com/ugorji/go-serverapp/internal/apptest"
+)
+
+type linkFn = func(ctx app.Context, route string, params ...interface{}) (string, error)
+
+// newMountedApp returns an app whose route "page" writes the path it got,
+// the url of the route from ToURL, and the url from Link (as used in templates).
+func newMountedApp(t *testing.T) app.HTTPHandler {
+	gapp := apptest.NewApp(t, memdb.New())
+	var rt *app.Route
+	rt = app.NewRouteFunc(gapp.Root, "page", func(c app.Context, w http.ResponseWriter, r *http.Request) error {
+		u, err := rt.ToURL("id", "5")
+		if err != nil {
+			return err
+		}
+		link, err := gapp.Views.FnMap["Link"].(linkFn)(c, "page", "id", 5, "?x", 1)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s %s %s", r.URL.Path, u, link)
+		return nil
+	}).Path("/page/${id}")
+	return app.HTTPHandler{App: gapp}
+}
+
+func TestMount(t *testing.T) {
+	parent := apptest.NewApp(t, memdb.New())
+	app.Mount(parent.Root, "m1", "/m1/", "", newMountedApp(t))
+	app.Mount(parent.Root, "m2", "/m2", "www.example.com", newMountedApp(t))
+	h := app.HTTPHandler{App: parent}
+	for _, x := range []struct {
+		host, path string
+		code       int
+		body       string
+	}{
+		{"a.com", "/m1/page/5", 200, "/page/5 /m1/page/5 /m1/page/5?x=1"},
+		{"www.example.com", "/m2/page/5", 200, "/page/5 //www.example.com/m2/page/5 //www.example.com/m2/page/5?x=1"},
+		{"WWW.Example.COM:8080", "/m2/page/5", 200, "/page/5 //www.example.com/m2/page/5 //www.example.com/m2/page/5?x=1"},
+		{"a.com", "/m2/page/5", 404, ""},
+		{"www.example.com", "/m3/page/5", 404, ""},
+	} {
+		// an origin-form request ie the host is only in the Host header
+		req := httptest.NewRequest("GET", x.path, nil)
+		req.Host = x.host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != x.code || (x.body != "" && w.Body.String() != x.body) {
+			t.Errorf("%s%s: expected: %d %q, got: %d %q", x.host, x.path, x.code, x.body, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ugorji/go-common/logging"
+	"github.com/ugorji/go-common/safestore"
+	"github.com/ugorji/go-serverapp/web"
+)
+
+// RateLimit returns Middleware which limits the rate of requests to a route
+// (and its descendants), using the limit and store of the RateLimitPipe
+// (see web.RateLimitPipe). If the key function returns "", the request is not limited.
+//
+// A request which exceeds the limit gets a TooManyRequests error.
+func RateLimit(p *web.RateLimitPipe, key func(c Context, r *http.Request) string) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(c Context, w http.ResponseWriter, r *http.Request) error {
+			if x := p.Allow(ctxctx(c), w.Header(), key(c, r)); !x.Allowed {
+				return TooManyRequests("", nil)
+			}
+			return h.HandleHttp(c, w, r)
+		})
+	}
+}
+
+// RouteRateLimitKey keys requests by the name of the route matched and the IP address
+// of the client, so each client has its own limit for each route.
+func RouteRateLimitKey(c Context, r *http.Request) string {
+	rt := CurrentRoute(c)
+	if rt == nil {
+		return ""
+	}
+	return "route:" + rt.Name + ":" + web.RemoteIPKey(r)
+}
+
+// CacheRateLimitStore is a web.RateLimitStore kept in a Cache (e.g. the SharedCache of the app),
+// so the limits are shared by all the processes of the app.
+//
+// As a Cache only supports atomic increments, it approximates the token bucket
+// with a counter per window of Burst/Rate seconds (the time to fill the bucket).
+// The first request in a window puts its counter with a TTL of 2 windows, so the Cache
+// can expire the counters of past windows (a few increments racing with that put may be lost).
+// If Rate is 0, the window is web.RateLimitIdle (ie Burst requests per hour).
+//
+// The Cache gets the Context of the request if used from the RateLimit Middleware,
+// else (from a web.RateLimitPipe) a nil Context.
+type CacheRateLimitStore struct {
+	Cache  Cache
+	Prefix string // prefix of the keys in the Cache
+}
+
+func (s CacheRateLimitStore) Take(ctx context.Context, key string, limit web.RateLimit, now time.Time) (
+	x web.RateLimitResult, err error) {
+	c, _ := ctx.Value(logging.AppContextKey).(Context)
+	window := web.RateLimitIdle
+	if limit.Rate > 0 {
+		if window = time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second)); window < time.Second {
+			window = time.Second
+		}
+	}
+	i := now.UnixNano() / int64(window)
+	ckey := s.Prefix + key + ":" + strconv.FormatInt(i, 10)
+	n, err := s.Cache.CacheIncr(c, ckey, 1, 0)
+	if err != nil {
+		return
+	}
+	if n == 1 {
+		if err = s.Cache.CachePut(c, &safestore.Item{Key: ckey, Value: n, TTL: 2 * window}); err != nil {
+			return
+		}
+	}
+	x.Reset = time.Duration((i+1)*int64(window) - now.UnixNano())
+	if n <= uint64(limit.Burst) {
+		x.Allowed = true
+		x.Remaining = limit.Burst - int(n)
+	} else {
+		x.RetryAfter = x.Reset
+	}
+	return
+}
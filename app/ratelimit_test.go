@@ -0,0 +1,86 @@
+package app_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go-common/safestore"
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db/memdb"
+	"github.com/ugorji/go-serverapp/internal/apptest"
+	"github.com/ugorji/go-serverapp/web"
+)
+
+func TestCacheRateLimitStore(t *testing.T) {
+	s := app.CacheRateLimitStore{Cache: app.SafeStoreCache{T: safestore.New(true)}, Prefix: "rl:"}
+	// windows of 10s, and (with Rate 0) of RateLimitIdle
+	now := time.Unix(1000, 0)
+	for i, x := range []struct {
+		key     string
+		limit   web.RateLimit
+		after   time.Duration
+		allowed bool
+		remain  int
+		reset   time.Duration
+	}{
+		{"a", web.RateLimit{Rate: 0.2, Burst: 2}, 0, true, 1, 10 * time.Second},
+		{"a", web.RateLimit{Rate: 0.2, Burst: 2}, 4 * time.Second, true, 0, 6 * time.Second},
+		{"a", web.RateLimit{Rate: 0.2, Burst: 2}, 9 * time.Second, false, 0, time.Second},
+		{"b", web.RateLimit{Rate: 0.2, Burst: 2}, 9 * time.Second, true, 1, time.Second},
+		{"a", web.RateLimit{Rate: 0.2, Burst: 2}, 10 * time.Second, true, 1, 10 * time.Second}, // next window
+		{"c", web.RateLimit{Rate: 0, Burst: 1}, 0, true, 0, web.RateLimitIdle - 1000*time.Second},
+		{"c", web.RateLimit{Rate: 0, Burst: 1}, 30 * time.Minute, false, 0, web.RateLimitIdle/2 - 1000*time.Second},
+	} {
+		r, err := s.Take(context.Background(), x.key, x.limit, now.Add(x.after))
+		if err != nil || r.Allowed != x.allowed || r.Remaining != x.remain || r.Reset != x.reset ||
+			(!x.allowed && r.RetryAfter != x.reset) {
+			t.Fatalf("take %d: expected allowed: %v, remaining: %d, reset: %v, got: %+v (error: %v)",
+				i, x.allowed, x.remain, x.reset, r, err)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gapp := apptest.NewApp(t, memdb.New())
+	p := &web.RateLimitPipe{
+		Limit: web.RateLimit{Rate: 0, Burst: 2}, // a window of an hour
+		Store: app.CacheRateLimitStore{Cache: app.SafeStoreCache{T: safestore.New(true)}},
+	}
+	gapp.Root.Use(app.RateLimit(p, app.RouteRateLimitKey))
+	app.NewRouteFunc(gapp.Root, "list", func(c app.Context, w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}).Path("/api/list")
+	app.NewRouteFunc(gapp.Root, "get", func(c app.Context, w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}).Path("/api/get")
+	h := app.HTTPHandler{App: gapp}
+	// each route has its own limit, for each client
+	for i, x := range []struct {
+		path, remoteAddr string
+		code             int
+		remaining        string
+	}{
+		{"/api/list", "10.0.0.1:1000", 204, "1"},
+		{"/api/list", "10.0.0.1:1001", 204, "0"},
+		{"/api/list", "10.0.0.1:1002", 429, "0"},
+		{"/api/get", "10.0.0.1:1003", 204, "1"},
+		{"/api/list", "10.0.0.2:1000", 204, "1"},
+	} {
+		req := httptest.NewRequest("GET", x.path, nil)
+		req.RemoteAddr = x.remoteAddr
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		hdr := w.Header()
+		if w.Code != x.code || hdr.Get("X-RateLimit-Limit") != "2" || hdr.Get("X-RateLimit-Remaining") != x.remaining ||
+			hdr.Get("X-RateLimit-Reset") == "" || (hdr.Get("Retry-After") != "") != (x.code == 429) {
+			t.Fatalf("request %d: %s from %s: expected: %d, remaining: %s, got: %d, %v",
+				i, x.path, x.remoteAddr, x.code, x.remaining, w.Code, hdr)
+		}
+	}
+}
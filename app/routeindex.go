@@ -0,0 +1,156 @@
+package app
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ugorji/go-common/regexputil"
+)
+
+// Routes with many children index them by the static part of their Path,
+// so Match only runs the matchers (and regexes) of the children which can match the path.
+//
+// The index is a radix tree over the static prefix of each child's Path template
+// (the text before its first variable or regexp character), or its full path for an
+// exact match. Children without a Path (or whose regexp is not anchored) are always
+// candidates. The candidates are checked in the order of Children, so the index
+// does not change which route is matched.
+//
+// The index is built on first use, and rebuilt if a child is added or a Path is set on a child.
+
+// minChildrenToIndex is the number of children a route must have, for them to be indexed.
+const minChildrenToIndex = 4
+
+type routeIndex struct {
+	numChildren int // number of children when it was built
+	always      []int
+	tree        pathIndexNode
+}
+
+type pathIndexNode struct {
+	label    string
+	children []*pathIndexNode
+	prefix   []int // routes whose static path prefix ends here
+	exact    []int // routes whose exact path ends here
+}
+
+// setPathIndex sets the static path (prefix) of this route used by its parent's index.
+// If the route has many Paths (all of which must match), the most specific one is used.
+func (rt *Route) setPathIndex(path string, exact bool) {
+	if !rt.pathIndexed || (exact && !rt.pathExact) ||
+		(exact == rt.pathExact && len(path) > len(rt.pathPrefix)) {
+		rt.pathPrefix, rt.pathExact, rt.pathIndexed = path, exact, true
+	}
+	if rt.Parent != nil {
+		rt.Parent.resetIndex()
+	}
+}
+
+func (rt *Route) resetIndex() {
+	rt.index.Store((*routeIndex)(nil))
+}
+
+// childIndex returns the index of the children of this route,
+// or nil if it has too few children to be indexed.
+func (rt *Route) childIndex() (idx *routeIndex) {
+	if len(rt.Children) < minChildrenToIndex {
+		return nil
+	}
+	idx, _ = rt.index.Load().(*routeIndex)
+	if idx == nil || idx.numChildren != len(rt.Children) {
+		idx = newRouteIndex(rt.Children)
+		rt.index.Store(idx)
+	}
+	return
+}
+
+func newRouteIndex(children []*Route) (idx *routeIndex) {
+	idx = &routeIndex{numChildren: len(children)}
+	for i, rt := range children {
+		if rt.pathIndexed {
+			idx.tree.insert(rt.pathPrefix, i, rt.pathExact)
+		} else {
+			idx.always = append(idx.always, i)
+		}
+	}
+	return
+}
+
+// candidates returns the indexes of the children which can match the path, in order.
+func (idx *routeIndex) candidates(path string) []int {
+	v := append(make([]int, 0, len(idx.always)+4), idx.always...)
+	v = idx.tree.lookup(path, v)
+	if len(v) > len(idx.always) {
+		sort.Ints(v)
+	}
+	return v
+}
+
+func (n *pathIndexNode) insert(s string, i int, exact bool) {
+	for s != "" {
+		var c *pathIndexNode
+		for _, c0 := range n.children {
+			if c0.label[0] == s[0] {
+				c = c0
+				break
+			}
+		}
+		if c == nil {
+			c = &pathIndexNode{label: s}
+			n.children = append(n.children, c)
+			n, s = c, ""
+			break
+		}
+		l := commonPrefixLen(c.label, s)
+		if l < len(c.label) {
+			// split the edge
+			c2 := &pathIndexNode{label: c.label[l:], children: c.children, prefix: c.prefix, exact: c.exact}
+			*c = pathIndexNode{label: c.label[:l], children: []*pathIndexNode{c2}}
+		}
+		n, s = c, s[l:]
+	}
+	if exact {
+		n.exact = append(n.exact, i)
+	} else {
+		n.prefix = append(n.prefix, i)
+	}
+}
+
+func (n *pathIndexNode) lookup(path string, v []int) []int {
+	for {
+		v = append(v, n.prefix...)
+		if path == "" {
+			return append(v, n.exact...)
+		}
+		var c *pathIndexNode
+		for _, c0 := range n.children {
+			if c0.label[0] == path[0] {
+				c = c0
+				break
+			}
+		}
+		if c == nil || !strings.HasPrefix(path, c.label) {
+			return v
+		}
+		n, path = c, path[len(c.label):]
+	}
+}
+
+func commonPrefixLen(a, b string) (i int) {
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return
+}
+
+// pathStaticPrefix returns the text of a Path template which any matching path must
+// start with ie the text before its first variable or regexp character.
+func pathStaticPrefix(pathRegexp string) string {
+	if i := strings.Index(pathRegexp, regexputil.InterpolatePrefix); i >= 0 {
+		pathRegexp = pathRegexp[:i]
+	}
+	if i := strings.IndexAny(pathRegexp, `\.+*?()|[]{}^$`); i >= 0 {
+		pathRegexp = pathRegexp[:i]
+	}
+	return pathRegexp
+}
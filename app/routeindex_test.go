@@ -0,0 +1,134 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ugorji/go-common/safestore"
+)
+
+// matchLinear is Match without the index ie it checks all the children in order.
+func matchLinear(rt *Route, store safestore.I, req *http.Request) *Route {
+	if !rt.matches(store, req, false) {
+		return nil
+	}
+	for _, rt1 := range rt.Children {
+		if rt2 := matchLinear(rt1, store, req); rt2 != nil {
+			return rt2
+		}
+	}
+	return rt
+}
+
+func newTestRouteTree() (root *Route) {
+	h := writeHandler("")
+	root = NewRoot("Root")
+	NewRouteFunc(root, "home", h).Path("/")
+	NewRouteFunc(root, "users", h).Path("/users")
+	NewRouteFunc(root, "user", h).Path("/users/${id}")
+	user := NewRouteFunc(root, "user-sub", h).Path("/users/${id}/${rest:.*}")
+	NewRouteFunc(user, "user-posts", h).Path("/users/${id}/posts")
+	NewRouteFunc(user, "user-post", h).Path("/users/${id}/posts/${pid}")
+	NewRouteFunc(root, "hosted", h).Host("${sub}.example.com").Path("/h/${x}")
+	NewRouteFunc(root, "header", h).Header("X-Test", "yes")
+	NewRouteFunc(root, "blog-index", h).Path("/blog")
+	NewRouteFunc(root, "blog", h).Path("/blog/${year}/${slug}")
+	NewRouteFunc(root, "static", h).Path("/static/${file:.*}")
+	api := NewRouteFunc(root, "api", h).Path("/api/${rest:.*}")
+	for i := 0; i < 10; i++ {
+		NewRouteFunc(api, fmt.Sprintf("api-res%d", i), h).Path(fmt.Sprintf("/api/res%d/${id}", i))
+		NewRouteFunc(api, fmt.Sprintf("api-res%d-all", i), h).Path(fmt.Sprintf("/api/res%d", i))
+	}
+	return
+}
+
+func TestMatchIndexSameAsLinear(t *testing.T) {
+	root := newTestRouteTree()
+	for _, x := range []struct {
+		host, path, header string
+		name               string
+	}{
+		{"a.com", "/", "", "home"},
+		{"a.com", "/users", "", "users"},
+		{"a.com", "/users/12", "", "user"},
+		{"a.com", "/users/12/posts", "", "user-posts"},
+		{"a.com", "/users/12/posts/3", "", "user-post"},
+		{"a.com", "/users/12/likes", "", "user-sub"},
+		{"www.example.com", "/h/1", "", "hosted"},
+		{"a.com", "/h/1", "", "Root"},
+		{"a.com", "/h/1", "yes", "header"},
+		{"www.example.com", "/users/12", "yes", "user"},
+		{"a.com", "/blog", "", "blog-index"},
+		{"www.example.com", "/blog", "", "blog-index"},
+		{"a.com", "/blog/2020/hello", "", "blog"},
+		{"a.com", "/blog/2020", "", "Root"},
+		{"a.com", "/static/css/a.css", "", "static"},
+		{"a.com", "/api/res3/7", "", "api-res3"},
+		{"a.com", "/api/res3", "", "api-res3-all"},
+		{"a.com", "/api/res30", "", "api"},
+		{"a.com", "/none", "", "Root"},
+	} {
+		r := httptest.NewRequest("GET", "http://"+x.host+x.path, nil)
+		if x.header != "" {
+			r.Header.Set("X-Test", x.header)
+		}
+		store1, store2 := safestore.New(false), safestore.New(false)
+		rt1, rt2 := root.Match(store1, r), matchLinear(root, store2, r)
+		if rt1.Name != x.name || rt2.Name != x.name {
+			t.Errorf("%s%s: expected route: %s, got: %s (linear: %s)", x.host, x.path, x.name, rt1.Name, rt2.Name)
+		}
+		if vars1, vars2 := Vars(store1), Vars(store2); !reflect.DeepEqual(vars1, vars2) {
+			t.Errorf("%s%s: vars: %v, linear: %v", x.host, x.path, vars1, vars2)
+		}
+	}
+	if root.childIndex() == nil || root.FindByName("api").childIndex() == nil {
+		t.Errorf("expected the children of Root and api to be indexed")
+	}
+}
+
+// newBenchRouteTree returns a tree with n routes under the root, in groups of size
+// (fewer than minChildrenToIndex means the children of a group are not indexed).
+func newBenchRouteTree(n, size int) (root *Route) {
+	h := writeHandler("")
+	root = NewRoot("Root")
+	for i := 0; i < n/size; i++ {
+		g := NewRouteFunc(root, fmt.Sprintf("g%d", i), h).Path(fmt.Sprintf("/g%d/${rest:.*}", i))
+		for j := 0; j < size; j++ {
+			NewRouteFunc(g, fmt.Sprintf("g%d-r%d", i, j), h).Path(fmt.Sprintf("/g%d/r%d/${id}", i, j))
+		}
+	}
+	return
+}
+
+func benchmarkMatch(b *testing.B, n, size int, linear bool) {
+	root := newBenchRouteTree(n, size)
+	r := httptest.NewRequest("GET", fmt.Sprintf("/g%d/r%d/42", n/size-1, size-1), nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store := safestore.New(false)
+		var rt *Route
+		if linear {
+			rt = matchLinear(root, store, r)
+		} else {
+			rt = root.Match(store, r)
+		}
+		if rt == root {
+			b.Fatal("no match")
+		}
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	for _, x := range []struct{ n, size int }{{300, minChildrenToIndex - 1}, {300, 30}, {1000, 100}} {
+		for _, linear := range []bool{false, true} {
+			name := fmt.Sprintf("routes=%d/group=%d/indexed", x.n, x.size)
+			if linear {
+				name = fmt.Sprintf("routes=%d/group=%d/linear", x.n, x.size)
+			}
+			b.Run(name, func(b *testing.B) { benchmarkMatch(b, x.n, x.size, linear) })
+		}
+	}
+}
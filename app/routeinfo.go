@@ -0,0 +1,312 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/ugorji/go-common/regexputil"
+)
+
+// DevRoutesPath is the path at which a development server renders its route tree
+// (see RoutesHandler).
+const DevRoutesPath = "/_dev/routes"
+
+// matcherDesc describes a Matcher added by the builtin methods (Host, Path, etc).
+type matcherDesc struct {
+	kind  string // Host, Path, etc, or True or custom
+	arg   string
+	path  string         // Path: clean template
+	re    *regexp.Regexp // Path: regexp
+	exact bool           // Path: no variables (ie exact match)
+}
+
+func (d matcherDesc) String() string {
+	if d.arg == "" {
+		return d.kind
+	}
+	return d.kind + "(" + d.arg + ")"
+}
+
+// addMatcher adds a Matcher, keeping its description at the same index as it.
+func (rt *Route) addMatcher(d matcherDesc, x Matcher) {
+	for len(rt.mdesc) < len(rt.Matchers) {
+		rt.mdesc = append(rt.mdesc, matcherDesc{kind: "custom"})
+	}
+	rt.Matchers = append(rt.Matchers, x)
+	rt.mdesc = append(rt.mdesc, d)
+}
+
+func (rt *Route) matcherDescs() []matcherDesc {
+	ds := rt.mdesc
+	if len(ds) > len(rt.Matchers) {
+		ds = ds[:len(rt.Matchers)]
+	}
+	for len(ds) < len(rt.Matchers) {
+		ds = append(ds[:len(ds):len(ds)], matcherDesc{kind: "custom"})
+	}
+	return ds
+}
+
+// Walk calls fn for this route and all its descendants, depth-first
+// in the order they are matched. It stops at the first error returned by fn.
+func (rt *Route) Walk(fn func(rt *Route, depth int) error) error {
+	return rt.walk(fn, 0)
+}
+
+func (rt *Route) walk(fn func(rt *Route, depth int) error, depth int) (err error) {
+	if err = fn(rt, depth); err != nil {
+		return
+	}
+	for _, rt1 := range rt.Children {
+		if err = rt1.walk(fn, depth+1); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// RouteInfo describes a Route and its descendants.
+type RouteInfo struct {
+	Name       string
+	Path       string       `json:",omitempty"` // url template (Path, Host, Scheme, Query)
+	Host       string       `json:",omitempty"`
+	Scheme     string       `json:",omitempty"`
+	Query      string       `json:",omitempty"`
+	Vars       []string     `json:",omitempty"` // variables in the Host, Path and Query templates
+	Params     []string     `json:",omitempty"` // form parameters checked by Param
+	Methods    []string     `json:",omitempty"`
+	Matchers   []string     `json:",omitempty"` // in the order they are run
+	Middleware int          `json:",omitempty"`
+	Handler    string       `json:",omitempty"` // type (or function name) of the Handler
+	Children   []*RouteInfo `json:",omitempty"`
+}
+
+// Describe returns a description of this route and its descendants.
+func (rt *Route) Describe() *RouteInfo {
+	ri := &RouteInfo{
+		Name:       rt.Name,
+		Path:       rt.url.Path,
+		Host:       rt.url.Host,
+		Scheme:     rt.url.Scheme,
+		Query:      rt.url.RawQuery,
+		Methods:    rt.methods,
+		Middleware: len(rt.mw),
+		Handler:    handlerName(rt.Handler),
+	}
+	if q, err := url.QueryUnescape(ri.Query); err == nil {
+		ri.Query = q
+	}
+	ri.Vars = append(append(templateVars(ri.Host), templateVars(ri.Path)...), templateVars(ri.Query)...)
+	for _, d := range rt.matcherDescs() {
+		ri.Matchers = append(ri.Matchers, d.String())
+		if d.kind == "Param" {
+			ri.Params = append(ri.Params, d.arg)
+		}
+	}
+	for _, rt1 := range rt.Children {
+		ri.Children = append(ri.Children, rt1.Describe())
+	}
+	return ri
+}
+
+// RouteIssue describes a route which will never be matched (or found by name).
+type RouteIssue struct {
+	Route      *Route
+	ShadowedBy *Route // route (earlier sibling or first route of same name) which hides it, if any
+	Reason     string
+}
+
+func (x RouteIssue) String() string {
+	if x.ShadowedBy == nil {
+		return fmt.Sprintf("route: %s: %s", x.Route.Name, x.Reason)
+	}
+	return fmt.Sprintf("route: %s: %s: %s", x.Route.Name, x.Reason, x.ShadowedBy.Name)
+}
+
+// Check looks for routes under this one which will never be matched or found by name:
+//   - routes with no matchers or methods (which match nothing)
+//   - routes shadowed by an earlier sibling, which matches all the requests they match
+//     (this is determined from the builtin matchers, as custom Matchers cannot be compared)
+//   - routes with the same name as an earlier route (FindByName returns the first)
+func (rt *Route) Check() (issues []RouteIssue) {
+	names := make(map[string]*Route)
+	rt.Walk(func(rt2 *Route, depth int) error {
+		if rt3, ok := names[rt2.Name]; ok {
+			issues = append(issues, RouteIssue{rt2, rt3, "duplicate name"})
+		} else {
+			names[rt2.Name] = rt2
+		}
+		if depth > 0 && len(rt2.Matchers) == 0 && rt2.methods == nil {
+			issues = append(issues, RouteIssue{rt2, nil, "no matchers"})
+			return nil
+		}
+		if depth == 0 {
+			return nil
+		}
+		for _, rt3 := range rt2.Parent.siblingsBefore(rt2) {
+			if rt3.shadows(rt2) {
+				issues = append(issues, RouteIssue{rt2, rt3, "shadowed by"})
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (rt *Route) siblingsBefore(rt2 *Route) []*Route {
+	for i, rt3 := range rt.Children {
+		if rt3 == rt2 {
+			return rt.Children[:i]
+		}
+	}
+	return nil
+}
+
+// shadows returns true if this route matches all requests that rt2 matches.
+func (rt *Route) shadows(rt2 *Route) bool {
+	if len(rt.Matchers) == 0 && rt.methods == nil {
+		return false
+	}
+	if rt.methods != nil {
+		if rt2.methods == nil {
+			return false
+		}
+		for _, m := range rt2.methods {
+			if !methodAllowed(rt.methods, m) {
+				return false
+			}
+		}
+	}
+	ds2 := rt2.matcherDescs()
+L:
+	for _, d := range rt.matcherDescs() {
+		switch d.kind {
+		case "True":
+			continue
+		case "custom":
+			return false
+		}
+		for _, d2 := range ds2 {
+			if d.implied(d2) {
+				continue L
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// implied returns true if a request which passes d2 always passes d.
+func (d matcherDesc) implied(d2 matcherDesc) bool {
+	if d.kind != d2.kind {
+		return false
+	}
+	if d.arg == d2.arg {
+		return true
+	}
+	if d.kind == "Path" && d2.exact {
+		if d.exact {
+			return d.path == d2.path
+		}
+		return d.re != nil && d.re.MatchString(d2.path)
+	}
+	return false
+}
+
+// RoutesHandler returns a Handler which renders the route tree at root,
+// and any issues found by Check, as text (or json if the format parameter is json).
+//
+// A development server serves it at DevRoutesPath.
+func RoutesHandler(root *Route) HandlerFunc {
+	return func(c Context, w http.ResponseWriter, r *http.Request) (err error) {
+		issues := root.Check()
+		if r.FormValue("format") == "json" {
+			x := struct {
+				Routes *RouteInfo
+				Issues []string
+			}{Routes: root.Describe()}
+			for _, v := range issues {
+				x.Issues = append(x.Issues, v.String())
+			}
+			w.Header().Set("Content-Type", "application/json")
+			return json.NewEncoder(w).Encode(&x)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err = writeRouteInfo(w, root.Describe(), 0); err != nil {
+			return
+		}
+		if len(issues) > 0 {
+			if _, err = io.WriteString(w, "\nIssues:\n"); err != nil {
+				return
+			}
+			for _, v := range issues {
+				if _, err = fmt.Fprintf(w, "  - %v\n", v); err != nil {
+					return
+				}
+			}
+		}
+		return
+	}
+}
+
+func writeRouteInfo(w io.Writer, ri *RouteInfo, depth int) (err error) {
+	s := strings.Repeat("  ", depth) + ri.Name
+	if len(ri.Matchers) > 0 {
+		s += " " + strings.Join(ri.Matchers, " ")
+	}
+	if len(ri.Methods) > 0 {
+		s += " [" + strings.Join(ri.Methods, ",") + "]"
+	}
+	if ri.Middleware > 0 {
+		s += fmt.Sprintf(" (middleware: %d)", ri.Middleware)
+	}
+	if ri.Handler != "" {
+		s += " -> " + ri.Handler
+	}
+	if _, err = io.WriteString(w, s+"\n"); err != nil {
+		return
+	}
+	for _, ri1 := range ri.Children {
+		if err = writeRouteInfo(w, ri1, depth+1); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func handlerName(h Handler) string {
+	if h == nil {
+		return ""
+	}
+	if hf, ok := h.(HandlerFunc); ok {
+		if fn := runtime.FuncForPC(reflect.ValueOf(hf).Pointer()); fn != nil {
+			return fn.Name()
+		}
+	}
+	return fmt.Sprintf("%T", h)
+}
+
+// templateVars returns the names of the variables in a clean template e.g. /show/${id}.
+func templateVars(s string) (vars []string) {
+	for {
+		i := strings.Index(s, regexputil.InterpolatePrefix)
+		if i < 0 {
+			return
+		}
+		s = s[i+len(regexputil.InterpolatePrefix):]
+		j := strings.Index(s, regexputil.InterpolatePostfix)
+		if j < 0 {
+			return
+		}
+		vars = append(vars, s[:j])
+		s = s[j+len(regexputil.InterpolatePostfix):]
+	}
+}
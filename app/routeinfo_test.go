@@ -0,0 +1,63 @@
+package app
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/ugorji/go-common/safestore"
+)
+
+func TestCheck(t *testing.T) {
+	root := NewRoot("Root")
+	h := writeHandler("")
+	custom := func(store safestore.I, req *http.Request) (bool, error) { return true, nil }
+
+	// a regexp Path shadows an exact Path it matches, but not the reverse
+	NewRoute(root, "user", h).Path("/user/${id}")
+	NewRoute(root, "userMe", h).Path("/user/me")
+	NewRoute(root, "item", h).Path("/item/${id:int}")
+	NewRoute(root, "itemNew", h).Path("/item/new")
+	NewRoute(root, "page", h).Path("/page/me")
+	NewRoute(root, "page2", h).Path("/page/${id}")
+	NewRoute(root, "about", h).Path("/about")
+	NewRoute(root, "about2", h).Path("/about").Header("X-Debug", "1")
+	NewRoute(root, "aboutPage", h).Path("/about").Query("page", "${page}")
+
+	// methods: a route with methods only shadows routes whose methods it allows
+	NewRoute(root, "get", h).Path("/get").Method("GET", "POST")
+	NewRoute(root, "getHead", h).Path("/get").Method("HEAD")
+	NewRoute(root, "getAny", h).Path("/get")
+	NewRoute(root, "put", h).Path("/put").Method("PUT")
+	NewRoute(root, "putAny", h).Path("/put")
+
+	// custom Matchers cannot be compared
+	NewRoute(root, "custom", h).Path("/custom").AddMatcher(custom)
+	NewRoute(root, "custom2", h).Path("/custom")
+	NewRoute(root, "custom3", h).Path("/custom").AddMatcher(custom)
+
+	// no matchers, and duplicate names (also in another branch)
+	NewRoute(root, "empty", h)
+	api := NewRoute(root, "api", h).Host("api.example.com")
+	NewRoute(api, "about", h).Path("/about")
+	NewRoute(api, "list", h).Path("/list")
+	NewRoute(api, "list", h).Path("/list2")
+
+	var issues []string
+	for _, x := range root.Check() {
+		issues = append(issues, x.String())
+	}
+	exp := []string{
+		"route: userMe: shadowed by: user",
+		"route: about2: shadowed by: about",
+		"route: aboutPage: shadowed by: about",
+		"route: getHead: shadowed by: get",
+		"route: custom3: shadowed by: custom2",
+		"route: empty: no matchers",
+		"route: about: duplicate name: about",
+		"route: list: duplicate name: list",
+	}
+	if !reflect.DeepEqual(issues, exp) {
+		t.Fatalf("expected issues: %q, got: %q", exp, issues)
+	}
+}
@@ -0,0 +1,215 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ugorji/go-common/regexputil"
+)
+
+// ParamType is a type of route parameter, declared in a template as ${name:type}
+// e.g. /show/${id:int}.
+//
+// A parameter can also be declared with a regexp e.g. ${slug:[a-z-]+}.
+// As in the regexp of a ParamType, braces are not supported (e.g. ${year:[0-9]{4}}).
+type ParamType struct {
+	Name string
+	// Regexp is used in place of the type name in the route regexp.
+	// It must not contain braces.
+	Regexp string
+	// Check (optional) validates a value matched by Regexp (e.g. its range).
+	Check func(s string) error
+}
+
+var (
+	paramTypesMu sync.RWMutex
+	paramTypes   = make(map[string]*ParamType)
+)
+
+func init() {
+	hex := "[0-9a-fA-F]"
+	for _, t := range []*ParamType{
+		{Name: "int", Regexp: "-?[0-9]+", Check: func(s string) (err error) {
+			_, err = strconv.ParseInt(s, 10, 64)
+			return
+		}},
+		{Name: "uint", Regexp: "[0-9]+", Check: func(s string) (err error) {
+			_, err = strconv.ParseUint(s, 10, 64)
+			return
+		}},
+		{Name: "hex", Regexp: hex + "+"},
+		{Name: "uuid", Regexp: strings.Repeat(hex, 8) + "-" + strings.Repeat(hex, 4) + "-" +
+			strings.Repeat(hex, 4) + "-" + strings.Repeat(hex, 4) + "-" + strings.Repeat(hex, 12)},
+		{Name: "alpha", Regexp: "[a-zA-Z]+"},
+		{Name: "alnum", Regexp: "[a-zA-Z0-9]+"},
+	} {
+		paramTypes[t.Name] = t
+	}
+}
+
+// RegisterParamType registers a type of route parameter, so it can be declared
+// in templates as ${name:type}. The builtin types are:
+// int, uint, hex, uuid, alpha and alnum.
+func RegisterParamType(t *ParamType) error {
+	if t.Name == "" || t.Regexp == "" {
+		return fmt.Errorf("RegisterParamType: name and regexp are required")
+	}
+	if strings.ContainsAny(t.Regexp, "{}") {
+		return fmt.Errorf("RegisterParamType: regexp of type: %s contains braces", t.Name)
+	}
+	paramTypesMu.Lock()
+	defer paramTypesMu.Unlock()
+	if _, ok := paramTypes[t.Name]; ok {
+		return fmt.Errorf("RegisterParamType: type: %s already registered", t.Name)
+	}
+	paramTypes[t.Name] = t
+	return nil
+}
+
+func getParamType(name string) (t *ParamType) {
+	paramTypesMu.RLock()
+	t = paramTypes[name]
+	paramTypesMu.RUnlock()
+	return
+}
+
+// paramSpec is the type or regexp declared for a route parameter.
+type paramSpec struct {
+	typ *ParamType // nil if declared with a regexp
+	re  *regexp.Regexp
+}
+
+func (p *paramSpec) check(s string) error {
+	if !p.re.MatchString(s) {
+		if p.typ != nil {
+			return fmt.Errorf("value: %q is not a valid %s", s, p.typ.Name)
+		}
+		return fmt.Errorf("value: %q does not match: %s", s, p.re)
+	}
+	if p.typ != nil && p.typ.Check != nil {
+		if err := p.typ.Check(s); err != nil {
+			return fmt.Errorf("value: %q is not a valid %s: %v", s, p.typ.Name, err)
+		}
+	}
+	return nil
+}
+
+// parseTemplate replaces the typed parameters in the template with the regexp of
+// their type, records the type or regexp of each parameter in the route,
+// and parses it via regexputil.ParseRegexTemplate.
+func (rt *Route) parseTemplate(tmpl string) (re *regexp.Regexp, sclean string, keys []string, err error) {
+	var buf strings.Builder
+	s := tmpl
+	for {
+		i := strings.Index(s, regexputil.InterpolatePrefix)
+		if i < 0 {
+			buf.WriteString(s)
+			break
+		}
+		buf.WriteString(s[:i+len(regexputil.InterpolatePrefix)])
+		s = s[i+len(regexputil.InterpolatePrefix):]
+		// find the closing brace, skipping braces in a regexp e.g. ${year:[0-9]{4}},
+		// so it is reported (as regexputil.ParseRegexTemplate does not support them)
+		j, depth := 0, 0
+		for ; j < len(s); j++ {
+			if s[j] == '{' {
+				depth++
+			} else if s[j] == '}' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			}
+		}
+		if j == len(s) {
+			err = fmt.Errorf("Unterminated parameter in route template: %s", tmpl)
+			return
+		}
+		name, spec := s[:j], ""
+		if k := strings.IndexByte(name, ':'); k >= 0 {
+			name, spec = name[:k], name[k+1:]
+		}
+		if strings.ContainsAny(spec, "{}") {
+			err = fmt.Errorf("Parameter: %s in route template: %s: braces are not supported in its regexp "+
+				"(e.g. use [0-9][0-9] in place of [0-9]{2})", name, tmpl)
+			return
+		}
+		if spec != "" {
+			p := new(paramSpec)
+			if p.typ = getParamType(spec); p.typ != nil {
+				spec = p.typ.Regexp
+			}
+			if p.re, err = regexp.Compile("^(?:" + spec + ")$"); err != nil {
+				return
+			}
+			if rt.params == nil {
+				rt.params = make(map[string]*paramSpec)
+			}
+			rt.params[name] = p
+			buf.WriteString(name + ":" + spec)
+		} else {
+			buf.WriteString(name)
+		}
+		s = s[j:]
+	}
+	return regexputil.ParseRegexTemplate(buf.String())
+}
+
+// checkVars checks the typed parameters matched in a request (ie res from FindStringSubmatch).
+func (rt *Route) checkVars(keys []string, res []string) bool {
+	if rt.params == nil {
+		return true
+	}
+	for i := 0; i < len(keys) && i+1 < len(res); i++ {
+		if p := rt.params[keys[i]]; p != nil && p.typ != nil && p.typ.Check != nil {
+			if p.typ.Check(res[i+1]) != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkParams validates the parameters given to ToURLX against the types
+// (or regexps) declared for them in this route and its ancestors.
+func (rt *Route) checkParams(params map[string]interface{}) (err error) {
+	for rt2 := rt; rt2 != nil; rt2 = rt2.Parent {
+		for name, p := range rt2.params {
+			v, ok := params[name]
+			if !ok {
+				continue
+			}
+			if err = p.check(fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("Invalid parameter: %s for route: %s: %v", name, rt.Name, err)
+			}
+		}
+	}
+	return
+}
+
+// Var returns the value of the route variable (see Vars) for this request.
+func Var(c Context, name string) (s string, ok bool) {
+	s, ok = Vars(c.Store())[name]
+	return
+}
+
+// VarInt returns the value of the route variable for this request as an int64.
+func VarInt(c Context, name string) (i int64, err error) {
+	s, ok := Var(c, name)
+	if !ok {
+		return 0, fmt.Errorf("No route variable: %s", name)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// VarUint returns the value of the route variable for this request as a uint64.
+func VarUint(c Context, name string) (u uint64, err error) {
+	s, ok := Var(c, name)
+	if !ok {
+		return 0, fmt.Errorf("No route variable: %s", name)
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
@@ -0,0 +1,71 @@
+package app
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ugorji/go-common/safestore"
+)
+
+func TestParamBracesRejected(t *testing.T) {
+	rt := NewRouteFunc(NewRoot("Root"), "archive", writeHandler(""))
+	_, _, _, err := rt.parseTemplate("/archive/${year:[0-9]{4}}")
+	if err == nil || !strings.Contains(err.Error(), "braces") {
+		t.Fatalf("expected error about braces, got: %v", err)
+	}
+	defer func() {
+		if x := recover(); x == nil {
+			t.Errorf("expected Path to panic")
+		}
+	}()
+	rt.Path("/archive/${year:[0-9]{4}}")
+}
+
+func TestParamTypes(t *testing.T) {
+	root := NewRoot("Root")
+	show := NewRouteFunc(root, "show", writeHandler("")).Path("/show/${id:int}")
+	post := NewRouteFunc(root, "post", writeHandler("")).Path("/post/${slug:[a-z-]+}")
+
+	for _, x := range []struct {
+		path, name, varName, varValue string
+	}{
+		{"/show/12", "show", "id", "12"},
+		{"/show/-3", "show", "id", "-3"},
+		{"/show/abc", "Root", "", ""},
+		{"/show/99999999999999999999", "Root", "", ""}, // overflows an int64
+		{"/post/hello-world", "post", "slug", "hello-world"},
+		{"/post/Hello", "Root", "", ""},
+	} {
+		store := safestore.New(false)
+		rt := root.Match(store, httptest.NewRequest("GET", x.path, nil))
+		if rt.Name != x.name {
+			t.Errorf("%s: expected route: %s, got: %s", x.path, x.name, rt.Name)
+		}
+		if x.varName != "" && Vars(store)[x.varName] != x.varValue {
+			t.Errorf("%s: expected %s: %q, got: %q", x.path, x.varName, x.varValue, Vars(store)[x.varName])
+		}
+	}
+
+	for _, x := range []struct {
+		rt     *Route
+		params map[string]interface{}
+		path   string // "" means an error is expected
+	}{
+		{show, map[string]interface{}{"id": 12}, "/show/12"},
+		{show, map[string]interface{}{"id": "12"}, "/show/12"},
+		{show, map[string]interface{}{"id": "abc"}, ""},
+		{show, map[string]interface{}{"id": "99999999999999999999"}, ""},
+		{post, map[string]interface{}{"slug": "hello-world"}, "/post/hello-world"},
+		{post, map[string]interface{}{"slug": "Hello!"}, ""},
+	} {
+		u, err := x.rt.ToURLX(x.params)
+		if x.path == "" {
+			if err == nil {
+				t.Errorf("%s: %v: expected error, got: %v", x.rt.Name, x.params, u)
+			}
+		} else if err != nil || u.Path != x.path {
+			t.Errorf("%s: %v: expected: %s, got: %v (error: %v)", x.rt.Name, x.params, x.path, u, err)
+		}
+	}
+}
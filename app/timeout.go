@@ -0,0 +1,53 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/ugorji/go-serverapp/web"
+)
+
+// Timeout returns Middleware which sets a deadline on the requests to a route
+// (and its descendants), in addition to any set by a web.TimeoutPipe.
+//
+// The deadline is on the context of the request, and on CtxCtx. The Handler runs in
+// another goroutine (see web.RunWithDeadline). At the deadline, if the response is not
+// committed, a ServiceUnavailable error is returned. Else the response is cut short.
+//
+// At the deadline, Timeout returns while the Handler may still be running in its
+// goroutine, with the same Context (and store) which Dispatch and the error handling
+// go on to use. So a Handler must stop at the deadline ie once r.Context() is done
+// (CtxCtx reverts to the context it had before, once Timeout returns).
+func Timeout(d time.Duration) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(c Context, w http.ResponseWriter, r *http.Request) (err error) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			store := c.Store()
+			parent := store.Get(RequestContextKey)
+			store.Put(RequestContextKey, ctx, 0)
+			defer store.Put(RequestContextKey, parent, 0)
+			w2, isRW := w.(web.ResponseWriter)
+			if !isRW {
+				w2 = web.AsResponseWriter(w)
+			}
+			var herr error
+			err = web.RunWithDeadline(w2, r.WithContext(ctx), func(w3 web.ResponseWriter, r3 *http.Request) {
+				herr = h.HandleHttp(c, w3, r3)
+			})
+			if err == nil {
+				if !isRW {
+					w2.Flush()
+				}
+				return herr
+			}
+			log.Warning(ctxctx(c), "Request: %s%s: %v after %v (response committed: %v)",
+				r.Host, r.URL.Path, err, d, w2.IsHeaderWritten())
+			if w2.IsHeaderWritten() {
+				return nil
+			}
+			return ServiceUnavailable("request timed out", err)
+		})
+	}
+}
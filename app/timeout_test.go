@@ -0,0 +1,28 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutRestoresContext(t *testing.T) {
+	for _, sleep := range []time.Duration{0, 100 * time.Millisecond} {
+		h := Timeout(20 * time.Millisecond)(HandlerFunc(func(c Context, w http.ResponseWriter, r *http.Request) error {
+			// it does not stop at the deadline, so it returns well after it
+			time.Sleep(sleep)
+			return nil
+		}))
+		c := newTestContext()
+		c.Store().Put(RequestContextKey, context.Background(), 0)
+		err := h.HandleHttp(c, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if timedOut := sleep > 0; timedOut != (err != nil) {
+			t.Errorf("sleep: %v: expected timeout: %v, got error: %v", sleep, timedOut, err)
+		}
+		if err := CtxCtx(c).Err(); err != nil {
+			t.Errorf("sleep: %v: context of the request not restored: %v", sleep, err)
+		}
+	}
+}
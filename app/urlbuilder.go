@@ -0,0 +1,153 @@
+package app
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/ugorji/go-common/errorutil"
+)
+
+// URLBuilder builds the url for a Route, from named parameters, extra query values
+// and a fragment. The url can be absolute (with scheme and host) or relative.
+//
+// Unlike ToURLX, Build returns an error if a parameter in the url templates
+// of the route is not given, or if a parameter given is not used.
+//
+// Typical usage:
+//   u, err := rt.URL().Param("id", 5).Query("page", "2").Fragment("top").Absolute().Build(ctx)
+type URLBuilder struct {
+	rt       *Route
+	params   map[string]interface{}
+	query    url.Values
+	fragment string
+	scheme   string
+	mode     int // 0: as the route's url, 1: absolute, -1: relative
+}
+
+// URL returns a URLBuilder for this route.
+func (rt *Route) URL() *URLBuilder {
+	return &URLBuilder{rt: rt, params: make(map[string]interface{})}
+}
+
+// Param sets the value of a parameter in the url templates of the route.
+func (b *URLBuilder) Param(name string, value interface{}) *URLBuilder {
+	b.params[name] = value
+	return b
+}
+
+// Params sets the values of parameters in the url templates of the route.
+func (b *URLBuilder) Params(params map[string]interface{}) *URLBuilder {
+	for k, v := range params {
+		b.params[k] = v
+	}
+	return b
+}
+
+// Query adds values for a query parameter, in addition to those of the route.
+func (b *URLBuilder) Query(name string, values ...string) *URLBuilder {
+	if b.query == nil {
+		b.query = make(url.Values)
+	}
+	b.query[name] = append(b.query[name], values...)
+	return b
+}
+
+// Fragment sets the fragment of the url.
+func (b *URLBuilder) Fragment(fragment string) *URLBuilder {
+	b.fragment = fragment
+	return b
+}
+
+// Scheme sets the scheme of an absolute url, if the route does not declare one.
+func (b *URLBuilder) Scheme(scheme string) *URLBuilder {
+	b.scheme = scheme
+	return b
+}
+
+// Absolute makes the url absolute. If the route does not declare a host,
+// the host of the app is used (see LowLevelDriver.Host). If neither the route
+// nor the builder declares a scheme, it is http in DEVELOPMENT, else https.
+func (b *URLBuilder) Absolute() *URLBuilder {
+	b.mode = 1
+	return b
+}
+
+// Relative makes the url relative ie without a scheme or host.
+func (b *URLBuilder) Relative() *URLBuilder {
+	b.mode = -1
+	return b
+}
+
+// Build returns the url. The Context is only used for an Absolute url.
+func (b *URLBuilder) Build(ctx Context) (u *url.URL, err error) {
+	defer errorutil.OnError(&err)
+	if err = b.checkParams(); err != nil {
+		return
+	}
+	if u, err = b.rt.ToURLX(b.params); err != nil {
+		return
+	}
+	if len(b.query) > 0 {
+		q := u.Query()
+		for k, v := range b.query {
+			q[k] = append(q[k], v...)
+		}
+		u.RawQuery = q.Encode()
+	}
+	u.Fragment = b.fragment
+	switch b.mode {
+	case 1:
+		if u.Host == "" {
+			dr := AppDriver(ctx.AppUUID())
+			if u.Host, err = dr.Host(ctx); err != nil {
+				return
+			}
+		}
+		if u.Scheme == "" {
+			u.Scheme = b.scheme
+		}
+		if u.Scheme == "" {
+			u.Scheme = "https"
+			if AppDriver(ctx.AppUUID()).Info().Tier == DEVELOPMENT {
+				u.Scheme = "http"
+			}
+		}
+	case -1:
+		u.Scheme, u.Host, u.User = "", "", nil
+	}
+	return
+}
+
+// checkParams checks that the parameters given are exactly those in the url templates.
+func (b *URLBuilder) checkParams() (err error) {
+	t, q, err := b.rt.urlTemplate()
+	if err != nil {
+		return
+	}
+	vars := append(templateVars(t.Host), templateVars(t.Path)...)
+	for _, v := range q {
+		for _, s := range v {
+			vars = append(vars, templateVars(s)...)
+		}
+	}
+	var missing, unused []string
+	used := make(map[string]bool, len(vars))
+	for _, v := range vars {
+		if _, ok := b.params[v]; !ok && !used[v] {
+			missing = append(missing, v)
+		}
+		used[v] = true
+	}
+	for k := range b.params {
+		if !used[k] {
+			unused = append(unused, k)
+		}
+	}
+	if len(missing) == 0 && len(unused) == 0 {
+		return
+	}
+	sort.Strings(unused)
+	return fmt.Errorf("URL for route: %s: missing parameters: %v, unused parameters: %v",
+		b.rt.Name, missing, unused)
+}
@@ -0,0 +1,97 @@
+package app_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db/memdb"
+	"github.com/ugorji/go-serverapp/internal/apptest"
+)
+
+func TestURLBuilder(t *testing.T) {
+	gapp := apptest.NewApp(t, memdb.New())
+	api := app.NewRouteFunc(gapp.Root, "api", nil).Path("/api").Query("v", "1").Query("fmt", "${fmt}")
+	user := app.NewRouteFunc(api, "user", nil).Path("/api/user/${id}").Query("v", "2")
+	site := app.NewRouteFunc(gapp.Root, "site", nil).Scheme("http").Host("${sub}.example.com").Path("/about")
+
+	child := apptest.NewApp(t, memdb.New())
+	page := app.NewRouteFunc(child.Root, "page", nil).Path("/page/${id}")
+	app.Mount(gapp.Root, "m1", "/m1/", "", app.HTTPHandler{App: child})
+	child2 := apptest.NewApp(t, memdb.New())
+	page2 := app.NewRouteFunc(child2.Root, "page", nil).Path("/page/${id}")
+	app.Mount(gapp.Root, "m2", "/m2", "www.example.com", app.HTTPHandler{App: child2})
+
+	ctx, err := gapp.AppDriver.NewContext(nil, gapp.UUID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, x := range []struct {
+		b   *app.URLBuilder
+		url string
+		err string
+	}{
+		// query values are merged up the tree (v of user hides v of api)
+		{user.URL().Param("id", 5).Param("fmt", "json"), "/api/user/5?fmt=json&v=2", ""},
+		{user.URL().Params(map[string]interface{}{"id": 5, "fmt": "json"}).Query("v", "3").Fragment("top"),
+			"/api/user/5?fmt=json&v=2&v=3#top", ""},
+		{api.URL().Param("fmt", "xml"), "/api?fmt=xml&v=1", ""},
+		// missing and unused parameters
+		{user.URL().Param("id", 5), "", "missing parameters: [fmt], unused parameters: []"},
+		{user.URL().Param("id", 5).Param("fmt", "json").Param("x", 1).Param("a", 2), "", "missing parameters: [], unused parameters: [a x]"},
+		{site.URL().Param("x", 1), "", "missing parameters: [sub], unused parameters: [x]"},
+		// absolute urls use the host of the app, and https outside DEVELOPMENT
+		{user.URL().Param("id", 5).Param("fmt", "json").Absolute(), "https://localhost:8080/api/user/5?fmt=json&v=2", ""},
+		{user.URL().Param("id", 5).Param("fmt", "json").Scheme("ftp").Absolute(), "ftp://localhost:8080/api/user/5?fmt=json&v=2", ""},
+		// else the scheme and host of the route
+		{site.URL().Param("sub", "www"), "http://www.example.com/about", ""},
+		{site.URL().Param("sub", "www").Scheme("ftp").Absolute(), "http://www.example.com/about", ""},
+		{site.URL().Param("sub", "www").Relative(), "/about", ""},
+		// mounted apps
+		{page.URL().Param("id", 5), "/m1/page/5", ""},
+		{page.URL().Param("id", 5).Absolute(), "https://localhost:8080/m1/page/5", ""},
+		{page2.URL().Param("id", 5), "//www.example.com/m2/page/5", ""},
+		{page2.URL().Param("id", 5).Absolute(), "https://www.example.com/m2/page/5", ""},
+		{page2.URL().Param("id", 5).Relative(), "/m2/page/5", ""},
+	} {
+		u, err := x.b.Build(ctx)
+		if x.err != "" {
+			if err == nil || !strings.Contains(err.Error(), x.err) {
+				t.Errorf("%d: expected error: %q, got: %v (url: %v)", i, x.err, err, u)
+			}
+		} else if err != nil || u.String() != x.url {
+			t.Errorf("%d: expected: %s, got: %v (error: %v)", i, x.url, u, err)
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	gapp := apptest.NewApp(t, memdb.New())
+	app.NewRouteFunc(gapp.Root, "user", nil).Path("/user/${id}").Query("v", "1")
+	ctx, err := gapp.AppDriver.NewContext(nil, gapp.UUID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := gapp.Views.FnMap["Link"].(linkFn)
+	for _, x := range []struct {
+		route  string
+		params []interface{}
+		url    string
+		err    string
+	}{
+		{"user", []interface{}{"id", 5}, "/user/5?v=1", ""},
+		{"user", []interface{}{"id", 5, "?page", 2, "?v", 2, "#", "top"}, "/user/5?page=2&v=1&v=2#top", ""},
+		{"user", []interface{}{"?id", 5}, "", "missing parameters: [id]"},
+		{"user", []interface{}{"id", 5, "?page"}, "", "odd number of params"},
+		{"nouser", nil, "", "no route: nouser"},
+	} {
+		s, err := link(ctx, x.route, x.params...)
+		if x.err != "" {
+			if err == nil || !strings.Contains(err.Error(), x.err) {
+				t.Errorf("Link %s %v: expected error: %q, got: %v (url: %s)", x.route, x.params, x.err, err, s)
+			}
+		} else if err != nil || s != x.url {
+			t.Errorf("Link %s %v: expected: %s, got: %s (error: %v)", x.route, x.params, x.url, s, err)
+		}
+	}
+}
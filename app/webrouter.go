@@ -9,8 +9,33 @@ ability to recreate a request (URL + Headers) based on the characteristics of a
 
 A Route is Matched if all its Routes or Route Expressions match.
 
+Builtin Matchers check the Host, Path, Method, Scheme, Header and Query of a request,
+as well as the media types it Accepts, and its ContentType. Custom Matchers
+can be added via AddMatcher.
+
+If a route matches a request except for its Method, Dispatch returns a
+MethodNotAllowedError (405) with an Allow header listing the methods allowed, or
+answers an OPTIONS request with it. This is unless the matched route can serve the
+request ie it allows the Method, or it has no methods and its own Handler.
+Either response goes through the middleware of the matched route (see Use),
+so e.g. a CORS middleware can answer preflight requests.
+A HEAD request is served by the route for GET, without writing a body.
+
+Routes with many children index them by the static prefix of their Path (in a radix
+tree), so Match only runs the Matchers of the children which can match the request path.
+This keeps matching fast for large route trees, without changing which route is matched.
+
+Middleware (e.g. for authentication, csrf checks or caching) can be attached to a Route
+via Use. It applies to the route and all its descendants. Dispatch runs the middleware
+of the matched route and its ancestors, from the root down, and then its Handler.
+
+To debug a route tree, Walk visits its routes, Describe returns their url templates,
+matchers (in order), methods and handlers, and Check finds routes which will never be
+matched (no matchers, shadowed by an earlier sibling, or a duplicate name).
+A development server renders the tree and its issues at DevRoutesPath (see RoutesHandler).
+
 It works as follows:
-  - A Route is a node in a tree. It can have children, and also have matchExpr to determine
+  - A Route is a node in a tree. It can have children, and also have Matchers to determine
     whether to proceed walking down the tree or not.
   - At runtime, the package looks for the deepest Route which can handle a Request,
     in sequence. This means that a branch is checked, and if it matches, then its children
@@ -32,6 +57,17 @@ store them in a request-scoped store. This way, they are not parsed again, and c
   - during request handling, to get variables
   - during URL generation of a named route
 
+Variables can be declared with a type (e.g. ${id:int}, ${key:uuid}) or a regexp
+without braces (e.g. ${slug:[a-z-]+}). Typed variables are checked during matching, and can be read
+via typed accessors (e.g. VarInt(ctx, "id")). ToURLX validates the parameters it is
+given against the declared types or regexps. See RegisterParamType for the builtin
+types, and to add more.
+
+A URLBuilder (see Route.URL) builds the url of a route from named parameters, extra
+query values and a fragment, as an absolute (using the host of the app) or relative url.
+It returns an error if a parameter is missing or unused. The Link template function
+uses it.
+
 An application using the router will have pseudo-code like:
    -----------------------------------------------------
    func main() {
@@ -53,16 +89,27 @@ An application using the router will have pseudo-code like:
 package app
 
 import (
+	"fmt"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/ugorji/go-common/errorutil"
 	"github.com/ugorji/go-common/regexputil"
 	"github.com/ugorji/go-common/safestore"
+	"github.com/ugorji/go-serverapp/web"
 )
 
 const (
 	VarsKey   = "router_vars"
+	RouteKey  = "router_route"
 	LogTarget = "router"
 )
 
@@ -78,23 +125,94 @@ func (hf HandlerFunc) HandleHttp(c Context, w http.ResponseWriter, r *http.Reque
 	return hf(c, w, r)
 }
 
-type matchExpr func(safestore.I, *http.Request) (bool, error)
+// Middleware wraps a Handler, to do some work before and/or after calling it
+// (e.g. authentication, csrf checks, caching), or to not call it at all.
+//
+// Middleware is attached to a Route via Use, and applies to it and all its descendants.
+// It wraps the handlers of each route it applies to once (when the route is first
+// dispatched to), not for each request, so the Handler it returns may keep state.
+type Middleware func(Handler) Handler
+
+// Matcher determines whether a Route matches a request.
+// It may store variables for the request in the store (see Vars), by putting
+// a copy of the map of variables with them added under VarsKey, so they are
+// dropped if the Route does not match.
+//
+// Custom Matchers can be added to a Route via AddMatcher.
+type Matcher func(safestore.I, *http.Request) (bool, error)
 
 type Route struct {
 	// either the children or the handler is nil
 	Name     string
 	Parent   *Route
 	Children []*Route
-	Matchers []matchExpr
+	Matchers []Matcher
 	Handler  Handler
 	url      *url.URL // store info for reconstructing a url
+	methods  []string // set by Method (nil means all methods)
+	mw       []Middleware
+	mdesc    []matcherDesc         // describes each of the Matchers (see Describe)
+	params   map[string]*paramSpec // declared types (or regexps) of parameters
+	// set on the root of a mounted app (see Mount)
+	mountPath string
+	mountHost string
+	// static path used by the index of the parent's children (see routeindex.go)
+	pathPrefix  string
+	pathExact   bool
+	pathIndexed bool
+	index       atomic.Value // *routeIndex
+	chain       atomic.Value // *routeChain
+}
+
+// routeChain holds the handlers of a route, wrapped by its middleware (see wrap).
+// It is built on first use, so the middleware is called once per route, not per request.
+type routeChain struct {
+	handler Handler // the Handler of the route
+	allow   Handler // allowHandler, used by Dispatch
 }
 
 // Any wrapping function can call Dispatch, and overwrite TopLevelHandler
+//
+// If the matched route cannot serve the method of the request (see serves), and a route
+// under it matches the request except for its method, Dispatch sets the Allow header,
+// and returns a MethodNotAllowedError (or answers an OPTIONS request). This is done
+// through the middleware of the matched route (e.g. so a CORS middleware can answer
+// a preflight request), unless a route under it declares the OPTIONS method.
+// A HEAD request is served without writing a body.
 func Dispatch(ctx Context, root *Route, w http.ResponseWriter, r *http.Request) error {
 	rt := root.Match(ctx.Store(), r)
 	log.Debug(ctxctx(ctx), "rt: %v", rt.Name)
-	return rt.Handler.HandleHttp(ctx, w, r)
+	ctx.Store().Put(RouteKey, rt, 0)
+	if len(rt.Children) > 0 && !rt.serves(r.Method) {
+		allowed := make(map[string]bool)
+		for _, m := range rt.methods {
+			allowed[m] = true
+		}
+		rt.allowedMethods(safestore.New(false), r, rt.methods, allowed)
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", allowHeader(allowed))
+			return rt.handlers().allow.HandleHttp(ctx, w, r)
+		}
+	}
+	if r.Method == http.MethodHead {
+		w2, ok := w.(web.ResponseWriter)
+		if !ok {
+			w2 = web.AsResponseWriter(w)
+			defer w2.Flush()
+		}
+		w = headResponseWriter{w2}
+	}
+	return rt.handler().HandleHttp(ctx, w, r)
+}
+
+// allowHandler answers a request for a method which a route does not serve,
+// using the Allow header set by Dispatch.
+func allowHandler(c Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	return MethodNotAllowedError(fmt.Sprintf("method %s not allowed (allowed: %s)", r.Method, w.Header().Get("Allow")))
 }
 
 // This is the method that the root handler runs by default. The
@@ -109,7 +227,7 @@ func NoMatchFoundHandler(c Context, w http.ResponseWriter, r *http.Request) erro
 
 func NewRoot(name string) (root *Route) {
 	root = NewRouteFunc(nil, name, NoMatchFoundHandler)
-	root.Matchers = append(root.Matchers, TrueExpr)
+	root.addMatcher(matcherDesc{kind: "True"}, TrueExpr)
 	return
 }
 
@@ -118,7 +236,7 @@ func NewRoute(parent *Route, name string, handler Handler) *Route {
 	r := &Route{
 		Name:     name,
 		Children: make([]*Route, 0, 4),
-		Matchers: make([]matchExpr, 0, 4),
+		Matchers: make([]Matcher, 0, 4),
 		Handler:  handler,
 		url:      new(url.URL),
 	}
@@ -154,7 +272,40 @@ func (rt *Route) FindByName(name string) *Route {
 // match, then return the current one.
 func (rt *Route) Match(store safestore.I, req *http.Request) *Route {
 	//check if match first
+	if !rt.matches(store, req, false) {
+		return nil
+	}
+	// if matched, then check children to see first one that matches recursively
+	if idx := rt.childIndex(); idx != nil {
+		for _, i := range idx.candidates(req.URL.Path) {
+			if rt2 := rt.Children[i].Match(store, req); rt2 != nil {
+				return rt2
+			}
+		}
+		return rt
+	}
+	for _, rt1 := range rt.Children {
+		if rt2 := rt1.Match(store, req); rt2 != nil {
+			return rt2
+		}
+	}
+	return rt
+}
+
+// matches checks the methods and Matchers of this route (not its children).
+//
+// If the route does not match, the variables stored by its Matchers are removed,
+// so the variables of a request only come from the routes which matched it
+// (and do not depend on which routes were checked, see routeindex.go).
+func (rt *Route) matches(store safestore.I, req *http.Request, ignoreMethod bool) bool {
 	b := false
+	if rt.methods != nil {
+		if b = ignoreMethod || methodAllowed(rt.methods, req.Method); !b {
+			return false
+		}
+	}
+	// storeVars does not change the map of variables in place
+	vars0, _ := store.Get(VarsKey).(map[string]string)
 	for _, x := range rt.Matchers {
 		if b1, err1 := x(store, req); err1 == nil {
 			b = b1
@@ -164,20 +315,90 @@ func (rt *Route) Match(store safestore.I, req *http.Request) *Route {
 		}
 	}
 	if !b {
-		return nil
+		vars, _ := store.Get(VarsKey).(map[string]string)
+		if reflect.ValueOf(vars).Pointer() != reflect.ValueOf(vars0).Pointer() {
+			if vars0 == nil {
+				store.Removes(VarsKey)
+			} else {
+				store.Put(VarsKey, vars0, 0)
+			}
+		}
 	}
-	// if matched, then check children to see first one that matches recursively
+	return b
+}
+
+// serves returns true if this route can serve the method ie its methods allow it,
+// or it has no methods and its own handler. The handler of a root (which has
+// no parent) is for requests which no route matches, so it does not count.
+func (rt *Route) serves(method string) bool {
+	if rt.methods != nil {
+		return methodAllowed(rt.methods, method)
+	}
+	return rt.Handler != nil && rt.Parent != nil
+}
+
+// allowedMethods collects the methods of the routes under this route, which
+// would match the request if not for its method. A route without methods
+// gets those of its parent, and a route only gets the methods of its parent
+// (as its children are only matched if it is).
+func (rt *Route) allowedMethods(store safestore.I, req *http.Request, methods []string, allowed map[string]bool) {
 	for _, rt1 := range rt.Children {
-		if rt2 := rt1.Match(store, req); rt2 != nil {
-			return rt2
+		if !rt1.matches(store, req, true) {
+			continue
 		}
+		methods1 := rt1.methods
+		if methods1 == nil {
+			methods1 = methods
+		} else if methods != nil {
+			methods1 = make([]string, 0, len(rt1.methods))
+			for _, m := range rt1.methods {
+				if containsString(methods, m) {
+					methods1 = append(methods1, m)
+				}
+			}
+			if len(methods1) == 0 {
+				continue
+			}
+		}
+		for _, m := range methods1 {
+			allowed[m] = true
+		}
+		rt1.allowedMethods(store, req, methods1, allowed)
 	}
-	return rt
 }
 
 //Sister function to ToURL.
 func (rt *Route) ToURLX(params map[string]interface{}) (u *url.URL, err error) {
 	defer errorutil.OnError(&err)
+	if err = rt.checkParams(params); err != nil {
+		return
+	}
+	u, q, err := rt.urlTemplate()
+	if err != nil {
+		return
+	}
+	//do substitution on Path and Host if necessary
+	//for i := 0; i < len(params);  { // where params is a []string
+	//	u.Path = strings.Replace(u.Path, regexputil.InterpolatePrefix + params[i] + regexputil.InterpolatePostfix, params[i+1], -1)
+	//	u.Host = strings.Replace(u.Host, regexputil.InterpolatePrefix + params[i] + regexputil.InterpolatePostfix, params[i+1], -1)
+	//	i += 2
+	//}
+	u.Path = regexputil.Interpolate(u.Path, params)
+	u.Host = regexputil.Interpolate(u.Host, params)
+	for _, v := range q {
+		for i := range v {
+			v[i] = regexputil.Interpolate(v[i], params)
+		}
+	}
+	if len(q) > 0 {
+		u.RawQuery = q.Encode()
+	}
+	return
+}
+
+// urlTemplate returns the url of the route, and its query values,
+// before the parameters are substituted into them.
+func (rt *Route) urlTemplate() (u *url.URL, q url.Values, err error) {
 	//populate Scheme, Path, Host, RawUserinfo, RawQuery and call String() method
 	u = new(url.URL)
 	for rt2 := rt; rt2 != nil; rt2 = rt2.Parent {
@@ -204,28 +425,41 @@ func (rt *Route) ToURLX(params map[string]interface{}) (u *url.URL, err error) {
 			break
 		}
 	}
+	//query values are merged up the tree (a name in a child route hides it in the parent)
+	root := rt
 	for rt2 := rt; rt2 != nil; rt2 = rt2.Parent {
-		if rt2.url.RawQuery != "" {
-			u.RawQuery = rt2.url.RawQuery
-			break
+		root = rt2
+		if rt2.url.RawQuery == "" {
+			continue
+		}
+		var q2 url.Values
+		if q2, err = url.ParseQuery(rt2.url.RawQuery); err != nil {
+			return
+		}
+		if q == nil {
+			q = make(url.Values)
+		}
+		for k, v := range q2 {
+			if _, ok := q[k]; !ok {
+				q[k] = v
+			}
 		}
 	}
-	//do substitution on Path and Host if necessary
-	//for i := 0; i < len(params);  { // where params is a []string
-	//	u.Path = strings.Replace(u.Path, regexputil.InterpolatePrefix + params[i] + regexputil.InterpolatePostfix, params[i+1], -1)
-	//	u.Host = strings.Replace(u.Host, regexputil.InterpolatePrefix + params[i] + regexputil.InterpolatePostfix, params[i+1], -1)
-	//	i += 2
-	//}
-	u.Path = regexputil.Interpolate(u.Path, params)
-	u.Host = regexputil.Interpolate(u.Host, params)
-	if u.RawQuery != "" {
-		u.RawQuery = regexputil.Interpolate(u.RawQuery, params)
+	//the tree of a mounted app is served under a path prefix (and host)
+	if root.mountPath != "" {
+		u.Path = root.mountPath + u.Path
+	}
+	if u.Host == "" {
+		u.Host = root.mountHost
 	}
 	return
 }
 
 func (rt *Route) ToURL(params ...string) (u *url.URL, err error) {
 	defer errorutil.OnError(&err)
+	if len(params)%2 != 0 {
+		return nil, fmt.Errorf("ToURL: odd number of params: %d for route: %s", len(params), rt.Name)
+	}
 	m := make(map[string]interface{})
 	for i := 0; i < len(params); {
 		m[params[i]] = params[i+1]
@@ -234,31 +468,36 @@ func (rt *Route) ToURL(params ...string) (u *url.URL, err error) {
 	return rt.ToURLX(m)
 }
 
-// This adds a Host matchExpr to this router.
+// This adds a Host Matcher to this router.
 func (rt *Route) Host(hostRegexp string) *Route {
 	log.Debug(nil, "Adding Host Match: %v to Route: %v", hostRegexp, rt.Name)
-	re, sclean, keys, _ := regexputil.ParseRegexTemplate(hostRegexp)
+	re, sclean, keys, _ := rt.parseTemplate(hostRegexp)
 	rt.url.Host = sclean
 	x := func(store safestore.I, req *http.Request) (bool, error) {
-		if res := re.FindStringSubmatch(req.URL.Host); res != nil {
+		if res := re.FindStringSubmatch(req.URL.Host); res != nil && rt.checkVars(keys, res) {
 			storeVars(store, keys, res)
 			return true, nil
 		}
 		return false, nil
 	}
-	rt.Matchers = append(rt.Matchers, x)
+	rt.addMatcher(matcherDesc{kind: "Host", arg: hostRegexp}, x)
 	return rt
 }
 
-// This adds a Path matchExpr to this router. It supports exact matches,
+// This adds a Path Matcher to this router. It supports exact matches,
 // as well as matches of regexp.
 func (rt *Route) Path(pathRegexp string) *Route {
 	log.Debug(nil, "Adding Path Match: %v to Route: %v", pathRegexp, rt.Name)
-	re, sclean, keys, err := regexputil.ParseRegexTemplate(pathRegexp)
+	re, sclean, keys, err := rt.parseTemplate(pathRegexp)
 	if err != nil {
 		panic(err)
 	}
 	rt.url.Path = sclean
+	if len(keys) == 0 {
+		rt.setPathIndex(sclean, true)
+	} else if strings.HasPrefix(re.String(), "^") {
+		rt.setPathIndex(pathStaticPrefix(pathRegexp), false)
+	}
 	x := func(store safestore.I, req *http.Request) (bool, error) {
 		// log.Debug(nil, "req.URL.Path: (against route: %v): %v", rt.Name, req.URL.Path)
 		if len(keys) == 0 { // exact match
@@ -266,14 +505,14 @@ func (rt *Route) Path(pathRegexp string) *Route {
 				return true, nil
 			}
 		} else {
-			if res := re.FindStringSubmatch(req.URL.Path); res != nil {
+			if res := re.FindStringSubmatch(req.URL.Path); res != nil && rt.checkVars(keys, res) {
 				storeVars(store, keys, res)
 				return true, nil
 			}
 		}
 		return false, nil
 	}
-	rt.Matchers = append(rt.Matchers, x)
+	rt.addMatcher(matcherDesc{kind: "Path", arg: pathRegexp, path: sclean, re: re, exact: len(keys) == 0}, x)
 	return rt
 }
 
@@ -284,7 +523,184 @@ func (rt *Route) Param(param string) *Route {
 		_, ok := req.Form[param]
 		return ok, nil
 	}
-	rt.Matchers = append(rt.Matchers, x)
+	rt.addMatcher(matcherDesc{kind: "Param", arg: param}, x)
+	return rt
+}
+
+// This adds a Method match to this router. It matches if the request method
+// is one of the methods given. A HEAD request matches a route which allows GET.
+//
+// Dispatch uses the methods to tell a request which matched a route except for
+// its method, and reply 405 (Method Not Allowed) or answer an OPTIONS request.
+func (rt *Route) Method(methods ...string) *Route {
+	log.Debug(nil, "Adding Method Match: %v to Route: %v", methods, rt.Name)
+	rt.methods = append(rt.methods, mapStrings(methods, strings.ToUpper)...)
+	return rt
+}
+
+// This adds a Scheme Matcher to this router. It matches if the request scheme
+// (http or https) is one of the schemes given.
+//
+// If only one scheme is given, it is used when reconstructing a url.
+func (rt *Route) Scheme(schemes ...string) *Route {
+	log.Debug(nil, "Adding Scheme Match: %v to Route: %v", schemes, rt.Name)
+	schemes = mapStrings(schemes, strings.ToLower)
+	if len(schemes) == 1 {
+		rt.url.Scheme = schemes[0]
+	}
+	x := func(store safestore.I, req *http.Request) (bool, error) {
+		return containsString(schemes, requestScheme(req)), nil
+	}
+	rt.addMatcher(matcherDesc{kind: "Scheme", arg: strings.Join(schemes, ", ")}, x)
+	return rt
+}
+
+// This adds a Header Matcher to this router. It matches if the value of the
+// request header matches the regexp, storing any named variables in it.
+func (rt *Route) Header(name string, valueRegexp string) *Route {
+	log.Debug(nil, "Adding Header Match: %v: %v to Route: %v", name, valueRegexp, rt.Name)
+	re, _, keys, err := rt.parseTemplate(valueRegexp)
+	if err != nil {
+		panic(err)
+	}
+	x := func(store safestore.I, req *http.Request) (bool, error) {
+		if res := re.FindStringSubmatch(req.Header.Get(name)); res != nil && rt.checkVars(keys, res) {
+			storeVars(store, keys, res)
+			return true, nil
+		}
+		return false, nil
+	}
+	rt.addMatcher(matcherDesc{kind: "Header", arg: name + ": " + valueRegexp}, x)
+	return rt
+}
+
+// This adds a Query Matcher to this router. It matches if a value of the
+// query parameter in the request url matches the regexp, storing any named variables in it.
+//
+// If the regexp is a literal or has named variables (e.g. ${page}), the parameter
+// is added when reconstructing a url.
+func (rt *Route) Query(name string, valueRegexp string) *Route {
+	log.Debug(nil, "Adding Query Match: %v: %v to Route: %v", name, valueRegexp, rt.Name)
+	re, sclean, keys, err := rt.parseTemplate(valueRegexp)
+	if err != nil {
+		panic(err)
+	}
+	if len(keys) > 0 || regexp.QuoteMeta(sclean) == sclean {
+		q := rt.url.Query()
+		q.Add(name, sclean)
+		rt.url.RawQuery = q.Encode()
+	}
+	x := func(store safestore.I, req *http.Request) (bool, error) {
+		for _, v := range req.URL.Query()[name] {
+			if res := re.FindStringSubmatch(v); res != nil && rt.checkVars(keys, res) {
+				storeVars(store, keys, res)
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	rt.addMatcher(matcherDesc{kind: "Query", arg: name + "=" + valueRegexp}, x)
+	return rt
+}
+
+// This adds an Accepts Matcher to this router. It matches if the request Accept header
+// allows any of the media types given (e.g. application/json), honoring wildcards
+// (e.g. text/*, */*) and q=0. The quality of a media type is given by the most specific
+// media range which matches it e.g. "*/*, application/json;q=0" does not accept json.
+// A request without an Accept header accepts all types.
+func (rt *Route) Accepts(mediaTypes ...string) *Route {
+	log.Debug(nil, "Adding Accepts Match: %v to Route: %v", mediaTypes, rt.Name)
+	mediaTypes = mapStrings(mediaTypes, strings.ToLower)
+	x := func(store safestore.I, req *http.Request) (bool, error) {
+		accept := req.Header.Get("Accept")
+		if accept == "" {
+			return true, nil
+		}
+		mts, qs := parseAccept(accept)
+		for _, mt := range mediaTypes {
+			if q, _ := acceptQuality(mts, qs, mt); q > 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	rt.addMatcher(matcherDesc{kind: "Accepts", arg: strings.Join(mediaTypes, ", ")}, x)
+	return rt
+}
+
+// This adds a ContentType Matcher to this router. It matches if the media type of
+// the request Content-Type header is one of the media types given
+// (which can have wildcards e.g. text/*).
+func (rt *Route) ContentType(mediaTypes ...string) *Route {
+	log.Debug(nil, "Adding ContentType Match: %v to Route: %v", mediaTypes, rt.Name)
+	mediaTypes = mapStrings(mediaTypes, strings.ToLower)
+	x := func(store safestore.I, req *http.Request) (bool, error) {
+		mt, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil {
+			return false, nil
+		}
+		for _, mt2 := range mediaTypes {
+			if mediaTypeMatch(mt2, mt) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	rt.addMatcher(matcherDesc{kind: "ContentType", arg: strings.Join(mediaTypes, ", ")}, x)
+	return rt
+}
+
+// Use attaches middleware to this route. It wraps the Handler of this route and
+// all its descendants. Middleware of a parent runs before that of its children,
+// and middleware attached to a route runs in the order given.
+func (rt *Route) Use(mw ...Middleware) *Route {
+	log.Debug(nil, "Adding %d Middleware to Route: %v", len(mw), rt.Name)
+	rt.mw = append(rt.mw, mw...)
+	rt.resetHandlers()
+	return rt
+}
+
+// resetHandlers drops the handlers cached for this route and its descendants.
+func (rt *Route) resetHandlers() {
+	rt.chain.Store((*routeChain)(nil))
+	for _, rt2 := range rt.Children {
+		rt2.resetHandlers()
+	}
+}
+
+// handlers returns the handlers of this route, wrapped by its middleware
+// (building them the first time).
+func (rt *Route) handlers() (c *routeChain) {
+	c, _ = rt.chain.Load().(*routeChain)
+	if c == nil {
+		c = &routeChain{handler: rt.wrap(rt.Handler), allow: rt.wrap(HandlerFunc(allowHandler))}
+		rt.chain.Store(c)
+	}
+	return
+}
+
+// handler returns the Handler of this route, wrapped by its middleware (see wrap).
+func (rt *Route) handler() Handler {
+	return rt.handlers().handler
+}
+
+// wrap wraps h by the middleware of this route and its ancestors
+// (with that of the root outermost).
+func (rt *Route) wrap(h Handler) Handler {
+	for rt2 := rt; rt2 != nil; rt2 = rt2.Parent {
+		for i := len(rt2.mw) - 1; i >= 0; i-- {
+			h = rt2.mw[i](h)
+		}
+	}
+	return h
+}
+
+// AddMatcher adds custom Matchers to this router.
+func (rt *Route) AddMatcher(matchers ...Matcher) *Route {
+	log.Debug(nil, "Adding %d custom Matchers to Route: %v", len(matchers), rt.Name)
+	for _, x := range matchers {
+		rt.addMatcher(matcherDesc{kind: "custom"}, x)
+	}
 	return rt
 }
 
@@ -295,14 +711,26 @@ func TrueExpr(store safestore.I, req *http.Request) (bool, error) {
 
 // update the vars for this request.
 func storeVars(sf safestore.I, keys []string, res []string) {
-	vars := Vars(sf)
+	vars0, _ := sf.Get(VarsKey).(map[string]string)
 	slen := len(res) - 1 // first match is for full
 	if slen > len(keys) {
 		slen = len(keys)
 	}
+	// copy the map, so a route which does not match can restore it (see matches)
+	vars := make(map[string]string, len(vars0)+slen)
+	for k, v := range vars0 {
+		vars[k] = v
+	}
 	for i := 0; i < slen; i++ {
 		vars[keys[i]] = res[i+1]
 	}
+	sf.Put(VarsKey, vars, 0)
+}
+
+// CurrentRoute returns the route matched for this request by Dispatch, or nil.
+func CurrentRoute(c Context) *Route {
+	rt, _ := c.Store().Get(RouteKey).(*Route)
+	return rt
 }
 
 // Return the vars stored for this request. An application can request it
@@ -317,3 +745,159 @@ func Vars(sf safestore.I) (vars map[string]string) {
 	}
 	return
 }
+
+func mapStrings(ss []string, fn func(string) string) []string {
+	ss2 := make([]string, len(ss))
+	for i := range ss {
+		ss2[i] = fn(ss[i])
+	}
+	return ss2
+}
+
+func containsString(ss []string, s string) bool {
+	for _, s2 := range ss {
+		if s2 == s {
+			return true
+		}
+	}
+	return false
+}
+
+// requestScheme returns the scheme of the request: http or https.
+func requestScheme(req *http.Request) string {
+	if req.URL.Scheme != "" {
+		return strings.ToLower(req.URL.Scheme)
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost returns the host of the request, without its port.
+// It is got from the url (for absolute-form requests), else from the Host header.
+func requestHost(req *http.Request) string {
+	h := req.URL.Host
+	if h == "" {
+		h = req.Host
+	}
+	if h2, _, err := net.SplitHostPort(h); err == nil {
+		return h2
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")
+}
+
+// parseAcceptElem parses an element of an Accept header e.g. text/html;q=0.9
+// into its media type and quality.
+func parseAcceptElem(s string) (mediaType string, q float64) {
+	q = 1
+	ss := strings.Split(s, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(ss[0]))
+	for _, p := range ss[1:] {
+		p = strings.TrimSpace(p)
+		if len(p) > 2 && (p[0] == 'q' || p[0] == 'Q') && p[1] == '=' {
+			if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+				q = f
+			}
+		}
+	}
+	return
+}
+
+// parseAccept parses an Accept header into its media ranges and their qualities.
+func parseAccept(accept string) (mts []string, qs []float64) {
+	elems := strings.Split(accept, ",")
+	mts, qs = make([]string, len(elems)), make([]float64, len(elems))
+	for i, s := range elems {
+		mts[i], qs[i] = parseAcceptElem(s)
+	}
+	return
+}
+
+// acceptQuality returns the quality of the media type in a parsed Accept header.
+// It is given by the most specific media range which matches it (0 if none does).
+// ok is true if a media range matches it, so a quality of 0 means it was refused.
+func acceptQuality(mts []string, qs []float64, mediaType string) (q float64, ok bool) {
+	specificity := -1
+	for i, mt := range mts {
+		if !mediaTypeMatch(mt, mediaType) {
+			continue
+		}
+		sp := 0 // */*
+		if mt == mediaType {
+			sp = 2
+		} else if mt != "*/*" && mt != "*" {
+			sp = 1 // type/*
+		}
+		if sp > specificity {
+			q, specificity = qs[i], sp
+		}
+	}
+	return q, specificity >= 0
+}
+
+// negotiateContentType returns the media type of the offers which the Accept header
+// prefers (by quality, then in the order of the offers). The most specific media range
+// in the Accept header which matches an offer gives its quality.
+// If the header is empty, it returns the first offer. If no offer is acceptable, it
+// returns the first offer which is not refused (with q=0), else the last offer.
+func negotiateContentType(accept string, offers ...string) string {
+	if accept == "" {
+		return offers[0]
+	}
+	mts, qs := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, ok := acceptQuality(mts, qs, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		} else if best == "" && !ok {
+			best = offer
+		}
+	}
+	if best == "" {
+		best = offers[len(offers)-1]
+	}
+	return best
+}
+
+// mediaTypeMatch returns true if the media type matches the pattern,
+// which can be a wildcard (*/* or type/*).
+func mediaTypeMatch(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == "*" || pattern == mediaType {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, pattern[:len(pattern)-1])
+	}
+	return false
+}
+
+func methodAllowed(methods []string, method string) bool {
+	return containsString(methods, method) ||
+		(method == http.MethodHead && containsString(methods, http.MethodGet))
+}
+
+// allowHeader returns the value of the Allow header for the allowed methods.
+func allowHeader(allowed map[string]bool) string {
+	if allowed[http.MethodGet] {
+		allowed[http.MethodHead] = true
+	}
+	allowed[http.MethodOptions] = true
+	ss := make([]string, 0, len(allowed))
+	for m := range allowed {
+		ss = append(ss, m)
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, ", ")
+}
+
+// headResponseWriter serves a HEAD request through the handler for GET,
+// discarding the body it writes.
+type headResponseWriter struct {
+	web.ResponseWriter
+}
+
+func (w headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
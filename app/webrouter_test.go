@@ -0,0 +1,253 @@
+package app
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ugorji/go-common/safestore"
+)
+
+func newTestContext() Context {
+	return &BasicContext{TheAppUUID: "test", SafeStore: safestore.New(false)}
+}
+
+func writeHandler(s string) HandlerFunc {
+	return func(c Context, w http.ResponseWriter, r *http.Request) error {
+		_, err := w.Write([]byte(s))
+		return err
+	}
+}
+
+func TestDispatchMethods(t *testing.T) {
+	root := NewRoot("Root")
+	items := NewRouteFunc(root, "items", writeHandler("items-get")).Path("/items").Method("GET")
+	// not reachable, as its parent only matches GET (and HEAD)
+	NewRouteFunc(items, "items-post", writeHandler("items-post")).Path("/items").Method("POST")
+	docs := NewRouteFunc(root, "docs", writeHandler("docs-get")).Path("/docs").Method("GET", "POST")
+	NewRouteFunc(docs, "docs-post", writeHandler("docs-post")).Path("/docs").Method("POST", "PUT")
+	anyRt := NewRouteFunc(root, "any", writeHandler("any")).Path("/any")
+	NewRouteFunc(anyRt, "any-post", writeHandler("any-post")).Path("/any").Method("POST")
+	NewRouteFunc(root, "only", writeHandler("only")).Path("/only").Method("PUT")
+
+	for _, x := range []struct {
+		method, path string
+		code         int // 0 means no error
+		body, allow  string
+	}{
+		{"GET", "/items", 0, "items-get", ""},
+		{"HEAD", "/items", 0, "", ""},
+		{"POST", "/items", 405, "", "GET, HEAD, OPTIONS"},
+		{"DELETE", "/items", 405, "", "GET, HEAD, OPTIONS"},
+		{"OPTIONS", "/items", 0, "", "GET, HEAD, OPTIONS"},
+		{"HEAD", "/docs", 0, "", ""},
+		{"POST", "/docs", 0, "docs-post", ""},
+		{"PUT", "/docs", 405, "", "GET, HEAD, OPTIONS, POST"},
+		{"GET", "/any", 0, "any", ""},
+		{"DELETE", "/any", 0, "any", ""},
+		{"POST", "/any", 0, "any-post", ""},
+		{"DELETE", "/only", 405, "", "OPTIONS, PUT"},
+		{"GET", "/none", 404, "", ""},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(x.method, x.path, nil)
+		err := Dispatch(newTestContext(), root, w, r)
+		code := 0
+		if err != nil {
+			code = errorStatusCode(err)
+		}
+		if code != x.code {
+			t.Errorf("%s %s: expected code: %d, got: %d (error: %v)", x.method, x.path, x.code, code, err)
+		}
+		if s := w.Body.String(); s != x.body {
+			t.Errorf("%s %s: expected body: %q, got: %q", x.method, x.path, x.body, s)
+		}
+		if s := w.Header().Get("Allow"); s != x.allow {
+			t.Errorf("%s %s: expected Allow: %q, got: %q", x.method, x.path, x.allow, s)
+		}
+	}
+}
+
+func TestDispatchAllowMiddleware(t *testing.T) {
+	// cors answers preflight requests, and adds its header to others
+	var calls int
+	cors := func(h Handler) Handler {
+		return HandlerFunc(func(c Context, w http.ResponseWriter, r *http.Request) error {
+			calls++
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.WriteHeader(http.StatusNoContent)
+				return nil
+			}
+			return h.HandleHttp(c, w, r)
+		})
+	}
+	root := NewRoot("Root").Use(cors)
+	NewRouteFunc(root, "items", writeHandler("items-get")).Path("/api/items").Method("GET")
+	NewRouteFunc(root, "docs", writeHandler("docs-get")).Path("/api/docs").Method("GET")
+	NewRouteFunc(root, "docs-options", writeHandler("docs-options")).Path("/api/docs").Method("OPTIONS")
+
+	for _, x := range []struct {
+		method, path, reqMethod string
+		code                    int // error code, or status written if no error
+		body, allow             string
+	}{
+		{"OPTIONS", "/api/items", "", 200, "", "GET, HEAD, OPTIONS"},
+		{"OPTIONS", "/api/items", "GET", 204, "", "GET, HEAD, OPTIONS"},
+		{"POST", "/api/items", "", 405, "", "GET, HEAD, OPTIONS"},
+		// the route which declares OPTIONS is not run through the automatic reply
+		{"OPTIONS", "/api/docs", "", 200, "docs-options", ""},
+	} {
+		calls = 0
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(x.method, x.path, nil)
+		if x.reqMethod != "" {
+			r.Header.Set("Access-Control-Request-Method", x.reqMethod)
+		}
+		code := 0
+		if err := Dispatch(newTestContext(), root, w, r); err != nil {
+			code = errorStatusCode(err)
+		} else {
+			code = w.Code
+		}
+		if code != x.code || w.Body.String() != x.body {
+			t.Errorf("%s %s: expected: %d %q, got: %d %q", x.method, x.path, x.code, x.body, code, w.Body.String())
+		}
+		if s := w.Header().Get("Allow"); s != x.allow {
+			t.Errorf("%s %s: expected Allow: %q, got: %q", x.method, x.path, x.allow, s)
+		}
+		if s := w.Header().Get("Access-Control-Allow-Origin"); calls != 1 || s != "*" {
+			t.Errorf("%s %s: expected middleware run once, got: %d runs (header: %q)", x.method, x.path, calls, s)
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var ran []string
+	wraps := make(map[string]int)
+	mw := func(name string) Middleware {
+		return func(h Handler) Handler {
+			wraps[name]++
+			return HandlerFunc(func(c Context, w http.ResponseWriter, r *http.Request) error {
+				ran = append(ran, name)
+				return h.HandleHttp(c, w, r)
+			})
+		}
+	}
+	root := NewRoot("Root").Use(mw("a"), mw("b"))
+	users := NewRouteFunc(root, "users", writeHandler("users")).Path("/users/${rest:.*}").Use(mw("c"))
+	NewRouteFunc(users, "user", writeHandler("user")).Path("/users/${id}").Use(mw("d"))
+	NewRouteFunc(root, "home", writeHandler("home")).Path("/")
+
+	dispatch := func(path string, exp ...string) {
+		ran = ran[:0]
+		w := httptest.NewRecorder()
+		if err := Dispatch(newTestContext(), root, w, httptest.NewRequest("GET", path, nil)); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if fmt.Sprint(ran) != fmt.Sprint(exp) {
+			t.Errorf("%s: expected middleware: %v, got: %v", path, exp, ran)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		dispatch("/users/1", "a", "b", "c", "d")
+		dispatch("/users/1/x", "a", "b", "c")
+		dispatch("/", "a", "b")
+	}
+	// each route is wrapped once (for its Handler, and for the automatic OPTIONS and 405 replies)
+	if exp := map[string]int{"a": 6, "b": 6, "c": 4, "d": 2}; !reflect.DeepEqual(wraps, exp) {
+		t.Errorf("expected wraps: %v, got: %v", exp, wraps)
+	}
+	// Use on an ancestor applies to the routes dispatched to already
+	root.Use(mw("e"))
+	dispatch("/users/1", "a", "b", "e", "c", "d")
+	dispatch("/", "a", "b", "e")
+}
+
+func TestMatchers(t *testing.T) {
+	h := writeHandler("")
+	hdr := func(name, value string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set(name, value) }
+	}
+	for _, x := range []struct {
+		name  string
+		route func(*Route) *Route
+		url   string
+		setup func(*http.Request)
+		match bool
+		vars  string // fmt of the vars, if matched
+	}{
+		{"header", func(rt *Route) *Route { return rt.Header("X-Ver", "v${n:[0-9]+}") }, "/", hdr("X-Ver", "v2"), true, "map[n:2]"},
+		{"header bad value", func(rt *Route) *Route { return rt.Header("X-Ver", "v${n:[0-9]+}") }, "/", hdr("X-Ver", "vx"), false, ""},
+		{"header missing", func(rt *Route) *Route { return rt.Header("X-Ver", "v${n:[0-9]+}") }, "/", nil, false, ""},
+
+		{"query var", func(rt *Route) *Route { return rt.Query("page", "${p:[0-9]+}") }, "/?page=3", nil, true, "map[p:3]"},
+		{"query any value", func(rt *Route) *Route { return rt.Query("page", "${p:[0-9]+}") }, "/?page=a&page=4", nil, true, "map[p:4]"},
+		{"query missing", func(rt *Route) *Route { return rt.Query("page", "${p:[0-9]+}") }, "/?pg=3", nil, false, ""},
+		{"query literal", func(rt *Route) *Route { return rt.Query("fmt", "json") }, "/?fmt=json", nil, true, "map[]"},
+		{"query literal other", func(rt *Route) *Route { return rt.Query("fmt", "json") }, "/?fmt=xml", nil, false, ""},
+
+		{"scheme https", func(rt *Route) *Route { return rt.Scheme("https") }, "https://a.com/", nil, true, "map[]"},
+		{"scheme http", func(rt *Route) *Route { return rt.Scheme("https") }, "http://a.com/", nil, false, ""},
+		{"scheme tls", func(rt *Route) *Route { return rt.Scheme("https") }, "/",
+			func(r *http.Request) { r.TLS = new(tls.ConnectionState) }, true, "map[]"},
+		{"scheme any case", func(rt *Route) *Route { return rt.Scheme("HTTP", "https") }, "/", nil, true, "map[]"},
+
+		{"accepts no header", func(rt *Route) *Route { return rt.Accepts("application/json") }, "/", nil, true, "map[]"},
+		{"accepts exact", func(rt *Route) *Route { return rt.Accepts("application/json") }, "/", hdr("Accept", "Application/JSON"), true, "map[]"},
+		{"accepts wildcard", func(rt *Route) *Route { return rt.Accepts("application/json") }, "/",
+			hdr("Accept", "text/html, application/*;q=0.5"), true, "map[]"},
+		{"accepts any", func(rt *Route) *Route { return rt.Accepts("application/json") }, "/", hdr("Accept", "*/*"), true, "map[]"},
+		{"accepts other", func(rt *Route) *Route { return rt.Accepts("application/json") }, "/", hdr("Accept", "text/html"), false, ""},
+		{"accepts q=0", func(rt *Route) *Route { return rt.Accepts("application/json") }, "/",
+			hdr("Accept", "application/json;q=0"), false, ""},
+		{"accepts q=0 over wildcard", func(rt *Route) *Route { return rt.Accepts("application/json") }, "/",
+			hdr("Accept", "*/*, application/json; q=0"), false, ""},
+		{"accepts one of", func(rt *Route) *Route { return rt.Accepts("application/json", "text/html") }, "/",
+			hdr("Accept", "application/json;q=0, text/*"), true, "map[]"},
+
+		{"content type with params", func(rt *Route) *Route { return rt.ContentType("application/json") }, "/",
+			hdr("Content-Type", "Application/JSON; charset=utf-8"), true, "map[]"},
+		{"content type wildcard", func(rt *Route) *Route { return rt.ContentType("text/*") }, "/",
+			hdr("Content-Type", "text/plain;charset=utf-8"), true, "map[]"},
+		{"content type other", func(rt *Route) *Route { return rt.ContentType("application/json") }, "/",
+			hdr("Content-Type", "text/plain"), false, ""},
+		{"content type missing", func(rt *Route) *Route { return rt.ContentType("application/json") }, "/", nil, false, ""},
+	} {
+		rt := x.route(NewRouteFunc(NewRoot("Root"), x.name, h))
+		req := httptest.NewRequest("GET", x.url, nil)
+		if x.setup != nil {
+			x.setup(req)
+		}
+		store := safestore.New(false)
+		if b := rt.matches(store, req, false); b != x.match {
+			t.Errorf("%s: expected match: %v, got: %v", x.name, x.match, b)
+		} else if b && fmt.Sprint(Vars(store)) != x.vars {
+			t.Errorf("%s: expected vars: %s, got: %v", x.name, x.vars, Vars(store))
+		}
+	}
+}
+
+func TestQueryToURL(t *testing.T) {
+	h := writeHandler("")
+	for _, x := range []struct {
+		name   string
+		route  func(*Route) *Route
+		params map[string]interface{}
+		url    string
+	}{
+		// a literal value is added, a regexp is not (as it cannot be reconstructed)
+		{"literal", func(rt *Route) *Route { return rt.Query("fmt", "json") }, nil, "/s?fmt=json"},
+		{"regexp", func(rt *Route) *Route { return rt.Query("q", "a.*") }, nil, "/s"},
+		{"var", func(rt *Route) *Route { return rt.Query("page", "${p:[0-9]+}") }, map[string]interface{}{"p": 3}, "/s?page=3"},
+	} {
+		rt := x.route(NewRouteFunc(NewRoot("Root"), x.name, h).Path("/s"))
+		u, err := rt.ToURLX(x.params)
+		if err != nil || u.String() != x.url {
+			t.Errorf("%s: expected url: %s, got: %v (error: %v)", x.name, x.url, u, err)
+		}
+	}
+}
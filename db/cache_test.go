@@ -0,0 +1,115 @@
+package db_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-common/safestore"
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db"
+	"github.com/ugorji/go-serverapp/db/memdb"
+	"github.com/ugorji/go-serverapp/internal/apptest"
+)
+
+type sharedEntity struct {
+	_struct bool `db:"keyf=Id,kind=ShE,mc,codec=json"`
+	Id      int64
+	Name    string `db:"dbname=n"`
+}
+
+// newSharedCacheApp returns a memdb Driver with a SharedCache, and a context for an app on it.
+func newSharedCacheApp(t *testing.T) (d *memdb.Driver, shared app.SafeStoreCache, ctx app.Context) {
+	d = memdb.New()
+	shared = app.SafeStoreCache{T: safestore.New(true)}
+	d.Shared = shared
+	return d, shared, apptest.NewContext(t, d)
+}
+
+func TestSharedCacheEncoded(t *testing.T) {
+	d, shared, ctx := newSharedCacheApp(t)
+	key, _ := d.NewKey(ctx, "ShE", "", 1, nil)
+	if err := db.Put(ctx, true, key, &sharedEntity{Id: 1, Name: "one"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	var v sharedEntity
+	if err := db.Get(ctx, true, key, &v); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	// the entry is encoded with the codec of the type, and tagged with it
+	it := &safestore.Item{Key: db.EntityCacheKeyPfx + d.EncodeKey(ctx, key)}
+	shared.CacheGet(ctx, it)
+	bs, ok := it.Value.([]byte)
+	if !ok || len(bs) == 0 {
+		t.Fatalf("expected encoded entry in SharedCache, got: %#v", it.Value)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(bs[1:], &m); err != nil || m["Name"] != "one" {
+		t.Fatalf("expected tagged json entry, got: %q (error: %v)", bs, err)
+	}
+
+	// it is served from the SharedCache (even once gone from the datastore)
+	if err := d.DatastoreDelete(ctx, []app.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, _ = d.NewContext(nil, ctx.AppUUID(), 2) // a new request, so not from the request cache
+	v = sharedEntity{}
+	if err := db.Get(ctx, true, key, &v); err != nil || v.Name != "one" {
+		t.Fatalf("Get from SharedCache: expected name: one, got: %q (error: %v)", v.Name, err)
+	}
+
+	// negatives are cached (encoded) too
+	key2, _ := d.NewKey(ctx, "ShE", "", 2, nil)
+	for i := 0; i < 2; i++ {
+		if err := db.Get(ctx, true, key2, &v); !db.IsNotFoundError(errorutil.Base(err)) {
+			t.Fatalf("Get %d of missing entity: expected not found, got: %v", i, err)
+		}
+	}
+	it = &safestore.Item{Key: db.EntityCacheKeyPfx + d.EncodeKey(ctx, key2)}
+	shared.CacheGet(ctx, it)
+	if _, ok = it.Value.([]byte); !ok {
+		t.Fatalf("expected encoded negative in SharedCache, got: %#v", it.Value)
+	}
+}
+
+func TestQueryCacheStale(t *testing.T) {
+	d, _, ctx := newSharedCacheApp(t)
+	// DsE is in the InstanceCache, and ShE in the SharedCache
+	for _, kind := range []string{"DsE", "ShE"} {
+		query := func(exp ...int64) {
+			keys, _, err := db.NewQuery(kind).Order("n").KeysOnly(ctx)
+			if ids := keyIds(keys); err != nil || fmt.Sprint(ids) != fmt.Sprint(exp) {
+				t.Fatalf("%s: expected: %v, got: %v (error: %v)", kind, exp, ids, err)
+			}
+		}
+		put := func(id int64, name string) app.Key {
+			key, _ := d.NewKey(ctx, kind, "", id, nil)
+			var v interface{} = &dsEntity{Id: id, Name: name}
+			if kind == "ShE" {
+				v = &sharedEntity{Id: id, Name: name}
+			}
+			if err := db.Put(ctx, true, key, v); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			return key
+		}
+		put(1, "a")
+		k2 := put(2, "b")
+		query(1, 2)
+		// the results are cached: a put straight to the driver is not seen
+		k3, _ := d.NewKey(ctx, kind, "", 3, nil)
+		if _, err := d.DatastorePut(ctx, []app.Key{k3}, nil, []interface{}{db.PropertyList{{Name: "n", Value: "c"}}}); err != nil {
+			t.Fatal(err)
+		}
+		query(1, 2)
+		// a Put or Delete makes them stale
+		put(4, "d")
+		query(1, 2, 3, 4)
+		if err := db.Deletes(ctx, true, k2); err != nil {
+			t.Fatal(err)
+		}
+		query(1, 3, 4)
+	}
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Names of the builtin codecs, as used in the codec= option of the _struct tag.
+const (
+	GobCodecName     = "gob"
+	JsonCodecName    = "json"
+	MsgpackCodecName = "msgpack"
+	CborCodecName    = "cbor"
+)
+
+// Codec tags must be in this range. A gob stream never starts with such a byte,
+// so data written before codec tags were used (which is gob by default) is told apart.
+const (
+	minCodecTag = 0x80
+	maxCodecTag = 0xf7
+)
+
+var (
+	GobCodec     CodecBytes = gobCodec{}
+	JsonCodec    CodecBytes = jsonCodec{}
+	MsgpackCodec CodecBytes = &binCodec{h: &codec.MsgpackHandle{WriteExt: true}}
+	CborCodec    CodecBytes = &binCodec{h: &codec.CborHandle{}}
+)
+
+type namedCodec struct {
+	name string
+	tag  byte
+	c    CodecBytes
+}
+
+var (
+	codecsMu     sync.RWMutex
+	codecsByName = make(map[string]*namedCodec)
+	codecsByTag  = make(map[byte]*namedCodec)
+)
+
+func init() {
+	for i, nc := range []namedCodec{
+		{GobCodecName, 0x81, GobCodec},
+		{JsonCodecName, 0x82, JsonCodec},
+		{MsgpackCodecName, 0x83, MsgpackCodec},
+		{CborCodecName, 0x84, CborCodec},
+	} {
+		if err := RegisterCodec(nc.name, nc.tag, nc.c); err != nil {
+			panic(fmt.Errorf("Error registering builtin codec at index: %d: %v", i, err))
+		}
+	}
+}
+
+type jsonCodec struct{}
+
+func (_ jsonCodec) EncodeBytes(out *[]byte, v interface{}) (err error) {
+	*out, err = json.Marshal(v)
+	return
+}
+
+func (_ jsonCodec) DecodeBytes(in []byte, v interface{}) error {
+	return json.Unmarshal(in, v)
+}
+
+// binCodec is a compact binary codec, using a github.com/ugorji/go/codec Handle.
+type binCodec struct {
+	h codec.Handle
+}
+
+func (x *binCodec) EncodeBytes(out *[]byte, v interface{}) error {
+	*out = nil
+	return codec.NewEncoderBytes(out, x.h).Encode(v)
+}
+
+func (x *binCodec) DecodeBytes(in []byte, v interface{}) error {
+	return codec.NewDecoderBytes(in, x.h).Decode(v)
+}
+
+// RegisterCodec registers a codec, so it can be used by name in the codec= option
+// of the _struct tag. Data encoded with it is prefixed with the tag, which must be
+// unique and between 0x80 and 0xf7.
+func RegisterCodec(name string, tag byte, c CodecBytes) error {
+	if name == "" || c == nil {
+		return fmt.Errorf("RegisterCodec: name and codec are required")
+	}
+	if tag < minCodecTag || tag > maxCodecTag {
+		return fmt.Errorf("RegisterCodec: tag: %#x for codec: %s not in range [%#x, %#x]",
+			tag, name, minCodecTag, maxCodecTag)
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if nc := codecsByName[name]; nc != nil {
+		return fmt.Errorf("RegisterCodec: codec: %s already registered", name)
+	}
+	if nc := codecsByTag[tag]; nc != nil {
+		return fmt.Errorf("RegisterCodec: tag: %#x for codec: %s already used by codec: %s", tag, name, nc.name)
+	}
+	nc := &namedCodec{name: name, tag: tag, c: c}
+	codecsByName[name] = nc
+	codecsByTag[tag] = nc
+	return nil
+}
+
+// GetCodec returns the codec registered with the name, or nil if none.
+func GetCodec(name string) CodecBytes {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if nc := codecsByName[name]; nc != nil {
+		return nc.c
+	}
+	return nil
+}
+
+// findCodec returns the registered codec for the name, or for Codec if name is "".
+// It returns nil if Codec is not registered (so its data is not tagged).
+func findCodec(name string) (nc *namedCodec, err error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if name != "" {
+		if nc = codecsByName[name]; nc == nil {
+			err = fmt.Errorf("No codec registered with name: %s", name)
+		}
+		return
+	}
+	for _, nc2 := range codecsByName {
+		// comparing interfaces holding values of non-comparable types panics
+		if reflect.TypeOf(nc2.c) == reflect.TypeOf(Codec) && reflect.TypeOf(Codec).Comparable() && nc2.c == Codec {
+			return nc2, nil
+		}
+	}
+	return
+}
+
+// EncodeTagged encodes v with the named codec (or Codec if name is ""),
+// prefixing the data with the tag of the codec.
+func EncodeTagged(name string, out *[]byte, v interface{}) (err error) {
+	nc, err := findCodec(name)
+	if err != nil {
+		return
+	}
+	if nc == nil {
+		return Codec.EncodeBytes(out, v)
+	}
+	var bs []byte
+	if err = nc.c.EncodeBytes(&bs, v); err != nil {
+		return
+	}
+	*out = append(append(make([]byte, 0, len(bs)+1), nc.tag), bs...)
+	return
+}
+
+// DecodeTagged decodes data written by EncodeTagged, using the codec named by its tag.
+// Data without a tag (e.g. written before tags were used) is decoded with Codec.
+func DecodeTagged(in []byte, v interface{}) error {
+	c, in := taggedCodec(in)
+	return c.DecodeBytes(in, v)
+}
+
+// taggedCodec returns the codec for the data, and the data without its tag.
+func taggedCodec(in []byte) (c CodecBytes, in2 []byte) {
+	if len(in) > 0 && in[0] >= minCodecTag && in[0] <= maxCodecTag {
+		codecsMu.RLock()
+		nc := codecsByTag[in[0]]
+		codecsMu.RUnlock()
+		if nc != nil {
+			return nc.c, in[1:]
+		}
+	}
+	return Codec, in
+}
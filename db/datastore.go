@@ -32,6 +32,8 @@ var log = logging.PkgLogger()
 const (
 	EntityCacheKeyPfx = "db/db::"
 	QueryCacheKeyPfx  = "db/db_query_cache::"
+	//Prefix for the query cache generation of a kind
+	QueryGenCacheKeyPfx = "db/db_query_gen::"
 
 	entityNotFoundMsg = "<App_Entity_Not_Found>"
 	//Error returned by Load calls where no entity is found
@@ -64,11 +66,13 @@ func (_ gobCodec) DecodeBytes(in []byte, v interface{}) error {
 	return gob.NewDecoder(bytes.NewBuffer(in)).Decode(v)
 }
 
-// var GobCodec = gobCodec{}
-
 // Variable which sets up the Codec for the datastore package.
 // By default, it is initialized to use gob.
-var Codec CodecBytes = gobCodec{}
+//
+// A TypeMeta may use a different codec (see codec= option in the _struct tag).
+// Data is tagged with the codec it was encoded with, and data without a tag is
+// decoded with this Codec.
+var Codec CodecBytes = GobCodec
 
 type Property struct {
 	Name     string
@@ -119,7 +123,10 @@ type TypeMeta struct {
 	UseDatastore         bool
 	SharedCacheTimeout   time.Duration
 	InstanceCacheTimeout time.Duration
+	Codec                string // name of registered codec for marshal fields and cache entries ("" means Codec)
+	Version              int    // version of the stored form, upgraded on load by registered migrations
 	DbFields             map[string]*DbFieldMeta
+	DbFieldOrder         []string // names of DbFields, in declaration order
 }
 
 //Holds information about a struct field
@@ -132,6 +139,18 @@ type DbFieldMeta struct {
 	ReflectType reflect.Type
 }
 
+//holds the results of a query in the query cache
+type queryCacheEntry struct {
+	Keys   []app.Key
+	Cursor string
+}
+
+//holds the results of a query in the shared query cache (with the keys encoded)
+type sharedQueryCacheEntry struct {
+	Keys   []string
+	Cursor string
+}
+
 //holds info about datastore key in a struct (for use by cache methods, etc)
 type dkeyInfo struct {
 	k   app.Key
@@ -209,8 +228,8 @@ func PostSave(ctx app.Context, keys []app.Key, dst []interface{}) (err error) {
 	//} else {
 	//	err = CacheDelete(ctx, keys...)
 	//}
-	//After a Save, always remove from the caches
-	err = CacheDelete(ctx, keys...)
+	//After a Save, always remove from the caches (after commit, if in a transaction)
+	err = invalidate(ctx, keys...)
 	return err
 }
 
@@ -241,6 +260,10 @@ func Gets(ctx app.Context, useCache bool, keys []app.Key, dst []interface{}) (er
 	}
 	dr := app.AppDriver(ctx.AppUUID())
 	merr := make(errorutil.Multi, len(keys))
+	//within a transaction, the caches may hold values which are not consistent with it
+	if InTransaction(ctx) {
+		useCache = false
+	}
 	//ensure all dst is set to something (non-nil)
 	var kKind, kShape string
 	for i := 0; i < len(dst); i++ {
@@ -407,7 +430,7 @@ func Deletes(ctx app.Context, useCache bool, keys ...app.Key) (err error) {
 	if err = dr.DatastoreDelete(ctx, keys); err != nil {
 		return
 	}
-	err = CacheDelete(ctx, keys...)
+	err = invalidate(ctx, keys...)
 	return
 }
 
@@ -446,7 +469,12 @@ func CachePut(ctx app.Context, keys []app.Key, dst []interface{}) (err error) {
 				&safestore.Item{Key: enckey2, Value: dst[i], TTL: tm.InstanceCacheTimeout})
 		}
 		if tm.UseSharedCache && sharedCache != nil {
-			item := &safestore.Item{Key: enckey2, Value: dst[i]}
+			//shared cache entries are encoded with the codec of the type (and tagged with it)
+			var bs []byte
+			if bs, err = CacheEntryEncode(dst[i]); err != nil {
+				return
+			}
+			item := &safestore.Item{Key: enckey2, Value: bs}
 			if kKind, kShape, _, err = dr.GetInfoFromKey(ctx, keys[i]); err != nil {
 				return
 			}
@@ -529,7 +557,7 @@ func CacheGet(ctx app.Context, keys []app.Key, dst []interface{}) (result []Cach
 			}
 		}
 		if tm.UseSharedCache && sharedCache != nil {
-			mcck = append(mcck, &safestore.Item{Key: enckey2, Value: dst[i]})
+			mcck = append(mcck, &safestore.Item{Key: enckey2})
 			mccki = append(mccki, &dkeyInfo{keys[i], enckey2, i})
 			//mcckm[enckey2] = keys[i]
 			//mccki[keys[i]] = i
@@ -547,6 +575,11 @@ func CacheGet(ctx app.Context, keys []app.Key, dst []interface{}) (result []Cach
 		for i, dki := range mccki {
 			v := mcck[i].Value
 			log.Debug(app.CtxCtx(ctx), "----- SharedCache Result: %#v", v)
+			if bs, ok := v.([]byte); ok {
+				if v, err = CacheEntryDecode(bs, dst[dki.i]); err != nil {
+					return
+				}
+			}
 			if v != nil {
 				if _, ok2 := v.(bool); ok2 {
 					log.Debug(app.CtxCtx(ctx), "Miss Recorded Found in SharedCache: "+
@@ -578,7 +611,7 @@ func CacheDelete(ctx app.Context, keys ...app.Key) (err error) {
 		mcs = append(mcs, enckey2)
 	}
 	sf.Removes(mcs0...)
-	dr.InstanceCache().CacheDelete(ctx, mcs0...)
+	dr.InstanceCache().CacheDelete(ctx, mcs...)
 	if sharedCache := dr.SharedCache(false); sharedCache != nil {
 		err = sharedCache.CacheDelete(ctx, mcs...)
 	}
@@ -727,23 +760,43 @@ func fromDskey(ctx app.Context, s reflect.Value, field string, shape string, key
 	return
 }
 
+//Encode a cache entry for the SharedCache (as done by CachePut), using the codec of its TypeMeta.
+//Negatives (false) and values which are not registered structs use Codec.
+func CacheEntryEncode(v interface{}) (bs []byte, err error) {
+	defer errorutil.OnError(&err)
+	var codecName string
+	if rt := reflect.TypeOf(v); rt != nil && (rt.Kind() == reflect.Struct ||
+		(rt.Kind() == reflect.Ptr && rt.Elem().Kind() == reflect.Struct)) {
+		if rt.Kind() == reflect.Ptr {
+			rt = rt.Elem()
+		}
+		if tm, ok := StructMetas.Get(rt).(*TypeMeta); ok {
+			codecName = tm.Codec
+		}
+	}
+	err = EncodeTagged(codecName, &bs, v)
+	return
+}
+
 //Decode a cache entry. It knows that Negatives are recorded as 'false',
 //supports doing a quick check for false.
+//The entry is decoded with the codec it is tagged with (or Codec if not tagged).
 func CacheEntryDecode(bs []byte, v interface{}) (v2 interface{}, err error) {
 	defer errorutil.OnError(&err)
 	if len(bs) == 0 {
 		return
 	}
-	// "", false, true, etc are typically encoded as 4 bytes or less. Safe'ish check.
-	if len(bs) <= 4 {
+	c, bs := taggedCodec(bs)
+	// "", false, true, etc are typically encoded as 5 bytes or less. Safe'ish check.
+	if len(bs) <= 5 {
 		var bv bool
-		if err2 := Codec.DecodeBytes(bs, &bv); err2 == nil {
+		if err2 := c.DecodeBytes(bs, &bv); err2 == nil {
 			v2 = bv
 			return
 		}
 	}
 	if v2 == nil {
-		if err = Codec.DecodeBytes(bs, v); err != nil {
+		if err = c.DecodeBytes(bs, v); err != nil {
 			return
 		}
 		v2 = v
@@ -752,8 +805,11 @@ func CacheEntryDecode(bs []byte, v interface{}) (v2 interface{}, err error) {
 }
 
 //Query the datastore.
-//This supports using the InstanceCache as a Query Cache.
+//This supports using the InstanceCache (and SharedCache) as a Query Cache.
 //Ensure only entities of this kind and shape are returned.
+//
+//Cached queries are keyed by the query cache generation of the kind,
+//so they are stale as soon as an entity of the kind is put or deleted.
 func QuerySupport(ctx app.Context, qString string, kind string,
 	shape string, nextFn func() (k app.Key, cursor string, err error),
 ) (res []app.Key, lastqcur string, err error) {
@@ -766,29 +822,58 @@ func QuerySupport(ctx app.Context, qString string, kind string,
 	}
 	res = make([]app.Key, 0, 4)
 	var kKind, kShape string
-	//Do caching if instance caching supported.
-	useQCache, cacheTimeout := tm.UseInstanceCache, tm.InstanceCacheTimeout
-	log.Debug(app.CtxCtx(ctx), "QuerySupport: Will Check Query Cache for kind: %v, shape: %v", kind, shape)
 	dr := app.AppDriver(ctx.AppUUID())
+	sharedCache := dr.SharedCache(false)
+	//Do caching if instance (or shared) caching supported.
+	//Within a transaction, the query cache is not used.
+	useQCache := tm.UseInstanceCache && !InTransaction(ctx)
+	useSQCache := tm.UseSharedCache && sharedCache != nil && !InTransaction(ctx)
+	var qkey string
+	if useQCache || useSQCache {
+		qkey = fmt.Sprintf("%s%s@%d::%s", QueryCacheKeyPfx, kind, queryGen(ctx, kind), qString)
+	}
+	fnFromCache := func(keys []app.Key) (err error) {
+		for _, key := range keys {
+			kKind, kShape, _, err = dr.GetInfoFromKey(ctx, key)
+			if err != nil {
+				return
+			}
+			if kind != "" && kind != kKind {
+				continue
+			}
+			if shape != "" && shape != kShape {
+				continue
+			} //skip keys with different shape
+			res = append(res, key)
+		}
+		log.Debug(app.CtxCtx(ctx), "QuerySupport: Returning results from cache: %v", res)
+		return
+	}
+	log.Debug(app.CtxCtx(ctx), "QuerySupport: Will Check Query Cache for kind: %v, shape: %v", kind, shape)
 	if useQCache {
-		it := &safestore.Item{Key: QueryCacheKeyPfx + qString}
+		it := &safestore.Item{Key: qkey}
 		dr.InstanceCache().CacheGet(ctx, it)
-		if it.Value != nil {
-			log.Debug(app.CtxCtx(ctx), "QuerySupport: Found results in cache")
-			for _, key := range it.Value.([]app.Key) {
-				kKind, kShape, _, err = dr.GetInfoFromKey(ctx, key)
-				if err != nil {
+		if qce, ok := it.Value.(*queryCacheEntry); ok {
+			log.Debug(app.CtxCtx(ctx), "QuerySupport: Found results in InstanceCache")
+			lastqcur = qce.Cursor
+			err = fnFromCache(qce.Keys)
+			return
+		}
+	}
+	if useSQCache {
+		it := &safestore.Item{Key: qkey, Value: new(sharedQueryCacheEntry)}
+		if err2 := sharedCache.CacheGet(ctx, it); err2 != nil {
+			log.Debug(app.CtxCtx(ctx), "QuerySupport: Error checking SharedCache: %v", err2)
+		} else if sqce, ok := it.Value.(*sharedQueryCacheEntry); ok {
+			log.Debug(app.CtxCtx(ctx), "QuerySupport: Found results in SharedCache")
+			keys := make([]app.Key, len(sqce.Keys))
+			for i := range sqce.Keys {
+				if keys[i], err = dr.DecodeKey(ctx, sqce.Keys[i]); err != nil {
 					return
 				}
-				if kind != "" && kind != kKind {
-					continue
-				}
-				if shape != "" && shape != kShape {
-					continue
-				} //skip keys with different shape
-				res = append(res, key)
 			}
-			log.Debug(app.CtxCtx(ctx), "QuerySupport: Returning results from cache: %v", res)
+			lastqcur = sqce.Cursor
+			err = fnFromCache(keys)
 			return
 		}
 	}
@@ -796,7 +881,7 @@ func QuerySupport(ctx app.Context, qString string, kind string,
 	//Not in query cache. So continue.
 	var cachedKeys []app.Key
 	//if processcache, store query in cache again (for maybe later)
-	if useQCache {
+	if useQCache || useSQCache {
 		cachedKeys = make([]app.Key, 0, 4)
 	}
 
@@ -822,23 +907,75 @@ func QuerySupport(ctx app.Context, qString string, kind string,
 			continue
 		} //skip keys with different shape
 
-		if useQCache {
+		if useQCache || useSQCache {
 			cachedKeys = append(cachedKeys, key)
 		}
 		res = append(res, key)
 	}
 	if useQCache {
 		it := &safestore.Item{
-			Key:   QueryCacheKeyPfx + qString,
-			Value: cachedKeys,
-			TTL:   cacheTimeout,
+			Key:   qkey,
+			Value: &queryCacheEntry{Keys: cachedKeys, Cursor: lastqcur},
+			TTL:   tm.InstanceCacheTimeout,
 		}
 		dr.InstanceCache().CachePut(ctx, it)
 	}
+	if useSQCache {
+		sqce := &sharedQueryCacheEntry{Keys: make([]string, len(cachedKeys)), Cursor: lastqcur}
+		for i := range cachedKeys {
+			sqce.Keys[i] = dr.EncodeKey(ctx, cachedKeys[i])
+		}
+		it := &safestore.Item{Key: qkey, Value: sqce, TTL: tm.SharedCacheTimeout}
+		log.IfError(app.CtxCtx(ctx), sharedCache.CachePut(ctx, it), "QuerySupport: Error putting into SharedCache")
+	}
 	log.Debug(app.CtxCtx(ctx), "QuerySupport: Returning Keys: %v", res)
 	return
 }
 
+//queryGen returns the query cache generation of a kind.
+//
+//It is kept in the SharedCache (or the InstanceCache if there is no SharedCache),
+//so writes in one process make the cached queries of all processes stale.
+//A generation is initialized from the time, so that if it is evicted from the cache,
+//it does not come back as a generation which was seen before.
+func queryGen(ctx app.Context, kind string) (gen uint64) {
+	dr := app.AppDriver(ctx.AppUUID())
+	gen, err := dr.SharedCache(true).CacheIncr(ctx, QueryGenCacheKeyPfx+kind, 0, uint64(time.Now().UnixNano()))
+	log.IfError(app.CtxCtx(ctx), err, "Error getting query cache generation for kind: %v", kind)
+	return
+}
+
+//bumpQueryGens makes the cached queries for the kinds of the keys stale.
+//Kinds whose queries are not cached (for the shape of the key, or the base shape) are skipped.
+func bumpQueryGens(ctx app.Context, keys ...app.Key) (err error) {
+	defer errorutil.OnError(&err)
+	dr := app.AppDriver(ctx.AppUUID())
+	cache := dr.SharedCache(true)
+	kinds := make(map[string]bool, 2)
+	fnQCache := func(kind, shape string) bool {
+		tm := GetLoadedStructMetaFromKind(kind, shape)
+		return tm == nil || tm.UseInstanceCache || tm.UseSharedCache
+	}
+	for _, key := range keys {
+		var kind, shape string
+		if kind, shape, _, err = dr.GetInfoFromKey(ctx, key); err != nil {
+			return
+		}
+		if kinds[kind] {
+			continue
+		}
+		kinds[kind] = true
+		if !fnQCache(kind, shape) && !fnQCache(kind, "") {
+			continue
+		}
+		if _, err = cache.CacheIncr(ctx, QueryGenCacheKeyPfx+kind, 1, uint64(time.Now().UnixNano())); err != nil {
+			return
+		}
+		log.Debug(app.CtxCtx(ctx), "Bumped query cache generation for kind: %v", kind)
+	}
+	return
+}
+
 func QueryAsString(parentKey app.Key, kind string, opts *app.QueryOpts, filters ...*app.QueryFilter,
 ) (qString string) {
 	sa := make([]string, 0, 4)
@@ -0,0 +1,152 @@
+package db_test
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db"
+	"github.com/ugorji/go-serverapp/db/memdb"
+	"github.com/ugorji/go-serverapp/internal/apptest"
+)
+
+type dsEntity struct {
+	_struct bool `db:"keyf=Id,kind=DsE,pc"`
+	Id      int64
+	Name    string `db:"dbname=n"`
+	Score   int64  `db:"dbname=s"`
+}
+
+func newDsEntities(t *testing.T, ctx app.Context, d *memdb.Driver, ents ...*dsEntity) (keys []app.Key) {
+	dst := make([]interface{}, len(ents))
+	for i, e := range ents {
+		k, err := d.NewKey(ctx, "DsE", "", e.Id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, dst[i] = append(keys, k), e
+	}
+	if err := db.Puts(ctx, true, keys, dst); err != nil {
+		t.Fatalf("Puts: %v", err)
+	}
+	return
+}
+
+func keyIds(keys []app.Key) (ids []int64) {
+	for _, k := range keys {
+		ids = append(ids, k.(*memdb.Key).IntId)
+	}
+	return
+}
+
+func TestGetsPuts(t *testing.T) {
+	d := memdb.New()
+	ctx := apptest.NewContext(t, d)
+	keys := newDsEntities(t, ctx, d, &dsEntity{Id: 1, Name: "one"}, &dsEntity{Id: 2, Name: "two"})
+	k3, _ := d.NewKey(ctx, "DsE", "", 3, nil)
+	keys = append(keys, k3)
+	for _, useCache := range []bool{false, true} {
+		ctx, _ = d.NewContext(nil, ctx.AppUUID(), 2)
+		ents := []interface{}{new(dsEntity), new(dsEntity), new(dsEntity)}
+		err := db.Gets(ctx, useCache, keys, ents)
+		merr, ok := errorutil.Base(err).(errorutil.Multi)
+		if !ok || merr[0] != nil || merr[1] != nil || !db.IsNotFoundError(merr[2]) {
+			t.Fatalf("useCache: %v: expected not found for the last key only, got: %v", useCache, err)
+		}
+		if n1, n2 := ents[0].(*dsEntity).Name, ents[1].(*dsEntity).Name; n1 != "one" || n2 != "two" {
+			t.Fatalf("useCache: %v: expected names: one, two, got: %s, %s", useCache, n1, n2)
+		}
+	}
+}
+
+func TestQueryKeysOnly(t *testing.T) {
+	d := memdb.New()
+	ctx := apptest.NewContext(t, d)
+	newDsEntities(t, ctx, d, &dsEntity{Id: 1, Score: 10}, &dsEntity{Id: 2, Score: 20}, &dsEntity{Id: 3, Score: 30})
+	for _, useCache := range []bool{false, true} {
+		keys, _, err := db.NewQuery("DsE").Filter("s", ">=", 20).Order("-s").UseCache(useCache).KeysOnly(ctx)
+		if ids := keyIds(keys); err != nil || !reflect.DeepEqual(ids, []int64{3, 2}) {
+			t.Fatalf("useCache: %v: expected: [3 2], got: %v (error: %v)", useCache, ids, err)
+		}
+	}
+}
+
+func TestQuerySupport(t *testing.T) {
+	d := memdb.New()
+	ctx := apptest.NewContext(t, d)
+	k1, _ := d.NewKey(ctx, "DsE", "", 1, nil)
+	k2, _ := d.NewKey(ctx, "Other", "", 2, nil)
+	k3, _ := d.NewKey(ctx, "DsE", "", 3, nil)
+	var calls int
+	query := func() ([]app.Key, string) {
+		keys := []app.Key{k1, k2, k3}
+		res, cursor, err := db.QuerySupport(ctx, "q1", "DsE", "", func() (app.Key, string, error) {
+			calls++
+			if len(keys) == 0 {
+				return nil, "end", io.EOF
+			}
+			k := keys[0]
+			keys = keys[1:]
+			return k, "c", nil
+		})
+		if err != nil {
+			t.Fatalf("QuerySupport: %v", err)
+		}
+		return res, cursor
+	}
+	// keys of other kinds are skipped
+	res, cursor := query()
+	if ids := keyIds(res); !reflect.DeepEqual(ids, []int64{1, 3}) || cursor != "end" || calls != 4 {
+		t.Fatalf("expected: [1 3] with cursor: end after 4 calls, got: %v with cursor: %s after %d calls", ids, cursor, calls)
+	}
+	// then served from the query cache
+	res, cursor = query()
+	if ids := keyIds(res); !reflect.DeepEqual(ids, []int64{1, 3}) || cursor != "end" || calls != 4 {
+		t.Fatalf("expected: [1 3] with cursor: end from the cache, got: %v with cursor: %s after %d calls", ids, cursor, calls)
+	}
+}
+
+func TestQueryGetAll(t *testing.T) {
+	d := memdb.New()
+	ctx := apptest.NewContext(t, d)
+	keys := newDsEntities(t, ctx, d, &dsEntity{Id: 1, Score: 10}, &dsEntity{Id: 2, Score: 20},
+		&dsEntity{Id: 3, Score: 30}, &dsEntity{Id: 4, Score: 40}, &dsEntity{Id: 5, Score: 50})
+	q := db.NewQuery("DsE").Order("-s").Limit(2)
+	getAll := func(q *db.Query, exp ...int64) (cursor string) {
+		var ents []*dsEntity
+		cursor, err := q.GetAll(ctx, &ents)
+		if err != nil {
+			t.Fatalf("GetAll: %v", err)
+		}
+		var ids []int64
+		for _, e := range ents {
+			ids = append(ids, e.Id)
+		}
+		if !reflect.DeepEqual(ids, exp) {
+			t.Fatalf("GetAll: expected: %v, got: %v", exp, ids)
+		}
+		return
+	}
+	// cursor round-trip
+	cursor := getAll(q, 5, 4)
+	cursor = getAll(q.Start(cursor), 3, 2)
+	getAll(q.Start(cursor), 1)
+	if n, err := db.NewQuery("DsE").Count(ctx); err != nil || n != 5 {
+		t.Fatalf("Count: expected: 5, got: %d (error: %v)", n, err)
+	}
+
+	// a result deleted since the query ran (and was cached) is skipped
+	if err := d.DatastoreDelete(ctx, keys[3:4]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CacheDelete(ctx, keys[3]); err != nil {
+		t.Fatal(err)
+	}
+	getAll(q, 5)
+	var ents []interface{}
+	if _, err := q.UseCache(false).GetAll(ctx, &ents); err != nil || len(ents) != 2 {
+		t.Fatalf("GetAll without cache: expected 2 results, got: %v (error: %v)", ents, err)
+	}
+}
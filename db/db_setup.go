@@ -77,7 +77,8 @@ func GetLoadedStructMetaFromKind(kind string, shape string) *TypeMeta {
 
 func GetLoadedReflectTypeFromKind(kind string, shape string) reflect.Type {
 	smkKey := getStructMetaKindKey(kind, shape)
-	return StructMetaKinds.Get(smkKey).(reflect.Type)
+	rt, _ := StructMetaKinds.Get(smkKey).(reflect.Type)
+	return rt
 }
 
 func GetStructMeta(s interface{}) (tm *TypeMeta, err error) {
@@ -215,6 +216,17 @@ func addStructMetaFromTypeForStructInfo(rt reflect.Type, tm *TypeMeta) error {
 					tm.ParentShape = stv[i][7:]
 				case strings.HasPrefix(stv[i], "pshapef="):
 					tm.ParentShapeField = stv[i][8:]
+				case strings.HasPrefix(stv[i], "codec="):
+					if GetCodec(stv[i][6:]) == nil {
+						return fmt.Errorf("No codec registered with name: %s", stv[i][6:])
+					}
+					tm.Codec = stv[i][6:]
+				case strings.HasPrefix(stv[i], "version="):
+					to, err := strconv.ParseUint(stv[i][8:], 10, 31)
+					if err != nil {
+						return err
+					}
+					tm.Version = int(to)
 				}
 			}
 		}
@@ -258,6 +270,10 @@ func addStructMetaFromType(rt reflect.Type, tm *TypeMeta) error {
 					fm.Index = appendFVC(stv[i][6:], fm.Index)
 				}
 			}
+			if fm.DbName == VersionPropName {
+				return fmt.Errorf("Error binding dbname: %v to field: %v. It is reserved for the version",
+					fm.DbName, sf.Name)
+			}
 			for _, fm2 := range tm.DbFields {
 				if fm2.DbName == fm.DbName {
 					return fmt.Errorf("Error binding dbname: %v to DBFieldMeta: %#v. Already bound to: %#v",
@@ -273,6 +289,7 @@ func addStructMetaFromType(rt reflect.Type, tm *TypeMeta) error {
 				fm.Store = []FieldValueChecker{NOT_EMPTY_FVC}
 			}
 			tm.DbFields[sf.Name] = fm
+			tm.DbFieldOrder = append(tm.DbFieldOrder, sf.Name)
 		}
 	}
 	return nil
@@ -53,6 +53,27 @@ This ancestor support may be critical to support:
  - fast 1-PC single-entity-group transaction support
  - strongly consistent queries (with the new HRD)
 
+TRANSACTIONS
+
+RunInTransaction runs a function within a transaction, if the app's driver
+implements app.TransactionalDriver. Within the function, all calls must use the
+context passed to it:
+   err = db.RunInTransaction(ctx, func(tctx app.Context) error {
+       if err := db.Get(tctx, true, key, &acct); err != nil {
+           return err
+       }
+       acct.Balance += 100
+       return db.Put(tctx, true, key, &acct)
+   })
+
+Within a transaction:
+ - Gets bypass the caches (request, instance and shared), and do not populate them.
+ - Queries bypass the query cache.
+ - Cache entries of entities put or deleted are only removed after the transaction commits.
+
+If the transaction fails to commit because of a conflict (app.TxConflictError),
+it is run again, up to TxAttempts times. Nested transactions are not supported.
+
 DatastoreKeyAware
  
 This allows an entity to define how it wants to convert to/fro a datastore.Key instance. 
@@ -107,6 +128,16 @@ Benefits
    For even just one field, it could be up about 20 lines of code spread across 
    PostLoadHook, PreSaveHook and PostSaveHook
 
+GENERATED CODE
+
+To avoid the cost of reflection, the ormgen command (in db/ormgen) generates
+ToProperties and FromProperties methods from the db struct tags of a type.
+OrmFromIntf and OrmToIntf use them if present (see PropertiesMarshaler and
+PropertiesUnmarshaler). Versions and migrations are still handled by OrmFromIntf
+and OrmToIntf.
+
+The generated methods must give the same results as reflection, which is
+checked by CheckPropertiesMarshaler (call it from the tests of the package with the types).
 
 CONFIGURATION
  
@@ -136,7 +167,13 @@ The following keys in the struct tag "db" value on field _struct have meaning:
  - parent shape field: "pshapef"=<value> (Optional: value is FieldName. That field must be a string)
  - parent kind: "pkind"=<value> (same as kind but for optional ancestor)
  - parent shape: "pshape"=<value> (same as shape but for optional ancestor)
+ - codec: "codec"=<value> (name of a registered codec e.g. gob, json, msgpack, cbor.
+   It is used for marshal fields and entities in the SharedCache. Default: Codec)
+ - version: "version"=<value> (version of the stored form. See VERSIONS. Default: 0)
 
+Encoded data is prefixed with a tag for its codec, so data encoded with a different
+codec (e.g. before a switch) is still decoded. Data without a tag is decoded with Codec.
+Other codecs can be registered with RegisterCodec.
 
 Note that only fields with a "db" tag are store'able/index'able. To use the field name
 as default datastore column name, just make a non-blank db e.g. `db:"-"`
@@ -161,7 +198,29 @@ continously reflect and parse the same strings). This contains
 By default, we store and index fields whose value is not equal to their "zero" value
 ie if not defined, we act like this is set: store=!z,index=!z
 
+VERSIONS
+
+When a field is renamed or retyped, entities stored before the change will not
+load correctly. To handle this, bump the version on the _struct tag, and register
+a function which upgrades the PropertyList from the previous version e.g.
 
+   _struct bool `db:"keyf=Id,kind=U,version=1"`
+   ...
+   db.RegisterMigration("U", "", 0, func(props *db.PropertyList) error {
+     for i := range *props {
+       if (*props)[i].Name == "name" { (*props)[i].Name = "n" }
+     }
+     return nil
+   })
+
+The version is stored with the entity (in a non-indexed property called _v),
+even by drivers which only store indexed properties (see IndexesOnlyInProps).
+On load, the migrations from the stored version up to the version of the type are
+run in order, before the fields are set. Entities stored without a version are at 0.
+It is an error to load an entity stored by a newer version of the type.
+
+Migrations are only run on load. To rewrite all stored entities of a kind at the
+current version, run MigrateKind (e.g. from an admin task).
 
 QUERIES
  
@@ -182,6 +241,15 @@ leverages the caches, for the following reasons:
 If Not a KeysOnly query, and you don't want your query to integrate with the cache 
 (as is recommended), then call PostLoadNoCaching(...) after each iteration.
 
+Query is a builder which does this (keys only query, followed by a Gets):
+   var users []*User
+   q := db.NewQuery("U").Filter("em", "=", email).Order("-created").Limit(10)
+   cursor, err := q.GetAll(ctx, &users)
+   n, err := q.Count(ctx)
+   keys, cursor, err := q.KeysOnly(ctx)
+
+Count loads the keys of all the results to count them, so it is as costly as KeysOnly.
+
 POLYMORPHIC
  
  
@@ -279,7 +347,11 @@ In general, follow these guidelines also:
 
 The InstanceCache will also support a Query Cache. In this mode:
    - Queries are cached using their canonical (GQL) form as a map/cache key (with prefix)
-   - Note that
+   - Queries are also cached in the SharedCache, if the kind is configured for it (mc)
+   - Note that each kind has a query cache generation, which is part of the cache key.
+     It is kept in the SharedCache (so it is seen by all processes), and is incremented
+     on each Put or Delete of an entity of the kind (after commit, within a transaction).
+     Consequently, cached queries for a kind are stale as soon as any of its entities change.
 
 GUIDELINES
  
@@ -0,0 +1,125 @@
+package filedb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db/memdb"
+)
+
+// blobWriter writes a blob to a temporary file in the blobs directory.
+// On Finish, the file is synced and renamed to the key of the blob,
+// and then a record for the blob is appended to the log.
+type blobWriter struct {
+	d    *Driver
+	ct   string
+	f    *os.File
+	size int64
+}
+
+func (w *blobWriter) Write(b []byte) (n int, err error) {
+	n, err = w.f.Write(b)
+	w.size += int64(n)
+	return
+}
+
+func (w *blobWriter) Finish() (key string, err error) {
+	defer func() {
+		if err != nil {
+			w.f.Close()
+			os.Remove(w.f.Name())
+		}
+	}()
+	if key, err = memdb.NewBlobKey(); err != nil {
+		return
+	}
+	if err = w.f.Sync(); err != nil {
+		return
+	}
+	if err = w.f.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(w.f.Name(), w.d.blobPath(key)); err != nil {
+		return
+	}
+	bi := &app.BlobInfo{
+		Key:          key,
+		ContentType:  w.ct,
+		CreationTime: time.Now(),
+		Size:         w.size,
+	}
+	bs, err := encodeRecord(&record{Op: blobOp, Blob: bi})
+	if err != nil {
+		return
+	}
+	w.d.mu.Lock()
+	defer w.d.mu.Unlock()
+	if err = w.d.write(bs); err != nil {
+		// the blob file is removed on the next compaction
+		return
+	}
+	w.d.blobs[key] = bi
+	return
+}
+
+func (d *Driver) blobPath(key string) string {
+	return filepath.Join(d.dir, blobDirName, key)
+}
+
+func (d *Driver) blob(key string) (bi *app.BlobInfo, err error) {
+	d.mu.RLock()
+	bi = d.blobs[key]
+	d.mu.RUnlock()
+	if bi == nil {
+		err = fmt.Errorf("No Blob found for key: %s", key)
+	}
+	return
+}
+
+func (d *Driver) BlobWriter(ctx app.Context, contentType string) (app.BlobWriter, error) {
+	f, err := os.CreateTemp(filepath.Join(d.dir, blobDirName), "*"+tmpBlobSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{d: d, ct: contentType, f: f}, nil
+}
+
+func (d *Driver) BlobReader(ctx app.Context, key string) (app.BlobReader, error) {
+	if _, err := d.blob(key); err != nil {
+		return nil, err
+	}
+	return os.Open(d.blobPath(key))
+}
+
+func (d *Driver) BlobInfo(ctx app.Context, key string) (*app.BlobInfo, error) {
+	bi, err := d.blob(key)
+	if err != nil {
+		return nil, err
+	}
+	bi2 := *bi
+	return &bi2, nil
+}
+
+func (d *Driver) BlobServe(ctx app.Context, key string, response http.ResponseWriter) (err error) {
+	bi, err := d.blob(key)
+	if err != nil {
+		return
+	}
+	f, err := os.Open(d.blobPath(key))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if bi.ContentType != "" {
+		response.Header().Set("Content-Type", bi.ContentType)
+	}
+	response.Header().Set("Content-Length", strconv.FormatInt(bi.Size, 10))
+	_, err = io.Copy(response, f)
+	return
+}
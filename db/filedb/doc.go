@@ -0,0 +1,45 @@
+/*
+Package filedb provides an implementation of app.LowLevelDriver for single-node
+deployments, which persists entities and blobs to files in a directory.
+
+Entities are stored in an append-only log, and found through indexes kept in memory.
+The indexes are rebuilt from the log when it is opened.
+
+Typical usage:
+   lld, err = filedb.Open("/var/lib/myapp")
+   defer lld.Close()
+   gapp, err = app.NewApp(false, "1001", "views.json", lld)
+
+LOG
+
+Each record in the log is framed by its length and crc32 checksum.
+There are records for a put of an entity (which holds the full db.PropertyList
+produced by db.OrmFromIntf), a delete of an entity, a reservation of ids, and a blob.
+
+A put or delete of many entities is done in a single write. Set SyncWrites
+for the log to be synced to disk after each write.
+
+On open, a torn or corrupt record at the end of the log (e.g. the process
+crashed during a write) is dropped, and the log is truncated to the last good record.
+A corrupt record in the middle of the log (ie followed by valid records) is not
+dropped: Open fails with an error which names its offset, so it can be repaired.
+
+Blob contents are stored in the blobs directory, and are written in full
+before their record is appended to the log.
+
+COMPACTION
+
+As entities are put and deleted, the log holds records which are superseded.
+Once the ratio of stale bytes passes CompactRatio (and the log is at least
+CompactMinSize), the log is compacted: the live records are written to a new
+file, which is synced and then renamed over the log. A crash during a
+compaction leaves the old log in place. Compact can also be called directly.
+
+QUERIES
+
+For each kind, each indexed property (NoIndex=false) has a sorted index of its values.
+A query uses the index of one of its filters (an equality filter if there is one)
+to find the entities which may match, and then runs the full query against their
+indexed properties in memory (as memdb does). Cursors and order are as in memdb.
+*/
+package filedb
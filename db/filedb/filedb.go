@@ -0,0 +1,612 @@
+package filedb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-common/logging"
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db"
+	"github.com/ugorji/go-serverapp/db/memdb"
+)
+
+var log = logging.PkgLogger()
+
+const DriverName = "filedb"
+
+const (
+	logFileName     = "data.log"
+	compactFileName = "data.log.compact"
+	blobDirName     = "blobs"
+	tmpBlobSuffix   = ".tmp"
+)
+
+// idReserve is the number of ids reserved in the log at a time.
+// Ids reserved but not handed out before a restart are skipped.
+const idReserve = 128
+
+var _ app.LowLevelDriver = (*Driver)(nil)
+
+// Driver implements app.LowLevelDriver for a single node,
+// on top of an append-only log file and in-memory indexes.
+type Driver struct {
+	memdb.Base
+	// SyncWrites, if true, syncs the log to disk after each write.
+	SyncWrites bool
+	// CompactRatio is the ratio of stale bytes in the log, beyond which
+	// the log is compacted after a write. A value <= 0 disables it.
+	CompactRatio float64
+	// CompactMinSize is the size of the log below which it is not compacted after a write.
+	CompactMinSize int64
+
+	dir     string
+	mu      sync.RWMutex
+	f       *os.File
+	size    int64 // size of the log
+	stale   int64 // bytes of records in the log which are superseded
+	seq     int64 // last id handed out
+	seqHi   int64 // last id reserved in the log
+	seqSize int64 // size of the last seq record
+	ents    map[string]*entry
+	kinds   map[string]map[string]*entry
+	indexes map[string]map[string]*propIndex
+	blobs   map[string]*app.BlobInfo
+}
+
+// entry holds the location in the log of the last put of an entity,
+// along with its indexed properties (which are used to answer queries).
+type entry struct {
+	memdb.Entity
+	off  int64
+	size int64
+}
+
+// Open opens (or creates) the database in the given directory,
+// and rebuilds the indexes from the log.
+//
+// A record at the end of the log which is torn or corrupt (e.g. the process
+// crashed during a write) is dropped, and the log is truncated to the last good record.
+// If a corrupt record is followed by valid ones, Open fails with an error
+// which names the offset of the corrupt record (so no valid record is dropped).
+func Open(dir string) (d *Driver, err error) {
+	defer errorutil.OnError(&err)
+	if err = os.MkdirAll(filepath.Join(dir, blobDirName), 0755); err != nil {
+		return
+	}
+	// a compaction or blob write which did not complete is discarded
+	if err = os.Remove(filepath.Join(dir, compactFileName)); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	tmps, err := filepath.Glob(filepath.Join(dir, blobDirName, "*"+tmpBlobSuffix))
+	if err != nil {
+		return
+	}
+	for _, s := range tmps {
+		if err = os.Remove(s); err != nil {
+			return
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	d = &Driver{
+		Base:           memdb.NewBase(),
+		CompactRatio:   0.5,
+		CompactMinSize: 4 << 20,
+		dir:            dir,
+		f:              f,
+		ents:           make(map[string]*entry),
+		kinds:          make(map[string]map[string]*entry),
+		indexes:        make(map[string]map[string]*propIndex),
+		blobs:          make(map[string]*app.BlobInfo),
+	}
+	if err = d.replay(); err != nil {
+		f.Close()
+		d = nil
+	}
+	return
+}
+
+// replay reads the log from the start, and rebuilds the in-memory state.
+func (d *Driver) replay() (err error) {
+	br := bufio.NewReader(d.f)
+	var off int64
+	for {
+		r, size, err2 := readRecord(br)
+		if err2 == io.EOF {
+			break
+		}
+		if err2 == errCorruptRecord {
+			if err = d.truncateTornTail(off); err != nil {
+				return
+			}
+			break
+		}
+		if err2 != nil {
+			return err2
+		}
+		// a record which passed its checksum, but cannot be applied, is not from a crash
+		if err = d.apply(r, off, size); err != nil {
+			err = fmt.Errorf("Error applying record at offset: %d: %v", off, err)
+			return
+		}
+		off += size
+	}
+	d.size = off
+	if d.seq < d.seqHi {
+		d.seq = d.seqHi
+	}
+	log.Info(nil, "Opened log: %s, size: %d, entities: %d, blobs: %d", d.f.Name(), d.size, len(d.ents), len(d.blobs))
+	return
+}
+
+// truncateTornTail truncates the log at the offset of a torn or corrupt record,
+// if no valid record follows it (ie it is at the end of the log, from a crash during a write).
+// Else the log is corrupt in its middle, and an error is returned, so no valid record is lost.
+func (d *Driver) truncateTornTail(off int64) (err error) {
+	fi, err := d.f.Stat()
+	if err != nil {
+		return
+	}
+	bs := make([]byte, fi.Size()-off-1)
+	if _, err = d.f.ReadAt(bs, off+1); err != nil {
+		return
+	}
+	if i := findRecord(bs); i >= 0 {
+		return fmt.Errorf("Corrupt record at offset: %d, in log: %s, followed by a valid record at offset: %d",
+			off, d.f.Name(), off+1+int64(i))
+	}
+	log.Warning(nil, "Truncating log: %s, at offset: %d, on torn or corrupt record at its end", d.f.Name(), off)
+	if err = d.f.Truncate(off); err == nil {
+		err = d.f.Sync()
+	}
+	return
+}
+
+// apply updates the in-memory state with a record at the given offset in the log.
+func (d *Driver) apply(r *record, off, size int64) (err error) {
+	switch r.Op {
+	case putOp:
+		var k *memdb.Key
+		if k, err = memdb.ParseKey(r.Key); err != nil {
+			return
+		}
+		var props db.PropertyList
+		if props, err = db.DecodePropertyList(r.Props); err != nil {
+			return
+		}
+		d.put(&entry{Entity: memdb.Entity{Key: k, Props: indexedProps(props)}, off: off, size: size})
+	case delOp:
+		d.del(r.Key)
+		d.stale += size
+	case seqOp:
+		if r.Seq > d.seqHi {
+			d.seqHi = r.Seq
+		}
+		d.stale += d.seqSize
+		d.seqSize = size
+	case blobOp:
+		if r.Blob == nil {
+			return errCorruptRecord
+		}
+		d.blobs[r.Blob.Key] = r.Blob
+	default:
+		err = fmt.Errorf("%v: unknown op: %s", errCorruptRecord, r.Op)
+	}
+	return
+}
+
+// put adds an entry to the in-memory state, replacing the previous one for its key.
+// It must be called with the write lock held.
+func (d *Driver) put(e *entry) {
+	ks := e.Key.String()
+	d.del(ks)
+	d.ents[ks] = e
+	kents := d.kinds[e.Key.Kind]
+	if kents == nil {
+		kents = make(map[string]*entry)
+		d.kinds[e.Key.Kind] = kents
+	}
+	kents[ks] = e
+	d.index(e)
+	if e.Key.IntId > d.seq {
+		d.seq = e.Key.IntId
+	}
+}
+
+// del removes the entry for a key from the in-memory state.
+// It must be called with the write lock held.
+func (d *Driver) del(ks string) {
+	e := d.ents[ks]
+	if e == nil {
+		return
+	}
+	d.unindex(e)
+	delete(d.ents, ks)
+	delete(d.kinds[e.Key.Kind], ks)
+	d.stale += e.size
+}
+
+// write appends framed records to the log.
+// If the write fails, the log is truncated back, so it does not hold a partial record.
+// It must be called with the write lock held.
+func (d *Driver) write(bs []byte) (err error) {
+	if _, err = d.f.WriteAt(bs, d.size); err == nil && d.SyncWrites {
+		err = d.f.Sync()
+	}
+	if err != nil {
+		if err2 := d.f.Truncate(d.size); err2 != nil {
+			log.Error(nil, "Error truncating log: %s, after failed write: %v", d.f.Name(), err2)
+		}
+		return
+	}
+	d.size += int64(len(bs))
+	return
+}
+
+// allocate hands out n ids, reserving more in the log as needed, and returns the first one.
+// It must be called with the write lock held.
+func (d *Driver) allocate(n int64) (first int64, err error) {
+	if d.seq+n > d.seqHi {
+		hi := d.seq + n + idReserve
+		var bs []byte
+		if bs, err = encodeRecord(&record{Op: seqOp, Seq: hi}); err != nil {
+			return
+		}
+		if err = d.write(bs); err != nil {
+			return
+		}
+		d.stale += d.seqSize
+		d.seqSize = int64(len(bs))
+		d.seqHi = hi
+	}
+	first = d.seq + 1
+	d.seq += n
+	return
+}
+
+// Close closes the log.
+func (d *Driver) Close() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f == nil {
+		return
+	}
+	if err = d.f.Sync(); err == nil {
+		err = d.f.Close()
+	}
+	d.f = nil
+	return
+}
+
+func (d *Driver) DriverName() string {
+	return DriverName
+}
+
+func (d *Driver) NewKey(ctx app.Context, kind string, shape string, intId int64, pkey app.Key) (key app.Key, err error) {
+	defer errorutil.OnError(&err)
+	k, err := memdb.NewIncompleteKey(kind, shape, intId, pkey)
+	if err != nil {
+		return
+	}
+	if intId < 0 {
+		d.mu.Lock()
+		k.IntId, err = d.allocate(1)
+		d.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	return k, nil
+}
+
+// readProps reads the properties of an entity from its record in the log.
+// It must be called with the read lock held.
+func (d *Driver) readProps(e *entry) (props db.PropertyList, err error) {
+	bs := make([]byte, e.size)
+	if _, err = d.f.ReadAt(bs, e.off); err != nil {
+		return
+	}
+	r, err := decodeRecord(bs)
+	if err != nil {
+		return
+	}
+	return db.DecodePropertyList(r.Props)
+}
+
+func (d *Driver) DatastoreGet(ctx app.Context, keys []app.Key, dst []interface{}) (err error) {
+	defer errorutil.OnError(&err)
+	merr := make(errorutil.Multi, len(keys))
+	var hasMiss bool
+	for i := range keys {
+		var k *memdb.Key
+		if k, err = memdb.ToKey(keys[i]); err != nil {
+			return
+		}
+		var props db.PropertyList
+		d.mu.RLock()
+		e := d.ents[k.String()]
+		if e != nil {
+			props, err = d.readProps(e)
+		}
+		d.mu.RUnlock()
+		if err != nil {
+			return
+		}
+		if e == nil {
+			merr[i] = db.EntityNotFoundError(fmt.Sprintf("<Not_Found_In_Datastore> Key: %v", k))
+			hasMiss = true
+			continue
+		}
+		if err = db.OrmToIntf(&props, dst[i]); err != nil {
+			return
+		}
+	}
+	if hasMiss {
+		err = merr
+	}
+	return
+}
+
+// DatastorePut appends a record for each entity to the log, in a single write,
+// and then updates the indexes.
+func (d *Driver) DatastorePut(ctx app.Context, keys []app.Key, dst []interface{}, dprops []interface{},
+) (keys2 []app.Key, err error) {
+	defer errorutil.OnError(&err)
+	if len(keys) != len(dprops) {
+		err = fmt.Errorf("DatastorePut: lengths mismatch; keys: %v, props: %v", len(keys), len(dprops))
+		return
+	}
+	ks := make([]*memdb.Key, len(keys))
+	pls := make([]db.PropertyList, len(keys))
+	var numIncomplete int64
+	for i := range keys {
+		if ks[i], err = memdb.ToKey(keys[i]); err != nil {
+			return
+		}
+		if pls[i], err = memdb.ToPropertyList(dprops[i]); err != nil {
+			return
+		}
+		if ks[i].Incomplete() {
+			numIncomplete++
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if numIncomplete > 0 {
+		var id int64
+		if id, err = d.allocate(numIncomplete); err != nil {
+			return
+		}
+		for i, k := range ks {
+			if k.Incomplete() {
+				k2 := *k
+				k2.IntId = id
+				ks[i] = &k2
+				id++
+			}
+		}
+	}
+	var buf []byte
+	ents := make([]*entry, len(ks))
+	keys2 = make([]app.Key, len(ks))
+	for i, k := range ks {
+		r := &record{Op: putOp, Key: k.String()}
+		if r.Props, err = db.EncodePropertyList(pls[i]); err != nil {
+			return
+		}
+		var bs []byte
+		if bs, err = encodeRecord(r); err != nil {
+			return
+		}
+		ents[i] = &entry{
+			Entity: memdb.Entity{Key: k, Props: indexedProps(pls[i])},
+			off:    d.size + int64(len(buf)),
+			size:   int64(len(bs)),
+		}
+		buf = append(buf, bs...)
+		keys2[i] = k
+	}
+	if err = d.write(buf); err != nil {
+		return
+	}
+	for _, e := range ents {
+		d.put(e)
+	}
+	log.Debug(app.CtxCtx(ctx), "DatastorePut: keys: %v", keys2)
+	d.maybeCompact()
+	return
+}
+
+func (d *Driver) DatastoreDelete(ctx app.Context, keys []app.Key) (err error) {
+	defer errorutil.OnError(&err)
+	kss := make([]string, 0, len(keys))
+	for i := range keys {
+		var k *memdb.Key
+		if k, err = memdb.ToKey(keys[i]); err != nil {
+			return
+		}
+		kss = append(kss, k.String())
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var buf []byte
+	for _, ks := range kss {
+		if d.ents[ks] == nil {
+			continue
+		}
+		var bs []byte
+		if bs, err = encodeRecord(&record{Op: delOp, Key: ks}); err != nil {
+			return
+		}
+		buf = append(buf, bs...)
+	}
+	if len(buf) == 0 {
+		return
+	}
+	if err = d.write(buf); err != nil {
+		return
+	}
+	for _, ks := range kss {
+		d.del(ks)
+	}
+	// the delete records are themselves stale, as they are not needed after a compaction
+	d.stale += int64(len(buf))
+	d.maybeCompact()
+	return
+}
+
+// Query narrows down the entities which may match using the index of one of the
+// filters, and then runs the query against their indexed properties in memory.
+func (d *Driver) Query(ctx app.Context, parent app.Key, kind string, opts *app.QueryOpts,
+	filters ...*app.QueryFilter,
+) (res []app.Key, endCursor string, err error) {
+	defer errorutil.OnError(&err)
+	pk, err := memdb.ToKey(parent)
+	if err != nil {
+		return
+	}
+	d.mu.RLock()
+	ents := d.candidates(kind, filters)
+	d.mu.RUnlock()
+	return memdb.RunQuery(ents, pk, kind, opts, filters...)
+}
+
+// Compact rewrites the log with only the live records, and replaces the old log with it.
+//
+// The new log is written to a separate file, which is renamed over the old log
+// only after it is synced; so a crash during a compaction leaves the old log intact.
+// Blob files which are not referenced in the log are removed.
+func (d *Driver) Compact() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.compact()
+}
+
+// maybeCompact compacts the log if enough of it is stale.
+// It must be called with the write lock held.
+func (d *Driver) maybeCompact() {
+	if d.CompactRatio <= 0 || d.size < d.CompactMinSize || float64(d.stale) < d.CompactRatio*float64(d.size) {
+		return
+	}
+	log.IfError(nil, d.compact(), "Error compacting log: %s", d.f.Name())
+}
+
+func (d *Driver) compact() (err error) {
+	defer errorutil.OnError(&err)
+	fpath := filepath.Join(d.dir, compactFileName)
+	f2, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f2.Close()
+			os.Remove(fpath)
+		}
+	}()
+	w := bufio.NewWriter(f2)
+	var off, seqSize int64
+	offs := make(map[string]int64, len(d.ents))
+	fnWrite := func(bs []byte) (err error) {
+		_, err = w.Write(bs)
+		off += int64(len(bs))
+		return
+	}
+	bs, err := encodeRecord(&record{Op: seqOp, Seq: d.seqHi})
+	if err != nil {
+		return
+	}
+	seqSize = int64(len(bs))
+	if err = fnWrite(bs); err != nil {
+		return
+	}
+	for _, bi := range d.blobs {
+		if bs, err = encodeRecord(&record{Op: blobOp, Blob: bi}); err != nil {
+			return
+		}
+		if err = fnWrite(bs); err != nil {
+			return
+		}
+	}
+	for ks, e := range d.ents {
+		// copy the record as is, verifying it on the way
+		bs = make([]byte, e.size)
+		if _, err = d.f.ReadAt(bs, e.off); err != nil {
+			return
+		}
+		if _, err = decodeRecord(bs); err != nil {
+			err = fmt.Errorf("Error compacting record for key: %s, at offset: %d: %v", ks, e.off, err)
+			return
+		}
+		offs[ks] = off
+		if err = fnWrite(bs); err != nil {
+			return
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	if err = f2.Sync(); err != nil {
+		return
+	}
+	if err = os.Rename(fpath, filepath.Join(d.dir, logFileName)); err != nil {
+		return
+	}
+	// the new log is in place, so switch to it regardless of what happens after
+	log.IfError(nil, syncDir(d.dir), "Error syncing directory: %s", d.dir)
+	log.Info(nil, "Compacted log: %s, from size: %d (stale: %d), to size: %d", f2.Name(), d.size, d.stale, off)
+	d.f.Close()
+	d.f = f2
+	for ks, e := range d.ents {
+		e.off = offs[ks]
+	}
+	d.size, d.stale, d.seqSize = off, 0, seqSize
+	d.removeOrphanBlobs()
+	return
+}
+
+// removeOrphanBlobs removes blob files which are not referenced in the log
+// e.g. if the process crashed after the blob file was written, but before its record.
+// It must be called with the write lock held.
+func (d *Driver) removeOrphanBlobs() {
+	bdir := filepath.Join(d.dir, blobDirName)
+	fis, err := os.ReadDir(bdir)
+	if err != nil {
+		log.Error(nil, "Error reading blobs directory: %s: %v", bdir, err)
+		return
+	}
+	for _, fi := range fis {
+		// blobs being written have a temporary name, and are skipped
+		if n := fi.Name(); d.blobs[n] == nil && !strings.HasSuffix(n, tmpBlobSuffix) {
+			log.IfError(nil, os.Remove(filepath.Join(bdir, n)), "Error removing orphan blob: %s", n)
+		}
+	}
+}
+
+func syncDir(dir string) (err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// indexedProps returns the properties which are indexed (ie NoIndex=false).
+func indexedProps(props db.PropertyList) db.PropertyList {
+	props2 := make(db.PropertyList, 0, len(props))
+	for _, p := range props {
+		if !p.NoIndex {
+			props2 = append(props2, p)
+		}
+	}
+	return props2
+}
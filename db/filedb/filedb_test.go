@@ -0,0 +1,217 @@
+package filedb
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db"
+	"github.com/ugorji/go-serverapp/db/memdb"
+)
+
+type fdEntity struct {
+	_struct bool   `db:"kind=FdE"`
+	Name    string `db:"dbname=n"`
+}
+
+func open(t *testing.T, dir string) *Driver {
+	d, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	d.CompactRatio = 0 // tests compact explicitly
+	return d
+}
+
+func put(t *testing.T, d *Driver, id int64, name string) app.Key {
+	k, err := d.NewKey(nil, "FdE", "", id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := db.PropertyList{{Name: "n", Value: name}}
+	if _, err = d.DatastorePut(nil, []app.Key{k}, nil, []interface{}{props}); err != nil {
+		t.Fatalf("DatastorePut: %v", err)
+	}
+	return k
+}
+
+// names returns the name of each entity of the keys, or "" if not found.
+func names(t *testing.T, d *Driver, keys ...app.Key) []string {
+	ss := make([]string, len(keys))
+	for i, k := range keys {
+		var v fdEntity
+		err := d.DatastoreGet(nil, []app.Key{k}, []interface{}{&v})
+		if err != nil {
+			if _, ok := errorutil.Base(err).(errorutil.Multi); !ok {
+				t.Fatalf("DatastoreGet: %v", err)
+			}
+			continue
+		}
+		ss[i] = v.Name
+	}
+	return ss
+}
+
+func keyStrings(keys []app.Key) (ss []string) {
+	for _, k := range keys {
+		ss = append(ss, k.(*memdb.Key).String())
+	}
+	return
+}
+
+func logSize(t *testing.T, dir string) int64 {
+	fi, err := os.Stat(filepath.Join(dir, logFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestReplayTornTail(t *testing.T) {
+	dir := t.TempDir()
+	d := open(t, dir)
+	k1, k2 := put(t, d, 1, "one"), put(t, d, 2, "two")
+	size2 := logSize(t, dir)
+	k3 := put(t, d, 3, "three")
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// cut the log in the middle of the last record
+	if err := os.Truncate(filepath.Join(dir, logFileName), logSize(t, dir)-5); err != nil {
+		t.Fatal(err)
+	}
+	d = open(t, dir)
+	defer d.Close()
+	if s := names(t, d, k1, k2, k3); !reflect.DeepEqual(s, []string{"one", "two", ""}) {
+		t.Fatalf("after torn tail: expected: [one two ], got: %q", s)
+	}
+	if n := logSize(t, dir); n != size2 {
+		t.Fatalf("expected log truncated to: %d, got: %d", size2, n)
+	}
+	// the log is appended to after the truncation
+	k3 = put(t, d, 3, "three")
+	d.Close()
+	d = open(t, dir)
+	defer d.Close()
+	if s := names(t, d, k1, k2, k3); !reflect.DeepEqual(s, []string{"one", "two", "three"}) {
+		t.Fatalf("after reopen: expected: [one two three], got: %q", s)
+	}
+}
+
+func TestReplayCorruptMiddle(t *testing.T) {
+	dir := t.TempDir()
+	d := open(t, dir)
+	put(t, d, 1, "one")
+	off := logSize(t, dir)
+	put(t, d, 2, "two")
+	put(t, d, 3, "three")
+	d.Close()
+	// flip a bit in the payload of the second record
+	fpath := filepath.Join(dir, logFileName)
+	bs, err := os.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs[off+recHeaderLen+2] ^= 1
+	if err = os.WriteFile(fpath, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(dir); err == nil || !strings.Contains(err.Error(), "offset: "+strconv.FormatInt(off, 10)+",") {
+		t.Fatalf("expected error naming offset: %d, got: %v", off, err)
+	}
+	// the log is left as is
+	if n := logSize(t, dir); n != int64(len(bs)) {
+		t.Fatalf("expected log of size: %d, got: %d", len(bs), n)
+	}
+}
+
+func writeBlob(t *testing.T, d *Driver, data string) string {
+	w, err := d.BlobWriter(nil, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	key, err := w.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	d := open(t, dir)
+	k1 := put(t, d, 1, "one")
+	k2 := put(t, d, 2, "two")
+	put(t, d, 1, "uno") // supersedes one
+	k3 := put(t, d, 3, "three")
+	if err := d.DatastoreDelete(nil, []app.Key{k2}); err != nil {
+		t.Fatal(err)
+	}
+	bkey := writeBlob(t, d, "blob data")
+
+	bdir := filepath.Join(dir, blobDirName)
+	for _, s := range []string{"orphan", "writing" + tmpBlobSuffix} {
+		if err := os.WriteFile(filepath.Join(bdir, s), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := logSize(t, dir)
+	if err := d.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if n := logSize(t, dir); n >= size {
+		t.Fatalf("expected compacted log smaller than: %d, got: %d", size, n)
+	}
+	// orphan blobs are removed, but not blobs being written
+	var files []string
+	fis, err := os.ReadDir(bdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		files = append(files, fi.Name())
+	}
+	expFiles := []string{bkey, "writing" + tmpBlobSuffix}
+	sort.Strings(expFiles)
+	if !reflect.DeepEqual(files, expFiles) {
+		t.Fatalf("blob files: expected: %v, got: %v", expFiles, files)
+	}
+
+	// writes after the compaction are kept
+	k4 := put(t, d, 4, "four")
+	d.Close()
+	d = open(t, dir)
+	defer d.Close()
+	if s := names(t, d, k1, k2, k3, k4); !reflect.DeepEqual(s, []string{"uno", "", "three", "four"}) {
+		t.Fatalf("after compaction: expected: [uno  three four], got: %q", s)
+	}
+	res, _, err := d.Query(nil, nil, "FdE", &app.QueryOpts{Order: "n"})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if exp := []app.Key{k4, k3, k1}; !reflect.DeepEqual(keyStrings(res), keyStrings(exp)) {
+		t.Fatalf("Query: expected: %v, got: %v", exp, res)
+	}
+	res, _, err = d.Query(nil, nil, "FdE", nil, &app.QueryFilter{Name: "n", Op: app.EQ, Value: "two"})
+	if err != nil || len(res) != 0 {
+		t.Fatalf("Query for deleted entity: expected none, got: %v (error: %v)", res, err)
+	}
+	bi, err := d.BlobInfo(nil, bkey)
+	if err != nil || bi.Size != int64(len("blob data")) {
+		t.Fatalf("BlobInfo: %+v (error: %v)", bi, err)
+	}
+	// ids reserved before the compaction are not handed out again
+	if k5, err := d.NewKey(nil, "FdE", "", -1, nil); err != nil || k5.(*memdb.Key).IntId <= 4 {
+		t.Fatalf("NewKey: expected id > 4, got: %v (error: %v)", k5, err)
+	}
+}
@@ -0,0 +1,204 @@
+package filedb
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db/memdb"
+)
+
+// indexItem is a value in a propIndex, and the key of the entity which has it.
+type indexItem struct {
+	val interface{}
+	key string
+}
+
+// propIndex is a sorted index of the values of an indexed property,
+// across all entities of a kind.
+//
+// Items are sorted by the rank of their type, then value, then key.
+// Numbers (int64 and float64) share a rank, so they are compared with each other.
+type propIndex struct {
+	items []indexItem
+}
+
+// valueRank returns the rank of the type of a normalized value in an index,
+// or 0 if values of that type are not indexed.
+func valueRank(v interface{}) int {
+	switch v.(type) {
+	case int64, float64:
+		return 1
+	case string:
+		return 2
+	case bool:
+		return 3
+	case time.Time:
+		return 4
+	case []byte:
+		return 5
+	}
+	return 0
+}
+
+// compareValue compares 2 normalized values, first by the rank of their types.
+func compareValue(a, b interface{}) int {
+	ra, rb := valueRank(a), valueRank(b)
+	switch {
+	case ra < rb:
+		return -1
+	case ra > rb:
+		return 1
+	}
+	c, _ := memdb.CompareValues(a, b)
+	return c
+}
+
+func compareItem(x indexItem, val interface{}, key string) int {
+	if c := compareValue(x.val, val); c != 0 {
+		return c
+	}
+	return strings.Compare(x.key, key)
+}
+
+func (x *propIndex) search(val interface{}, key string) int {
+	return sort.Search(len(x.items), func(i int) bool { return compareItem(x.items[i], val, key) >= 0 })
+}
+
+func (x *propIndex) add(val interface{}, key string) {
+	i := x.search(val, key)
+	if i < len(x.items) && compareItem(x.items[i], val, key) == 0 {
+		return
+	}
+	x.items = append(x.items, indexItem{})
+	copy(x.items[i+1:], x.items[i:])
+	x.items[i] = indexItem{val: val, key: key}
+}
+
+func (x *propIndex) remove(val interface{}, key string) {
+	i := x.search(val, key)
+	if i < len(x.items) && compareItem(x.items[i], val, key) == 0 {
+		x.items = append(x.items[:i], x.items[i+1:]...)
+	}
+}
+
+// lookup returns the keys of entities which have a value satisfying (value op val).
+// A key may be returned more than once, if it has many values which satisfy it.
+func (x *propIndex) lookup(op app.QueryFilterOp, val interface{}) (keys []string) {
+	r := valueRank(val)
+	if r == 0 {
+		return
+	}
+	n := len(x.items)
+	first := func(fn func(v interface{}) bool) int {
+		return sort.Search(n, func(i int) bool { return fn(x.items[i].val) })
+	}
+	rankLo := first(func(v interface{}) bool { return valueRank(v) >= r })
+	rankHi := first(func(v interface{}) bool { return valueRank(v) > r })
+	lo := first(func(v interface{}) bool { return compareValue(v, val) >= 0 })
+	hi := first(func(v interface{}) bool { return compareValue(v, val) > 0 })
+	var i, j int
+	switch op {
+	case app.EQ:
+		i, j = lo, hi
+	case app.GT:
+		i, j = hi, rankHi
+	case app.GTE:
+		i, j = lo, rankHi
+	case app.LT:
+		i, j = rankLo, lo
+	case app.LTE:
+		i, j = rankLo, hi
+	default:
+		return
+	}
+	keys = make([]string, 0, j-i)
+	for _, it := range x.items[i:j] {
+		keys = append(keys, it.key)
+	}
+	return
+}
+
+// index adds the indexed properties of an entity to the indexes of its kind.
+// It must be called with the write lock held.
+func (d *Driver) index(e *entry) {
+	ks := e.Key.String()
+	kix := d.indexes[e.Key.Kind]
+	if kix == nil {
+		kix = make(map[string]*propIndex)
+		d.indexes[e.Key.Kind] = kix
+	}
+	for _, p := range e.Props {
+		v := memdb.NormValue(p.Value)
+		if valueRank(v) == 0 {
+			continue
+		}
+		ix := kix[p.Name]
+		if ix == nil {
+			ix = new(propIndex)
+			kix[p.Name] = ix
+		}
+		ix.add(v, ks)
+	}
+}
+
+// unindex removes the indexed properties of an entity from the indexes of its kind.
+// It must be called with the write lock held.
+func (d *Driver) unindex(e *entry) {
+	ks := e.Key.String()
+	kix := d.indexes[e.Key.Kind]
+	for _, p := range e.Props {
+		if ix := kix[p.Name]; ix != nil {
+			ix.remove(memdb.NormValue(p.Value), ks)
+			if len(ix.items) == 0 {
+				delete(kix, p.Name)
+			}
+		}
+	}
+}
+
+// candidates returns the entities which may match a query, narrowed down using
+// the index of one of the filters (an equality filter if there is one).
+// The full query is then run against them by memdb.RunQuery.
+// It must be called with the read lock held.
+func (d *Driver) candidates(kind string, filters []*app.QueryFilter) (ents []*memdb.Entity) {
+	if kind == "" {
+		ents = make([]*memdb.Entity, 0, len(d.ents))
+		for _, e := range d.ents {
+			ents = append(ents, &e.Entity)
+		}
+		return
+	}
+	var f *app.QueryFilter
+	for _, f2 := range filters {
+		if f == nil || (f2.Op == app.EQ && f.Op != app.EQ) {
+			f = f2
+		}
+	}
+	if f == nil {
+		kents := d.kinds[kind]
+		ents = make([]*memdb.Entity, 0, len(kents))
+		for _, e := range kents {
+			ents = append(ents, &e.Entity)
+		}
+		return
+	}
+	ix := d.indexes[kind][f.Name]
+	if ix == nil {
+		return
+	}
+	keys := ix.lookup(f.Op, memdb.NormValue(f.Value))
+	seen := make(map[string]bool, len(keys))
+	ents = make([]*memdb.Entity, 0, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if e := d.ents[k]; e != nil {
+			ents = append(ents, &e.Entity)
+		}
+	}
+	return
+}
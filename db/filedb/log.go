@@ -0,0 +1,111 @@
+package filedb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/ugorji/go-serverapp/app"
+)
+
+const (
+	putOp  = "p"
+	delOp  = "d"
+	seqOp  = "s"
+	blobOp = "b"
+)
+
+// recHeaderLen is the length of the header of each record: length and crc32 of the payload.
+const recHeaderLen = 8
+
+// maxRecLen bounds the length of a record, so a corrupt header is not mistaken for a huge record.
+const maxRecLen = 1 << 30
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// record is an entry in the log.
+type record struct {
+	Op    string          `json:"o"`
+	Key   string          `json:"k,omitempty"`
+	Props json.RawMessage `json:"p,omitempty"`
+	Seq   int64           `json:"s,omitempty"`
+	Blob  *app.BlobInfo   `json:"b,omitempty"`
+}
+
+// encodeRecord returns the record, framed with its header.
+func encodeRecord(r *record) (bs []byte, err error) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	bs = make([]byte, recHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(bs[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(bs[4:8], crc32.ChecksumIEEE(payload))
+	copy(bs[recHeaderLen:], payload)
+	return
+}
+
+// decodeRecord decodes a framed record, verifying its length and checksum.
+func decodeRecord(bs []byte) (r *record, err error) {
+	if len(bs) < recHeaderLen {
+		return nil, errCorruptRecord
+	}
+	n := binary.BigEndian.Uint32(bs[0:4])
+	if int(n) != len(bs)-recHeaderLen || crc32.ChecksumIEEE(bs[recHeaderLen:]) != binary.BigEndian.Uint32(bs[4:8]) {
+		return nil, errCorruptRecord
+	}
+	r = new(record)
+	if err = json.Unmarshal(bs[recHeaderLen:], r); err != nil {
+		err = fmt.Errorf("%v: %v", errCorruptRecord, err)
+	}
+	return
+}
+
+// readRecord reads the framed record at the current position of rd.
+// It returns io.EOF at a clean end of the log, and errCorruptRecord
+// for a torn or corrupt record (e.g. from a crash during a write).
+func readRecord(rd io.Reader) (r *record, size int64, err error) {
+	var hdr [recHeaderLen]byte
+	if _, err = io.ReadFull(rd, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errCorruptRecord
+		}
+		return
+	}
+	n := binary.BigEndian.Uint32(hdr[0:4])
+	if n > maxRecLen {
+		err = errCorruptRecord
+		return
+	}
+	bs := make([]byte, recHeaderLen+int(n))
+	copy(bs, hdr[:])
+	if _, err = io.ReadFull(rd, bs[recHeaderLen:]); err != nil {
+		err = errCorruptRecord
+		return
+	}
+	size = int64(len(bs))
+	r, err = decodeRecord(bs)
+	return
+}
+
+// findRecord returns the offset of the first valid record in bs, or -1 if there is none.
+// It is used to tell a torn record at the end of the log from a corrupt one in its middle.
+func findRecord(bs []byte) int {
+	for i := 0; i+recHeaderLen < len(bs); i++ {
+		// the payload is a json object
+		if bs[i+recHeaderLen] != '{' {
+			continue
+		}
+		n := int64(binary.BigEndian.Uint32(bs[i : i+4]))
+		if n > int64(len(bs)-i-recHeaderLen) {
+			continue
+		}
+		if _, err := decodeRecord(bs[i : i+recHeaderLen+int(n)]); err == nil {
+			return i
+		}
+	}
+	return -1
+}
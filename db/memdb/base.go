@@ -0,0 +1,116 @@
+package memdb
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ugorji/go-common/safestore"
+	"github.com/ugorji/go-serverapp/app"
+)
+
+// Base implements the parts of app.LowLevelDriver which do not depend on
+// where entities and blobs are stored i.e. caches, contexts and keys.
+//
+// It is embedded by drivers which use Key as their app.Key.
+type Base struct {
+	// HostName is returned by Host (default: localhost:8080).
+	HostName string
+	// Client is returned by HttpClient (default: http.DefaultClient).
+	Client *http.Client
+	// Shared is returned by SharedCache (default: nil).
+	Shared app.Cache
+
+	instCache app.SafeStoreCache
+}
+
+func NewBase() Base {
+	return Base{
+		HostName:  "localhost:8080",
+		Client:    http.DefaultClient,
+		instCache: app.SafeStoreCache{T: safestore.New(true)},
+	}
+}
+
+func (d *Base) IndexesOnlyInProps() bool {
+	return false
+}
+
+func (d *Base) InstanceCache() app.Cache {
+	return d.instCache
+}
+
+func (d *Base) SharedCache(returnInstanceCacheIfNil bool) app.Cache {
+	if d.Shared != nil {
+		return d.Shared
+	}
+	if returnInstanceCacheIfNil {
+		return d.instCache
+	}
+	return nil
+}
+
+func (d *Base) NewContext(r *http.Request, appUUID string, seqnum uint64) (app.Context, error) {
+	return &app.BasicContext{
+		SeqNum:     seqnum,
+		TheAppUUID: appUUID,
+		SafeStore:  safestore.New(false),
+	}, nil
+}
+
+func (d *Base) UseCache(ctx app.Context, preferred bool) bool {
+	return preferred
+}
+
+func (d *Base) HttpClient(ctx app.Context) (*http.Client, error) {
+	return d.Client, nil
+}
+
+func (d *Base) Host(ctx app.Context) (string, error) {
+	return d.HostName, nil
+}
+
+func (d *Base) ParentKey(ctx app.Context, key app.Key) app.Key {
+	// Note: do not return a nil *Key as a non-nil app.Key
+	if k, _ := ToKey(key); k != nil && k.Parent != nil {
+		return k.Parent
+	}
+	return nil
+}
+
+func (d *Base) EncodeKey(ctx app.Context, key app.Key) string {
+	k, _ := ToKey(key)
+	return k.Encode()
+}
+
+func (d *Base) GetInfoFromKey(ctx app.Context, key app.Key) (kind string, shape string, intId int64, err error) {
+	k, err := ToKey(key)
+	if err != nil {
+		return
+	}
+	if k == nil {
+		err = fmt.Errorf("GetInfoFromKey: nil Key")
+		return
+	}
+	return k.Kind, k.Shape, k.IntId, nil
+}
+
+func (d *Base) DecodeKey(ctx app.Context, s string) (app.Key, error) {
+	return DecodeKey(s)
+}
+
+// NewIncompleteKey validates the parts of a key and returns a Key for them.
+// Drivers call it from NewKey, and allocate the id if intId < 0.
+func NewIncompleteKey(kind string, shape string, intId int64, pkey app.Key) (k *Key, err error) {
+	if kind == "" || !validKeyPart(kind) || !validKeyPart(shape) {
+		err = fmt.Errorf("NewKey: Invalid kind: %q or shape: %q", kind, shape)
+		return
+	}
+	k = &Key{Kind: kind, Shape: shape, IntId: intId}
+	if k.Parent, err = ToKey(pkey); err != nil {
+		return
+	}
+	if k.IntId < 0 {
+		k.IntId = 0
+	}
+	return
+}
@@ -0,0 +1,111 @@
+package memdb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ugorji/go-serverapp/app"
+)
+
+type blob struct {
+	info app.BlobInfo
+	data []byte
+}
+
+type blobWriter struct {
+	d   *Driver
+	ct  string
+	buf bytes.Buffer
+}
+
+type blobReader struct {
+	*bytes.Reader
+}
+
+func (w *blobWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+func (w *blobWriter) Finish() (key string, err error) {
+	if key, err = NewBlobKey(); err != nil {
+		return
+	}
+	b := &blob{data: w.buf.Bytes()}
+	b.info = app.BlobInfo{
+		Key:          key,
+		ContentType:  w.ct,
+		CreationTime: time.Now(),
+		Size:         int64(len(b.data)),
+	}
+	w.d.mu.Lock()
+	w.d.blobs[key] = b
+	w.d.mu.Unlock()
+	return
+}
+
+func (r blobReader) Close() error {
+	return nil
+}
+
+// NewBlobKey returns a random web-safe key for a blob.
+func NewBlobKey() (string, error) {
+	var bs [16]byte
+	if _, err := rand.Read(bs[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs[:]), nil
+}
+
+func (d *Driver) blob(key string) (b *blob, err error) {
+	d.mu.RLock()
+	b = d.blobs[key]
+	d.mu.RUnlock()
+	if b == nil {
+		err = fmt.Errorf("No Blob found for key: %s", key)
+	}
+	return
+}
+
+func (d *Driver) BlobWriter(ctx app.Context, contentType string) (app.BlobWriter, error) {
+	return &blobWriter{d: d, ct: contentType}, nil
+}
+
+func (d *Driver) BlobReader(ctx app.Context, key string) (app.BlobReader, error) {
+	b, err := d.blob(key)
+	if err != nil {
+		return nil, err
+	}
+	return blobReader{bytes.NewReader(b.data)}, nil
+}
+
+func (d *Driver) BlobInfo(ctx app.Context, key string) (*app.BlobInfo, error) {
+	b, err := d.blob(key)
+	if err != nil {
+		return nil, err
+	}
+	bi := b.info
+	return &bi, nil
+}
+
+func (d *Driver) BlobServe(ctx app.Context, key string, response http.ResponseWriter) (err error) {
+	b, err := d.blob(key)
+	if err != nil {
+		return
+	}
+	ServeBlob(response, &b.info, b.data)
+	return
+}
+
+// ServeBlob writes out the headers and contents of a blob.
+func ServeBlob(w http.ResponseWriter, bi *app.BlobInfo, data []byte) {
+	if bi.ContentType != "" {
+		w.Header().Set("Content-Type", bi.ContentType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
@@ -0,0 +1,31 @@
+/*
+Package memdb provides an in-process, in-memory implementation of app.LowLevelDriver.
+
+It supports keys, datastore get/put/delete, queries (with filters, order, offset,
+limit and cursors), blobs and caches. Nothing is persisted, so it is best suited
+for local development and for exercising the db package in tests.
+
+Typical usage:
+   gapp, err = app.NewApp(true, "1001", "views.json", memdb.New())
+
+QUERIES
+
+Queries only consider indexed properties (ie those with NoIndex=false).
+A multi-valued property matches a filter if any of its values matches.
+Order is a comma-separated list of property names, with a - prefix for
+descending order e.g. "-created,name". Entities which do not have a value
+for an ordered property are not returned.
+
+Cursors hold the values of the ordered properties, and the key, of the last
+entity returned (see Cursor). The next page starts after it, so paging is not
+affected by entities put or deleted in between. sqldb and filedb use the same cursors.
+
+TRANSACTIONS
+
+The driver implements app.TransactionalDriver, with optimistic transactions.
+Gets within a transaction see its own puts and deletes, which are applied when
+it commits. The commit fails with an app.TxConflictError if an entity read or
+written within the transaction was changed by another commit since it started.
+Queries within a transaction only see committed entities.
+*/
+package memdb
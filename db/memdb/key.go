@@ -0,0 +1,117 @@
+package memdb
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ugorji/go-serverapp/app"
+)
+
+// Key implements app.Key.
+//
+// A Key is identified by its kind, optional shape, int id and optional parent.
+// A Key with IntId <= 0 is incomplete (ie it cannot be stored as is).
+type Key struct {
+	Kind   string
+	Shape  string
+	IntId  int64
+	Parent *Key
+}
+
+func (k *Key) Incomplete() bool {
+	return k.IntId <= 0
+}
+
+func (k *Key) EntityId() int64 {
+	return k.IntId
+}
+
+// String returns the canonical form of the key e.g. P,1/TP:sh,12
+// (ancestors first, separated by /).
+func (k *Key) String() string {
+	if k == nil {
+		return ""
+	}
+	s := k.Kind
+	if k.Shape != "" {
+		s += ":" + k.Shape
+	}
+	s += "," + strconv.FormatInt(k.IntId, 10)
+	if k.Parent != nil {
+		s = k.Parent.String() + "/" + s
+	}
+	return s
+}
+
+// Encode returns a web-safe encoding of the key.
+func (k *Key) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(k.String()))
+}
+
+// Equal returns true if both keys have the same kind, shape, id and ancestors.
+func (k *Key) Equal(k2 *Key) bool {
+	for ; k != nil && k2 != nil; k, k2 = k.Parent, k2.Parent {
+		if k.Kind != k2.Kind || k.Shape != k2.Shape || k.IntId != k2.IntId {
+			return false
+		}
+	}
+	return k == nil && k2 == nil
+}
+
+// HasAncestor returns true if anc is a (possibly indirect) parent of k.
+func (k *Key) HasAncestor(anc *Key) bool {
+	for k2 := k.Parent; k2 != nil; k2 = k2.Parent {
+		if k2.Equal(anc) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeKey decodes a string got from (*Key).Encode.
+func DecodeKey(s string) (k *Key, err error) {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return
+	}
+	return ParseKey(string(bs))
+}
+
+// ParseKey parses a string got from (*Key).String.
+func ParseKey(s string) (k *Key, err error) {
+	for _, s2 := range strings.Split(s, "/") {
+		k2 := &Key{Parent: k}
+		i := strings.LastIndex(s2, ",")
+		if i == -1 {
+			return nil, fmt.Errorf("Invalid Key: %s", s)
+		}
+		if k2.IntId, err = strconv.ParseInt(s2[i+1:], 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid Key: %s: %v", s, err)
+		}
+		k2.Kind = s2[:i]
+		if j := strings.Index(k2.Kind, ":"); j != -1 {
+			k2.Kind, k2.Shape = k2.Kind[:j], k2.Kind[j+1:]
+		}
+		k = k2
+	}
+	return
+}
+
+// ToKey converts an app.Key into a *Key. It returns an error if the app.Key
+// was not created by this package.
+func ToKey(key app.Key) (k *Key, err error) {
+	if key == nil {
+		return
+	}
+	var ok bool
+	if k, ok = key.(*Key); !ok {
+		err = fmt.Errorf("Unsupported Key type: %T", key)
+	}
+	return
+}
+
+func validKeyPart(s string) bool {
+	return !strings.ContainsAny(s, ",:/")
+}
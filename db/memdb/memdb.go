@@ -0,0 +1,220 @@
+package memdb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-common/logging"
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db"
+)
+
+var log = logging.PkgLogger()
+
+const DriverName = "memdb"
+
+var _ app.LowLevelDriver = (*Driver)(nil)
+
+// Driver is an in-process implementation of app.LowLevelDriver.
+//
+// Entities are stored as the db.PropertyList passed to DatastorePut,
+// so everything is loaded back through db.OrmToIntf.
+type Driver struct {
+	Base
+	mu    sync.RWMutex
+	seq   int64
+	ver   int64            // incremented on each change to an entity
+	vers  map[string]int64 // key to ver of its last change (used to detect conflicts)
+	ents  map[string]*Entity
+	blobs map[string]*blob
+}
+
+// New returns a new in-memory driver.
+func New() *Driver {
+	return &Driver{
+		Base:  NewBase(),
+		vers:  make(map[string]int64),
+		ents:  make(map[string]*Entity),
+		blobs: make(map[string]*blob),
+	}
+}
+
+func (d *Driver) DriverName() string {
+	return DriverName
+}
+
+func (d *Driver) NewKey(ctx app.Context, kind string, shape string, intId int64, pkey app.Key) (key app.Key, err error) {
+	defer errorutil.OnError(&err)
+	k, err := NewIncompleteKey(kind, shape, intId, pkey)
+	if err != nil {
+		return
+	}
+	if intId < 0 {
+		k.IntId = d.AllocateId()
+	}
+	return k, nil
+}
+
+// AllocateId returns a fresh id, unique across all kinds.
+func (d *Driver) AllocateId() int64 {
+	d.mu.Lock()
+	d.seq++
+	n := d.seq
+	d.mu.Unlock()
+	return n
+}
+
+func (d *Driver) DatastoreGet(ctx app.Context, keys []app.Key, dst []interface{}) (err error) {
+	defer errorutil.OnError(&err)
+	merr := make(errorutil.Multi, len(keys))
+	var hasMiss bool
+	for i := range keys {
+		var k *Key
+		if k, err = ToKey(keys[i]); err != nil {
+			return
+		}
+		var e *Entity
+		if t := txOf(ctx); t != nil {
+			e = t.get(d, k.String())
+		} else {
+			d.mu.RLock()
+			e = d.ents[k.String()]
+			d.mu.RUnlock()
+		}
+		if e == nil {
+			merr[i] = db.EntityNotFoundError(fmt.Sprintf("<Not_Found_In_Datastore> Key: %v", k))
+			hasMiss = true
+			continue
+		}
+		props := copyProps(e.Props)
+		if err = db.OrmToIntf(&props, dst[i]); err != nil {
+			return
+		}
+	}
+	if hasMiss {
+		err = merr
+	}
+	return
+}
+
+func (d *Driver) DatastorePut(ctx app.Context, keys []app.Key, dst []interface{}, dprops []interface{},
+) (keys2 []app.Key, err error) {
+	defer errorutil.OnError(&err)
+	if len(keys) != len(dprops) {
+		err = fmt.Errorf("DatastorePut: lengths mismatch; keys: %v, props: %v", len(keys), len(dprops))
+		return
+	}
+	keys2 = make([]app.Key, len(keys))
+	ents := make([]*Entity, len(keys))
+	for i := range keys {
+		var k *Key
+		if k, err = ToKey(keys[i]); err != nil {
+			return
+		}
+		var props db.PropertyList
+		if props, err = ToPropertyList(dprops[i]); err != nil {
+			return
+		}
+		if k.Incomplete() {
+			k2 := *k
+			k2.IntId = d.AllocateId()
+			k = &k2
+		}
+		keys2[i] = k
+		ents[i] = &Entity{Key: k, Props: copyProps(props)}
+	}
+	if t := txOf(ctx); t != nil {
+		for _, e := range ents {
+			t.writes[e.Key.String()] = e
+		}
+	} else {
+		d.mu.Lock()
+		for _, e := range ents {
+			d.set(e.Key.String(), e)
+		}
+		d.mu.Unlock()
+	}
+	log.Debug(app.CtxCtx(ctx), "DatastorePut: keys: %v", keys2)
+	return
+}
+
+func (d *Driver) DatastoreDelete(ctx app.Context, keys []app.Key) (err error) {
+	defer errorutil.OnError(&err)
+	kss := make([]string, len(keys))
+	for i := range keys {
+		var k *Key
+		if k, err = ToKey(keys[i]); err != nil {
+			return
+		}
+		kss[i] = k.String()
+	}
+	if t := txOf(ctx); t != nil {
+		for _, ks := range kss {
+			t.writes[ks] = nil
+		}
+		return
+	}
+	d.mu.Lock()
+	for _, ks := range kss {
+		d.set(ks, nil)
+	}
+	d.mu.Unlock()
+	return
+}
+
+// set puts the entity for a key (or deletes it if e is nil).
+// It must be called with the write lock held.
+func (d *Driver) set(ks string, e *Entity) {
+	d.ver++
+	d.vers[ks] = d.ver
+	if e == nil {
+		delete(d.ents, ks)
+		return
+	}
+	if e.Key.IntId > d.seq {
+		d.seq = e.Key.IntId
+	}
+	d.ents[ks] = e
+}
+
+func (d *Driver) Query(ctx app.Context, parent app.Key, kind string, opts *app.QueryOpts,
+	filters ...*app.QueryFilter,
+) (res []app.Key, endCursor string, err error) {
+	defer errorutil.OnError(&err)
+	pk, err := ToKey(parent)
+	if err != nil {
+		return
+	}
+	d.mu.RLock()
+	ents := make([]*Entity, 0, len(d.ents))
+	for _, e := range d.ents {
+		ents = append(ents, e)
+	}
+	d.mu.RUnlock()
+	return RunQuery(ents, pk, kind, opts, filters...)
+}
+
+// ToPropertyList converts the dprops passed to DatastorePut into a db.PropertyList.
+func ToPropertyList(v interface{}) (props db.PropertyList, err error) {
+	switch x := v.(type) {
+	case *db.PropertyList:
+		props = *x
+	case db.PropertyList:
+		props = x
+	default:
+		err = fmt.Errorf("Unsupported property list type: %T", v)
+	}
+	return
+}
+
+func copyProps(props db.PropertyList) db.PropertyList {
+	props2 := make(db.PropertyList, len(props))
+	copy(props2, props)
+	for i := range props2 {
+		if bs, ok := props2[i].Value.([]byte); ok {
+			props2[i].Value = append([]byte(nil), bs...)
+		}
+	}
+	return props2
+}
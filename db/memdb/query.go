@@ -0,0 +1,316 @@
+package memdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db"
+)
+
+// Entity is a stored entity, as considered by RunQuery.
+type Entity struct {
+	Key   *Key
+	Props db.PropertyList
+}
+
+// OrderBy is a single sort order parsed from app.QueryOpts.Order.
+type OrderBy struct {
+	Name string
+	Desc bool
+}
+
+// ParseOrder parses a QueryOpts.Order string.
+// It is a comma-separated list of property names. A name with a - prefix is
+// sorted in descending order e.g. "-created,name".
+func ParseOrder(s string) (ords []OrderBy) {
+	for _, s2 := range strings.Split(s, ",") {
+		if s2 = strings.TrimSpace(s2); s2 == "" {
+			continue
+		}
+		var o OrderBy
+		switch s2[0] {
+		case '-':
+			o.Desc = true
+			s2 = s2[1:]
+		case '+':
+			s2 = s2[1:]
+		}
+		o.Name = s2
+		ords = append(ords, o)
+	}
+	return
+}
+
+// cursorKeyName is the name of the key in an encoded cursor.
+const cursorKeyName = "__key__"
+
+// Cursor holds the values of the ordered properties, and the key, of the last entity
+// returned by a query. The next page starts after it, so paging is not affected by
+// entities put or deleted in between.
+type Cursor struct {
+	Vals []interface{}
+	Key  string
+}
+
+// EncodeCursor encodes a cursor for a query with the given order.
+func EncodeCursor(ords []OrderBy, c *Cursor) (s string, err error) {
+	props := make(db.PropertyList, 0, len(ords)+1)
+	for i, o := range ords {
+		props = append(props, db.Property{Name: o.Name, Value: NormValue(c.Vals[i])})
+	}
+	props = append(props, db.Property{Name: cursorKeyName, Value: c.Key})
+	bs, err := db.EncodePropertyList(props)
+	if err != nil {
+		return
+	}
+	s = base64.RawURLEncoding.EncodeToString(bs)
+	return
+}
+
+// DecodeCursor decodes a cursor, checking that it is for a query with the given order.
+func DecodeCursor(ords []OrderBy, s string) (c *Cursor, err error) {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		err = fmt.Errorf("Invalid Cursor: %s", s)
+		return
+	}
+	props, err := db.DecodePropertyList(bs)
+	if err != nil {
+		err = fmt.Errorf("Invalid Cursor: %s", s)
+		return
+	}
+	if len(props) != len(ords)+1 || props[len(ords)].Name != cursorKeyName {
+		err = fmt.Errorf("Cursor does not match the order of the query: %s", s)
+		return
+	}
+	c = &Cursor{Vals: make([]interface{}, len(ords))}
+	for i, o := range ords {
+		if props[i].Name != o.Name {
+			err = fmt.Errorf("Cursor does not match the order of the query: %s", s)
+			return
+		}
+		c.Vals[i] = props[i].Value
+	}
+	c.Key, _ = props[len(ords)].Value.(string)
+	return
+}
+
+// cursorOf returns the cursor of an entity, for a query with the given order.
+func cursorOf(ords []OrderBy, e *Entity) (c *Cursor) {
+	c = &Cursor{Vals: make([]interface{}, len(ords)), Key: e.Key.String()}
+	for i, o := range ords {
+		c.Vals[i], _ = IndexedValue(e.Props, o.Name)
+	}
+	return
+}
+
+// compareCursors compares the positions of 2 cursors in the order of a query,
+// returning -1, 0 or 1. Entities of equal values are ordered by their key.
+func compareCursors(ords []OrderBy, a, b *Cursor) int {
+	for i, o := range ords {
+		if c, _ := CompareValues(a.Vals[i], b.Vals[i]); c != 0 {
+			if o.Desc {
+				return -c
+			}
+			return c
+		}
+	}
+	return strings.Compare(a.Key, b.Key)
+}
+
+// NormValue converts a value to the canonical type which is stored in a db.PropertyList
+// i.e. int64, float64, string, bool, time.Time or []byte.
+func NormValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil, int64, float64, string, bool, time.Time, []byte:
+		return v
+	case *Key:
+		return x.String()
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	}
+	return v
+}
+
+// CompareValues compares 2 property values, returning -1, 0 or 1.
+// ok is false if the values are not comparable (e.g. string and int64).
+func CompareValues(a, b interface{}) (c int, ok bool) {
+	a, b = NormValue(a), NormValue(b)
+	fnCmp := func(lt, gt bool) int {
+		switch {
+		case lt:
+			return -1
+		case gt:
+			return 1
+		}
+		return 0
+	}
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return fnCmp(x < y, x > y), true
+		case float64:
+			return fnCmp(float64(x) < y, float64(x) > y), true
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return fnCmp(x < float64(y), x > float64(y)), true
+		case float64:
+			return fnCmp(x < y, x > y), true
+		}
+	case string:
+		if y, ok2 := b.(string); ok2 {
+			return strings.Compare(x, y), true
+		}
+	case bool:
+		if y, ok2 := b.(bool); ok2 {
+			return fnCmp(!x && y, x && !y), true
+		}
+	case time.Time:
+		if y, ok2 := b.(time.Time); ok2 {
+			return fnCmp(x.Before(y), x.After(y)), true
+		}
+	case []byte:
+		if y, ok2 := b.([]byte); ok2 {
+			return bytes.Compare(x, y), true
+		}
+	}
+	return
+}
+
+// MatchOp returns true if the result of a CompareValues satisfies the op.
+func MatchOp(op app.QueryFilterOp, c int) bool {
+	switch op {
+	case app.EQ:
+		return c == 0
+	case app.GT:
+		return c > 0
+	case app.GTE:
+		return c >= 0
+	case app.LT:
+		return c < 0
+	case app.LTE:
+		return c <= 0
+	}
+	return false
+}
+
+// MatchFilters returns true if all filters are satisfied by the indexed properties.
+// A multi-valued property satisfies a filter if any of its values does.
+func MatchFilters(props db.PropertyList, filters ...*app.QueryFilter) bool {
+	for _, f := range filters {
+		found := false
+		for _, p := range props {
+			if p.Name != f.Name || p.NoIndex {
+				continue
+			}
+			if c, ok := CompareValues(p.Value, f.Value); ok && MatchOp(f.Op, c) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// IndexedValue returns the first indexed value of the named property.
+func IndexedValue(props db.PropertyList, name string) (v interface{}, ok bool) {
+	for _, p := range props {
+		if p.Name == name && !p.NoIndex {
+			return p.Value, true
+		}
+	}
+	return
+}
+
+// RunQuery runs a query against a set of entities, and returns the matching keys.
+// It handles kind, ancestor, shape, filters, order, offset, limit and cursors.
+//
+// Entities which do not have an indexed value for an ordered property are not returned.
+func RunQuery(ents []*Entity, parent *Key, kind string, opts *app.QueryOpts, filters ...*app.QueryFilter,
+) (res []app.Key, endCursor string, err error) {
+	if opts == nil {
+		opts = new(app.QueryOpts)
+	}
+	ords := ParseOrder(opts.Order)
+	var start, end *Cursor
+	if opts.StartCursor != "" {
+		if start, err = DecodeCursor(ords, opts.StartCursor); err != nil {
+			return
+		}
+	}
+	if opts.EndCursor != "" {
+		if end, err = DecodeCursor(ords, opts.EndCursor); err != nil {
+			return
+		}
+	}
+	ents2 := make([]*Entity, 0, len(ents))
+	curs := make(map[*Entity]*Cursor, len(ents))
+LOOP:
+	for _, e := range ents {
+		if kind != "" && e.Key.Kind != kind {
+			continue
+		}
+		if opts.Shape != "" && e.Key.Shape != opts.Shape {
+			continue
+		}
+		if parent != nil && !e.Key.HasAncestor(parent) {
+			continue
+		}
+		for _, o := range ords {
+			if _, ok := IndexedValue(e.Props, o.Name); !ok {
+				continue LOOP
+			}
+		}
+		if !MatchFilters(e.Props, filters...) {
+			continue
+		}
+		c := cursorOf(ords, e)
+		if (start != nil && compareCursors(ords, c, start) <= 0) || (end != nil && compareCursors(ords, c, end) > 0) {
+			continue
+		}
+		ents2 = append(ents2, e)
+		curs[e] = c
+	}
+	sort.Slice(ents2, func(i, j int) bool {
+		return compareCursors(ords, curs[ents2[i]], curs[ents2[j]]) < 0
+	})
+	i, j := opts.Offset, len(ents2)
+	if opts.Limit > 0 && i+opts.Limit < j {
+		j = i + opts.Limit
+	}
+	if i > j {
+		i = j
+	}
+	res = make([]app.Key, 0, j-i)
+	for _, e := range ents2[i:j] {
+		res = append(res, e.Key)
+	}
+	endCursor = opts.StartCursor
+	if j > i {
+		endCursor, err = EncodeCursor(ords, curs[ents2[j-1]])
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package memdb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db"
+)
+
+func putProps(t *testing.T, d *Driver, id int64, props db.PropertyList) app.Key {
+	k, err := d.NewKey(nil, "QrE", "", id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.DatastorePut(nil, []app.Key{k}, nil, []interface{}{props}); err != nil {
+		t.Fatalf("DatastorePut: %v", err)
+	}
+	return k
+}
+
+func keyIds(keys []app.Key) (ids []int64) {
+	for _, k := range keys {
+		ids = append(ids, k.(*Key).IntId)
+	}
+	return
+}
+
+func TestQueryCursorStable(t *testing.T) {
+	d := New()
+	put := func(id int64, score int64) app.Key {
+		return putProps(t, d, id, db.PropertyList{{Name: "score", Value: score}})
+	}
+	for i := int64(1); i <= 6; i++ {
+		put(i, 10*i)
+	}
+	opts := &app.QueryOpts{Order: "-score", Limit: 2}
+	page := func(exp ...int64) {
+		res, cursor, err := d.Query(nil, nil, "QrE", opts)
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		if ids := keyIds(res); !reflect.DeepEqual(ids, exp) {
+			t.Fatalf("page: expected: %v, got: %v", exp, ids)
+		}
+		opts.StartCursor = cursor
+	}
+	page(6, 5)
+	// neither deleting a returned entity, nor adding one before the cursor, moves the next page
+	k5, _ := d.NewKey(nil, "QrE", "", 5, nil)
+	if err := d.DatastoreDelete(nil, []app.Key{k5}); err != nil {
+		t.Fatal(err)
+	}
+	put(7, 70)
+	page(4, 3)
+	// an entity after the cursor (with the same score as the last one, but a greater key) is returned
+	put(8, 30)
+	page(8, 2)
+	page(1)
+	page()
+	if opts.StartCursor == "" {
+		t.Fatalf("expected the cursor kept past the end of the results")
+	}
+
+	// the end cursor is inclusive
+	res, cursor, err := d.Query(nil, nil, "QrE", &app.QueryOpts{Order: "-score", Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err = d.Query(nil, nil, "QrE", &app.QueryOpts{Order: "-score", EndCursor: cursor})
+	if ids := keyIds(res); err != nil || !reflect.DeepEqual(ids, []int64{7, 6, 4}) {
+		t.Fatalf("Query up to cursor: expected: [7 6 4], got: %v (error: %v)", ids, err)
+	}
+	// a cursor is for the order of its query
+	if _, _, err = d.Query(nil, nil, "QrE", &app.QueryOpts{Order: "-score,name", StartCursor: cursor}); err == nil {
+		t.Fatalf("expected error for a cursor of another order")
+	}
+	if _, _, err = d.Query(nil, nil, "QrE", &app.QueryOpts{StartCursor: "x!"}); err == nil {
+		t.Fatalf("expected error for an invalid cursor")
+	}
+}
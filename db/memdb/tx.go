@@ -0,0 +1,79 @@
+package memdb
+
+import (
+	"fmt"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-serverapp/app"
+)
+
+var _ app.TransactionalDriver = (*Driver)(nil)
+
+// tx is the state of a transaction: the keys read within it, and the entities
+// to put (or delete, if nil) when it commits.
+type tx struct {
+	start  int64
+	reads  map[string]bool
+	writes map[string]*Entity
+}
+
+// txOf returns the transaction of this driver which ctx is within, if any.
+func txOf(ctx app.Context) *tx {
+	if tctx := app.TxFrom(ctx); tctx != nil {
+		t, _ := tctx.Tx.(*tx)
+		return t
+	}
+	return nil
+}
+
+// get returns the entity for a key as seen within the transaction.
+func (t *tx) get(d *Driver, ks string) *Entity {
+	if e, ok := t.writes[ks]; ok {
+		return e
+	}
+	t.reads[ks] = true
+	d.mu.RLock()
+	e := d.ents[ks]
+	d.mu.RUnlock()
+	return e
+}
+
+// RunInTransaction runs fn in an optimistic transaction.
+//
+// Gets within the transaction see its own puts and deletes, which are only applied when it commits.
+// Queries within it only see committed entities.
+//
+// The commit fails with an app.TxConflictError if an entity read, put or deleted within
+// the transaction was changed by another commit after the transaction started.
+func (d *Driver) RunInTransaction(ctx app.Context, fn func(tctx *app.TxContext) error) (err error) {
+	defer errorutil.OnError(&err)
+	d.mu.RLock()
+	t := &tx{start: d.ver, reads: make(map[string]bool), writes: make(map[string]*Entity)}
+	d.mu.RUnlock()
+	if err = fn(&app.TxContext{Context: ctx, Tx: t}); err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fnConflict := func(ks string) bool {
+		if d.vers[ks] > t.start {
+			err = app.TxConflictError(fmt.Sprintf("Transaction conflict on key: %s", ks))
+			return true
+		}
+		return false
+	}
+	for ks := range t.reads {
+		if fnConflict(ks) {
+			return
+		}
+	}
+	for ks := range t.writes {
+		if fnConflict(ks) {
+			return
+		}
+	}
+	for ks, e := range t.writes {
+		d.set(ks, e)
+	}
+	return
+}
@@ -0,0 +1,172 @@
+package memdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-common/safestore"
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db"
+	"github.com/ugorji/go-serverapp/internal/apptest"
+)
+
+type txEntity struct {
+	_struct bool `db:"keyf=Id,kind=TxE"`
+	Id      int64
+	Name    string `db:"dbname=n"`
+}
+
+type txCachedEntity struct {
+	_struct bool `db:"keyf=Id,kind=TxC,pc,mc"`
+	Id      int64
+	Name    string `db:"dbname=n"`
+}
+
+// newTestApp creates an app backed by a memdb Driver, and returns a context for it.
+func newTestApp(t *testing.T) (d *Driver, ctx app.Context) {
+	d = New()
+	return d, apptest.NewContext(t, d)
+}
+
+func TestRunInTransactionViaApp(t *testing.T) {
+	d, ctx := newTestApp(t)
+	key, err := d.NewKey(ctx, "TxE", "", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// committed
+	err = db.RunInTransaction(ctx, func(tctx app.Context) error {
+		return db.Put(tctx, false, key, &txEntity{Id: 1, Name: "one"})
+	})
+	if err != nil {
+		t.Fatalf("RunInTransaction: %v", err)
+	}
+	var v txEntity
+	if err = db.Get(ctx, false, key, &v); err != nil {
+		t.Fatalf("Get after commit: %v", err)
+	}
+	if v.Name != "one" {
+		t.Fatalf("Get after commit: expected name: one, got: %q", v.Name)
+	}
+
+	// rolled back
+	errFail := errors.New("fail")
+	err = db.RunInTransaction(ctx, func(tctx app.Context) error {
+		if err := db.Put(tctx, false, key, &txEntity{Id: 1, Name: "two"}); err != nil {
+			return err
+		}
+		return errFail
+	})
+	if err == nil {
+		t.Fatalf("RunInTransaction: expected error, got nil")
+	}
+	v = txEntity{}
+	if err = db.Get(ctx, false, key, &v); err != nil {
+		t.Fatalf("Get after rollback: %v", err)
+	}
+	if v.Name != "one" {
+		t.Fatalf("Get after rollback: expected name: one, got: %q", v.Name)
+	}
+}
+
+func TestRunInTransactionConflict(t *testing.T) {
+	d, ctx := newTestApp(t)
+	key, _ := d.NewKey(ctx, "TxE", "", 1, nil)
+	if err := db.Put(ctx, false, key, &txEntity{Id: 1, Name: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	// each attempt up to conflicts changes the entity outside the transaction, after reading it
+	run := func(conflicts int) (attempts int, err error) {
+		err = db.RunInTransaction(ctx, func(tctx app.Context) error {
+			attempts++
+			var v txEntity
+			if err := db.Get(tctx, false, key, &v); err != nil {
+				return err
+			}
+			if attempts <= conflicts {
+				if err := db.Put(ctx, false, key, &txEntity{Id: 1, Name: "other"}); err != nil {
+					return err
+				}
+			}
+			return db.Put(tctx, false, key, &txEntity{Id: 1, Name: v.Name + "+"})
+		})
+		return
+	}
+	if attempts, err := run(1); err != nil || attempts != 2 {
+		t.Fatalf("conflict once: expected success after 2 attempts, got: %d attempts (error: %v)", attempts, err)
+	}
+	attempts, err := run(db.TxAttempts)
+	if !app.IsTxConflict(err) || attempts != db.TxAttempts {
+		t.Fatalf("conflict always: expected conflict after %d attempts, got: %d attempts (error: %v)", db.TxAttempts, attempts, err)
+	}
+	var v txEntity
+	if err = db.Get(ctx, false, key, &v); err != nil || v.Name != "other" {
+		t.Fatalf("expected name: other (none of the failed attempts applied), got: %q (error: %v)", v.Name, err)
+	}
+}
+
+func TestRunInTransactionCacheEviction(t *testing.T) {
+	d := New()
+	shared := app.SafeStoreCache{T: safestore.New(true)}
+	d.Shared = shared
+	ctx := apptest.NewContext(t, d)
+	key, _ := d.NewKey(ctx, "TxC", "", 1, nil)
+	if err := db.Put(ctx, true, key, &txCachedEntity{Id: 1, Name: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	var v txCachedEntity
+	if err := db.Get(ctx, true, key, &v); err != nil {
+		t.Fatal(err)
+	}
+	// cached returns true if the entity is in the InstanceCache and the SharedCache,
+	// and false if in neither.
+	cached := func() bool {
+		var n int
+		for _, c := range []app.Cache{d.InstanceCache(), shared} {
+			it := &safestore.Item{Key: db.EntityCacheKeyPfx + d.EncodeKey(ctx, key)}
+			if c.CacheGet(ctx, it); it.Value != nil {
+				n++
+			}
+		}
+		if n == 1 {
+			t.Fatalf("expected entity in both caches or neither")
+		}
+		return n == 2
+	}
+	if !cached() {
+		t.Fatalf("expected entity in the caches")
+	}
+	errFail := errors.New("fail")
+	for _, fail := range []bool{true, false} {
+		err := db.RunInTransaction(ctx, func(tctx app.Context) error {
+			if err := db.Put(tctx, true, key, &txCachedEntity{Id: 1, Name: "two"}); err != nil {
+				return err
+			}
+			if !cached() {
+				t.Errorf("fail: %v: expected entity in the caches before commit", fail)
+			}
+			if fail {
+				return errFail
+			}
+			return nil
+		})
+		if fail {
+			if errorutil.Base(err) != errFail || !cached() {
+				t.Fatalf("expected entity in the caches after rollback (error: %v)", err)
+			}
+			ctx2, _ := d.NewContext(nil, ctx.AppUUID(), 2) // a new request, so not from the request cache
+			var v2 txCachedEntity                          // not v, as the caches hold it
+			if err = db.Get(ctx2, true, key, &v2); err != nil || v2.Name != "one" {
+				t.Fatalf("Get after rollback: expected name: one, got: %q (error: %v)", v2.Name, err)
+			}
+		} else if err != nil || cached() {
+			t.Fatalf("expected entity evicted from the caches after commit (error: %v)", err)
+		}
+	}
+	ctx, _ = d.NewContext(nil, ctx.AppUUID(), 3)
+	var v3 txCachedEntity
+	if err := db.Get(ctx, true, key, &v3); err != nil || v3.Name != "two" {
+		t.Fatalf("Get after commit: expected name: two, got: %q (error: %v)", v3.Name, err)
+	}
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-serverapp/app"
+)
+
+// VersionPropName is the name of the property which holds the version of a
+// stored entity (see version= option in the _struct tag).
+// A PropertyList without it is at version 0.
+const VersionPropName = "_v"
+
+// MigrationBatchSize is the default number of entities loaded and rewritten at a time by MigrateKind.
+var MigrationBatchSize = 100
+
+// MigrationFunc upgrades the PropertyList of an entity from one version to the next.
+// It can rename, retype, add or remove properties in place.
+type MigrationFunc func(props *PropertyList) error
+
+var (
+	migrationsMu sync.RWMutex
+	migrations   = make(map[string]map[int]MigrationFunc) //kind(:shape) -> fromVersion -> fn
+)
+
+// RegisterMigration registers the function which upgrades the PropertyList of
+// entities of the kind and shape, from version fromVersion to fromVersion+1.
+//
+// When an entity is loaded, the migrations from its stored version up to the version
+// of its type are run in order. A version with no registered migration is skipped
+// (e.g. if a field was only added).
+func RegisterMigration(kind string, shape string, fromVersion int, fn MigrationFunc) error {
+	if kind == "" || fn == nil {
+		return fmt.Errorf("RegisterMigration: kind and function are required")
+	}
+	if fromVersion < 0 {
+		return fmt.Errorf("RegisterMigration: invalid version: %d for kind: %s", fromVersion, kind)
+	}
+	smkKey := getStructMetaKindKey(kind, shape)
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	m := migrations[smkKey]
+	if m == nil {
+		m = make(map[int]MigrationFunc)
+		migrations[smkKey] = m
+	}
+	if _, ok := m[fromVersion]; ok {
+		return fmt.Errorf("RegisterMigration: migration from version: %d already registered for: %s",
+			fromVersion, smkKey)
+	}
+	m[fromVersion] = fn
+	return nil
+}
+
+func getMigration(kind string, shape string, fromVersion int) (fn MigrationFunc) {
+	migrationsMu.RLock()
+	fn = migrations[getStructMetaKindKey(kind, shape)][fromVersion]
+	migrationsMu.RUnlock()
+	return
+}
+
+// PropsVersion returns the version of the entity which the PropertyList was stored from.
+func PropsVersion(props PropertyList) int {
+	for _, p := range props {
+		if p.Name == VersionPropName {
+			if v, ok := p.Value.(int64); ok {
+				return int(v)
+			}
+		}
+	}
+	return 0
+}
+
+// migrateProps upgrades the PropertyList to the version of tm, running the registered migrations.
+// It is an error if the PropertyList was stored by a newer version of the type.
+func migrateProps(m *PropertyList, tm *TypeMeta) (err error) {
+	v := PropsVersion(*m)
+	if v == tm.Version {
+		return
+	}
+	if v > tm.Version {
+		return fmt.Errorf("Entity of kind: %s at version: %d is newer than its type: %v at version: %d",
+			tm.Kind, v, tm.Type, tm.Version)
+	}
+	for ; v < tm.Version; v++ {
+		fn := getMigration(tm.Kind, tm.Shape, v)
+		if fn == nil {
+			log.Debug(nil, "No migration for kind: %s, shape: %s, from version: %d", tm.Kind, tm.Shape, v)
+			continue
+		}
+		if err = fn(m); err != nil {
+			return fmt.Errorf("Error migrating kind: %s, shape: %s, from version: %d: %v",
+				tm.Kind, tm.Shape, v, err)
+		}
+	}
+	return
+}
+
+// MigrateKind rewrites all entities of the kind (and shape, if not "") at the current
+// version of their type. It pages through the driver's Query, loading each batch
+// (which runs the migrations) and putting it back.
+//
+// It returns the number of entities rewritten. If batchSize <= 0, MigrationBatchSize is used.
+// Entities put while it runs may be missed, so it is best run again until it returns 0
+// or at a quiet time.
+func MigrateKind(ctx app.Context, kind string, shape string, batchSize int) (n int, err error) {
+	defer errorutil.OnError(&err)
+	if batchSize <= 0 {
+		batchSize = MigrationBatchSize
+	}
+	dr := app.AppDriver(ctx.AppUUID())
+	opts := app.QueryOpts{Shape: shape, Limit: batchSize}
+	for {
+		var keys []app.Key
+		if keys, opts.StartCursor, err = dr.Query(ctx, nil, kind, &opts); err != nil {
+			return
+		}
+		nq := len(keys)
+		if nq == 0 {
+			return
+		}
+		dst := make([]interface{}, len(keys))
+		if err = Gets(ctx, false, keys, dst); err != nil {
+			merr, ok := errorutil.Base(err).(errorutil.Multi)
+			if !ok {
+				return
+			}
+			err = nil
+			keys2, dst2 := keys[:0:0], dst[:0:0]
+			for i := range keys {
+				if merr[i] == nil {
+					keys2, dst2 = append(keys2, keys[i]), append(dst2, dst[i])
+				} else if !IsNotFoundError(merr[i]) {
+					err = merr[i]
+					return
+				}
+			}
+			keys, dst = keys2, dst2
+		}
+		if len(dst) > 0 {
+			if err = Puts(ctx, true, keys, dst); err != nil {
+				return
+			}
+			n += len(dst)
+		}
+		log.Debug(app.CtxCtx(ctx), "MigrateKind: kind: %s, shape: %s, rewritten: %d", kind, shape, n)
+		if opts.StartCursor == "" || nq < batchSize {
+			return
+		}
+	}
+}
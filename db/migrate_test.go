@@ -0,0 +1,112 @@
+package db_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db"
+	"github.com/ugorji/go-serverapp/db/memdb"
+	"github.com/ugorji/go-serverapp/internal/apptest"
+)
+
+type migEntity struct {
+	_struct bool `db:"keyf=Id,kind=MgE,version=2"`
+	Id      int64
+	Name    string `db:"dbname=n"`
+}
+
+// renameProp returns a migration which renames a property.
+func renameProp(from, to string) db.MigrationFunc {
+	return func(props *db.PropertyList) error {
+		for i := range *props {
+			if (*props)[i].Name == from {
+				(*props)[i].Name = to
+			}
+		}
+		return nil
+	}
+}
+
+func TestRegisterMigration(t *testing.T) {
+	fn := renameProp("a", "b")
+	for _, x := range []struct {
+		kind    string
+		version int
+		fn      db.MigrationFunc
+		err     string
+	}{
+		{"", 0, fn, "required"},
+		{"MgR", 0, nil, "required"},
+		{"MgR", -1, fn, "invalid version"},
+		{"MgR", 0, fn, ""},
+		{"MgR", 1, fn, ""},
+		{"MgR", 0, fn, "already registered"},
+	} {
+		err := db.RegisterMigration(x.kind, "", x.version, x.fn)
+		if (x.err == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), x.err)) {
+			t.Errorf("kind: %q, version: %d: expected error: %q, got: %v", x.kind, x.version, x.err, err)
+		}
+	}
+}
+
+func TestOrmVersionIndexesOnly(t *testing.T) {
+	for _, indexesOnly := range []bool{false, true} {
+		var props db.PropertyList
+		if err := db.OrmFromIntf(&migEntity{Id: 1, Name: "x"}, &props, indexesOnly); err != nil {
+			t.Fatal(err)
+		}
+		if v := db.PropsVersion(props); v != 2 {
+			t.Errorf("indexesOnly: %v: expected version: 2, got: %d in: %v", indexesOnly, v, props)
+		}
+	}
+}
+
+func TestMigrateKind(t *testing.T) {
+	if err := db.RegisterMigration("MgE", "", 0, renameProp("name", "n")); err != nil {
+		t.Fatal(err)
+	}
+	d := memdb.New()
+	ctx := apptest.NewContext(t, d)
+	// stored at version 0 (with the old name of the property), and by a newer version of the type
+	var keys []app.Key
+	for i := int64(1); i <= 5; i++ {
+		k, _ := d.NewKey(ctx, "MgE", "", i, nil)
+		keys = append(keys, k)
+	}
+	pl := func(props ...db.Property) interface{} { return db.PropertyList(props) }
+	_, err := d.DatastorePut(ctx, keys, nil, []interface{}{
+		pl(db.Property{Name: "name", Value: "a"}),
+		pl(db.Property{Name: "name", Value: "b"}),
+		pl(db.Property{Name: "name", Value: "c"}),
+		pl(db.Property{Name: "name", Value: "d"}),
+		pl(db.Property{Name: "n", Value: "e"}, db.Property{Name: db.VersionPropName, Value: int64(3), NoIndex: true}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// migrated on load
+	var v migEntity
+	if err = db.Get(ctx, false, keys[0], &v); err != nil || v.Name != "a" {
+		t.Fatalf("Get: expected name: a, got: %q (error: %v)", v.Name, err)
+	}
+	if err = db.Get(ctx, false, keys[4], &v); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("Get of entity stored by a newer version: expected error, got: %v", err)
+	}
+	// it fails at the entity stored by a newer version (in the third batch of 2)
+	if _, err = db.MigrateKind(ctx, "MgE", "", 2); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("MigrateKind: expected error for entity stored by a newer version, got: %v", err)
+	}
+	if err = d.DatastoreDelete(ctx, keys[4:]); err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.MigrateKind(ctx, "MgE", "", 3)
+	if err != nil || n != 4 {
+		t.Fatalf("MigrateKind: expected 4 rewritten, got: %d (error: %v)", n, err)
+	}
+	// the rewritten entities have the new name of the property, which is queryable
+	res, _, err := d.Query(ctx, nil, "MgE", &app.QueryOpts{Order: "n"})
+	if ids := keyIds(res); err != nil || len(ids) != 4 || ids[0] != 1 || ids[3] != 4 {
+		t.Fatalf("Query: expected: [1 2 3 4], got: %v (error: %v)", ids, err)
+	}
+}
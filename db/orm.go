@@ -59,18 +59,37 @@ func HackRegisterSliceType(slcs ...interface{}) error {
 	return nil
 }
 
-//Populate from a struct
+//Populate from a struct.
+//If d is a PropertiesMarshaler (e.g. generated by ormgen), its ToProperties is used in place of reflection.
 func OrmFromIntf(d interface{}, m *PropertyList, indexesOnly bool) (err error) {
 	defer errorutil.OnError(&err)
 	tm, err := GetStructMeta(d)
 	if err != nil {
 		return err
 	}
+	if pm, ok := d.(PropertiesMarshaler); ok {
+		err = pm.ToProperties(m, indexesOnly)
+	} else {
+		err = ormFromIntf(d, m, indexesOnly, tm)
+	}
+	if err != nil {
+		return
+	}
+	//version is kept even if indexesOnly (though it is not indexed),
+	//so drivers which only store indexed properties can still migrate on load.
+	if tm.Version > 0 {
+		*m = append(*m, Property{Name: VersionPropName, Value: int64(tm.Version), NoIndex: true})
+	}
+	return nil
+}
+
+func ormFromIntf(d interface{}, m *PropertyList, indexesOnly bool, tm *TypeMeta) (err error) {
 	dv := reflect.ValueOf(d)
 	if dv.Kind() != reflect.Struct {
 		dv = dv.Elem()
 	}
-	for sfname, fm := range tm.DbFields {
+	for _, sfname := range tm.DbFieldOrder {
+		fm := tm.DbFields[sfname]
 		fv := dv.FieldByName(sfname)
 		var val interface{}
 		switch fm.Type {
@@ -81,7 +100,7 @@ func OrmFromIntf(d interface{}, m *PropertyList, indexesOnly bool) (err error) {
 		case MARSHAL_FTYPE:
 			var val []byte
 			log.Debug(nil, "Calling Encode for: %v", fv)
-			err = Codec.EncodeBytes(&val, fv.Interface())
+			err = EncodeTagged(tm.Codec, &val, fv.Interface())
 			if err != nil {
 				return
 			}
@@ -116,20 +135,33 @@ func OrmFromIntf(d interface{}, m *PropertyList, indexesOnly bool) (err error) {
 	return nil
 }
 
-//Populate to a struct
+//Populate to a struct.
+//The PropertyList is first upgraded to the version of the struct (see RegisterMigration).
+//If d is a PropertiesUnmarshaler (e.g. generated by ormgen), its FromProperties is used in place of reflection.
 func OrmToIntf(m *PropertyList, d interface{}) (err error) {
 	defer errorutil.OnError(&err)
 	tm, err := GetStructMeta(d)
 	if err != nil {
 		return
 	}
+	if err = migrateProps(m, tm); err != nil {
+		return
+	}
+	if pu, ok := d.(PropertiesUnmarshaler); ok {
+		return pu.FromProperties(m)
+	}
+	return ormToIntf(m, d, tm)
+}
+
+func ormToIntf(m *PropertyList, d interface{}, tm *TypeMeta) (err error) {
 	dv := reflect.ValueOf(d)
 	if dv.Kind() != reflect.Struct {
 		dv = dv.Elem()
 	}
 	//dv := reflect.ValueOf(d).Elem()
 	log.Debug(nil, " XYXYXYXYXY: m: %v, %#v", m, dv)
-	for sfname, fm := range tm.DbFields {
+	for _, sfname := range tm.DbFieldOrder {
+		fm := tm.DbFields[sfname]
 		fv := dv.FieldByName(sfname)
 		//var val interface{}
 		//log.Debug(nil, " YYYYY fmType: %v, field: %v ==> %#v, val: %v ==> %#v",
@@ -145,7 +177,7 @@ func OrmToIntf(m *PropertyList, d interface{}) (err error) {
 				if val.Name == fm.DbName {
 					fsrc := val.Value.([]byte)
 					log.Debug(nil, "Calling Decode for: %v", fsrc)
-					err = Codec.DecodeBytes(fsrc, fv)
+					err = DecodeTagged(fsrc, fv.Addr().Interface())
 					if err != nil {
 						return
 					}
@@ -228,7 +260,7 @@ func ormToIntfStruc(m *PropertyList, fr reflect.Value,
 		if err != nil {
 			return err
 		}
-		for j, _ := range tm2.DbFields {
+		for _, j := range tm2.DbFieldOrder {
 			if fst, ok := rt2.FieldByName(j); ok {
 				f2 := fr2.FieldByName(j)
 				if fm2, ok := tm2.DbFields[fst.Name]; ok {
@@ -257,7 +289,8 @@ func ormToIntfStruc(m *PropertyList, fr reflect.Value,
 		allNmFM := make(map[string]*DbFieldMeta)
 		allNms := make([]string, 0, 4)
 		rlen := 0
-		for _, mydbf := range tm4.DbFields {
+		for _, j := range tm4.DbFieldOrder {
+			mydbf := tm4.DbFields[j]
 			mynm0 := fm.DbName + "_" + mydbf.DbName
 			log.Debug(nil, "mydbf.ReflectType: %v, mynm0: %v", mydbf.ReflectType, mynm0)
 			nmslc := reflect.MakeSlice(ormSlices[mydbf.ReflectType], 0, 4)
@@ -319,7 +352,7 @@ func ormFromIntfStruc(m *PropertyList, indexesOnly bool, fr reflect.Value,
 		if err != nil {
 			return err
 		}
-		for j, _ := range tm2.DbFields {
+		for _, j := range tm2.DbFieldOrder {
 			if fst, ok := rt2.FieldByName(j); ok {
 				if fm2, ok := tm2.DbFields[fst.Name]; ok {
 					mynm, myval := fm.DbName+"_"+fm2.DbName, fr2.FieldByName(j).Interface()
@@ -339,7 +372,7 @@ func ormFromIntfStruc(m *PropertyList, indexesOnly bool, fr reflect.Value,
 		if err != nil {
 			return err
 		}
-		for j, _ := range tm4.DbFields {
+		for _, j := range tm4.DbFieldOrder {
 			if fst, ok := rt4.FieldByName(j); ok {
 				if fm2, ok := tm4.DbFields[fst.Name]; ok {
 					log.Debug(nil, "fst.Type: %v, .Name: %v, slice: %v",
@@ -411,36 +444,67 @@ func ormSetValFnp(x interface{}, xt reflect.Value) string {
 	return fmt.Sprintf("set fail. value %v overflows value of type %v", x, xt.Type())
 }
 
+func ormSetValMismatchFnp(val reflect.Value, xt reflect.Value) string {
+	return fmt.Sprintf("set fail. value %v of type %v cannot be set into value of type %v "+
+		"(if the field was retyped, bump the version and register a migration)", val, val.Type(), xt.Type())
+}
+
 //only call this if setting a primitive type (e.g. int, float, etc)
 //This is called during load from datastore
-//(no need to check for real type, since the field will have it appropriately)
-//panics if anything bad occurs (also check overflow)
+//(the stored value may not be of the kind of the field e.g. if it was retyped)
+//panics if anything bad occurs (also check overflow and kind mismatch)
 func ormSetVal(fv reflect.Value, val reflect.Value) {
+	vk := val.Kind()
+	isInt := vk >= reflect.Int && vk <= reflect.Int64
+	isUint := vk >= reflect.Uint && vk <= reflect.Uintptr
 	switch fv.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !isInt {
+			panic(ormSetValMismatchFnp(val, fv))
+		}
 		myval := val.Int()
 		if fv.OverflowInt(myval) {
 			panic(ormSetValFnp(myval, fv))
 		}
 		fv.SetInt(val.Int())
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		myval := val.Uint()
+		var myval uint64
+		switch {
+		case isUint:
+			myval = val.Uint()
+		case isInt: //unsigned values are stored as int64
+			myval = uint64(val.Int())
+		default:
+			panic(ormSetValMismatchFnp(val, fv))
+		}
 		if fv.OverflowUint(myval) {
 			panic(ormSetValFnp(myval, fv))
 		}
 		fv.SetUint(myval)
 	case reflect.Float32, reflect.Float64:
+		if vk != reflect.Float32 && vk != reflect.Float64 {
+			panic(ormSetValMismatchFnp(val, fv))
+		}
 		myval := val.Float()
 		if fv.OverflowFloat(myval) {
 			panic(ormSetValFnp(myval, fv))
 		}
 		fv.SetFloat(myval)
 	case reflect.String:
+		if vk != reflect.String {
+			panic(ormSetValMismatchFnp(val, fv))
+		}
 		fv.SetString(val.String())
 	case reflect.Bool:
+		if vk != reflect.Bool {
+			panic(ormSetValMismatchFnp(val, fv))
+		}
 		fv.SetBool(val.Bool())
 	default:
 		log.Debug(nil, "Unknown entity type in ormSetValue: %v", val)
+		if !val.Type().AssignableTo(fv.Type()) {
+			panic(ormSetValMismatchFnp(val, fv))
+		}
 		fv.Set(val)
 	}
 }
@@ -618,3 +682,25 @@ func fvc(what int, val interface{}, fm *DbFieldMeta, tm *TypeMeta) (b bool) {
 	}
 	return
 }
+
+// CheckFieldValue returns true if a field value should be stored (or indexed),
+// given its FieldValueCheckers, and whether the value is empty (zero, or of zero length).
+//
+// It gives the same results as the checks done by OrmFromIntf, and is used by
+// generated ToProperties methods (see ormgen).
+func CheckFieldValue(empty bool, fvcs ...FieldValueChecker) (b bool) {
+	b = true
+	for i := 0; i < len(fvcs) && b; i++ {
+		switch fvcs[i] {
+		case ALWAYS_FVC:
+			b = true
+		case NOT_ALWAYS_FVC:
+			b = false
+		case EMPTY_FVC:
+			b = empty
+		case NOT_EMPTY_FVC:
+			b = !empty
+		}
+	}
+	return
+}
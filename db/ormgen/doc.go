@@ -0,0 +1,30 @@
+/*
+Ormgen generates ToProperties and FromProperties methods for db entity types,
+so db.OrmFromIntf and db.OrmToIntf can convert them to and from a db.PropertyList
+without reflection.
+
+It reads the db struct tags of the types, as the db package does.
+
+Usage:
+   ormgen [-type T1,T2] [-output file] [directory]
+
+By default, methods are generated for all struct types in the package with a _struct field,
+into props_ormgen.go. Typically, it is run via go generate e.g.
+   //go:generate ormgen -type User,Topic
+
+SUPPORTED FIELDS
+
+Only regular and marshal fields are supported. A regular field must be a bool,
+string, number (or a type declared in the package whose underlying type is one of these),
+or time.Time. Embedded structs must be declared in the package.
+
+Generation fails for a type with other fields (e.g. ftype=struc, expando or tree,
+or a slice, which reflection does not load), in which case the type keeps using reflection.
+
+TESTING
+
+The generated methods must produce the same results as reflection. In the tests of
+the package, call db.CheckPropertiesMarshaler with populated values of each generated type.
+Re-run ormgen whenever the db fields of a type change.
+*/
+package main
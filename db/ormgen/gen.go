@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ugorji/go-serverapp/db"
+)
+
+const dbImportPath = "github.com/ugorji/go-serverapp/db"
+
+// kinds of the values of regular fields
+const (
+	intKind    = "int"
+	uintKind   = "uint"
+	floatKind  = "float"
+	stringKind = "string"
+	boolKind   = "bool"
+	timeKind   = "time"
+)
+
+var builtinKinds = map[string]struct {
+	kind string
+	bits int
+}{
+	"int": {intKind, 0}, "int8": {intKind, 8}, "int16": {intKind, 16}, "int32": {intKind, 32},
+	"int64": {intKind, 64}, "rune": {intKind, 32},
+	"uint": {uintKind, 0}, "uint8": {uintKind, 8}, "uint16": {uintKind, 16}, "uint32": {uintKind, 32},
+	"uint64": {uintKind, 64}, "uintptr": {uintKind, 0}, "byte": {uintKind, 8},
+	"float32": {floatKind, 32}, "float64": {floatKind, 64},
+	"string": {stringKind, 0}, "bool": {boolKind, 0},
+}
+
+// field holds what is needed to generate the code for a db field.
+type field struct {
+	name    string // go field name
+	dbName  string
+	marshal bool
+	kind    string // kind of the value of a regular field
+	bits    int
+	typ     string // go type of the value of a regular field
+	store   []db.FieldValueChecker
+	index   []db.FieldValueChecker
+}
+
+type structInfo struct {
+	name   string
+	codec  string
+	fields []*field
+}
+
+// pkgInfo holds the type declarations of the package being generated for.
+type pkgInfo struct {
+	name  string
+	specs map[string]*ast.TypeSpec
+	files map[string]*ast.File // type name -> file declaring it
+	order []string             // type names in declaration order
+}
+
+func parsePackage(dir string, output string) (p *pkgInfo, err error) {
+	fset := token.NewFileSet()
+	filter := func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != filepath.Base(output)
+	}
+	pkgs, err := parser.ParseDir(fset, dir, filter, parser.ParseComments)
+	if err != nil {
+		return
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("expected 1 package in: %s, found: %d", dir, len(pkgs))
+	}
+	p = &pkgInfo{specs: make(map[string]*ast.TypeSpec), files: make(map[string]*ast.File)}
+	for name, pkg := range pkgs {
+		p.name = name
+		fnames := make([]string, 0, len(pkg.Files))
+		for fname := range pkg.Files {
+			fnames = append(fnames, fname)
+		}
+		sort.Strings(fnames)
+		for _, fname := range fnames {
+			f := pkg.Files[fname]
+			for _, decl := range f.Decls {
+				gd, ok := decl.(*ast.GenDecl)
+				if !ok || gd.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range gd.Specs {
+					ts := spec.(*ast.TypeSpec)
+					p.specs[ts.Name.Name] = ts
+					p.files[ts.Name.Name] = f
+					p.order = append(p.order, ts.Name.Name)
+				}
+			}
+		}
+	}
+	return
+}
+
+// entityTypes returns the struct types with a _struct field, in declaration order.
+func (p *pkgInfo) entityTypes() (names []string) {
+	for _, name := range p.order {
+		if st, ok := p.specs[name].Type.(*ast.StructType); ok && structTag(st) != nil {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// structTag returns the db tag on the _struct field, or nil if none.
+func structTag(st *ast.StructType) []string {
+	for _, f := range st.Fields.List {
+		for _, n := range f.Names {
+			if n.Name == db.StructInfoField {
+				return tagValue(f)
+			}
+		}
+	}
+	return nil
+}
+
+// tagValue returns the db tag of a field split by comma (as the db package does), or nil if none.
+func tagValue(f *ast.Field) []string {
+	if f.Tag == nil {
+		return nil
+	}
+	s, err := strconv.Unquote(f.Tag.Value)
+	if err != nil {
+		return nil
+	}
+	if s = reflect.StructTag(s).Get(db.StructTagKey); s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func (p *pkgInfo) structInfo(name string) (si *structInfo, err error) {
+	ts := p.specs[name]
+	if ts == nil {
+		return nil, fmt.Errorf("type not found: %s", name)
+	}
+	st, ok := ts.Type.(*ast.StructType)
+	if !ok {
+		return nil, fmt.Errorf("type: %s is not a struct", name)
+	}
+	si = &structInfo{name: name}
+	for _, s := range structTag(st) {
+		if strings.HasPrefix(s, "codec=") {
+			si.codec = s[6:]
+		}
+	}
+	if err = p.addFields(si, st, p.files[name]); err != nil {
+		return nil, fmt.Errorf("type: %s: %v", name, err)
+	}
+	return
+}
+
+// addFields adds the db fields of the struct, in the order the db package finds them
+// (embedded structs are expanded in place).
+func (p *pkgInfo) addFields(si *structInfo, st *ast.StructType, file *ast.File) (err error) {
+	for _, f := range st.Fields.List {
+		if len(f.Names) == 0 {
+			ident, ok := f.Type.(*ast.Ident)
+			if !ok {
+				return fmt.Errorf("embedded field: %s: only structs declared in the package are supported",
+					types.ExprString(f.Type))
+			}
+			var est *ast.StructType
+			if ts := p.specs[ident.Name]; ts != nil {
+				est, _ = ts.Type.(*ast.StructType)
+			}
+			if est == nil {
+				return fmt.Errorf("embedded field: %s: only structs declared in the package are supported", ident.Name)
+			}
+			if err = p.addFields(si, est, p.files[ident.Name]); err != nil {
+				return
+			}
+			continue
+		}
+		stv := tagValue(f)
+		if stv == nil {
+			continue
+		}
+		for _, n := range f.Names {
+			if n.Name == db.StructInfoField {
+				continue
+			}
+			var fd *field
+			if fd, err = p.newField(n.Name, stv, f.Type, file); err != nil {
+				return
+			}
+			for _, fd2 := range si.fields {
+				if fd2.dbName == fd.dbName {
+					return fmt.Errorf("field: %s: dbname: %s already used by field: %s", fd.name, fd.dbName, fd2.name)
+				}
+			}
+			si.fields = append(si.fields, fd)
+		}
+	}
+	return
+}
+
+func (p *pkgInfo) newField(name string, stv []string, typ ast.Expr, file *ast.File) (fd *field, err error) {
+	if !ast.IsExported(name) {
+		return nil, fmt.Errorf("field: %s: db fields must be exported", name)
+	}
+	fd = &field{name: name, dbName: name}
+	for _, s := range stv {
+		switch {
+		case strings.HasPrefix(s, "dbname="):
+			fd.dbName = s[7:]
+		case strings.HasPrefix(s, "ftype="):
+			switch s[6:] {
+			case "marshal":
+				fd.marshal = true
+			case "struc", "expando", "tree":
+				return nil, fmt.Errorf("field: %s: %s not supported (only regular and marshal fields are)", name, s)
+			}
+		case strings.HasPrefix(s, "store="):
+			fd.store = appendFVC(s[6:], fd.store)
+		case strings.HasPrefix(s, "index="):
+			fd.index = appendFVC(s[6:], fd.index)
+		}
+	}
+	if fd.dbName == db.VersionPropName {
+		return nil, fmt.Errorf("field: %s: dbname: %s is reserved for the version", name, fd.dbName)
+	}
+	if len(fd.store) == 0 {
+		fd.store = []db.FieldValueChecker{db.NOT_EMPTY_FVC}
+	}
+	if len(fd.index) == 0 {
+		fd.index = []db.FieldValueChecker{db.NOT_EMPTY_FVC}
+	}
+	if fd.marshal {
+		return
+	}
+	if _, ok := typ.(*ast.ArrayType); ok {
+		// reflection does not load slices (see db.OrmToIntf), so they are not supported
+		return nil, fmt.Errorf("field: %s: slices and arrays are not supported", name)
+	}
+	fd.typ = types.ExprString(typ)
+	if fd.kind, fd.bits, err = p.valueKind(typ, file); err != nil {
+		return nil, fmt.Errorf("field: %s: %v", name, err)
+	}
+	if fd.kind == timeKind {
+		fd.typ = "time.Time" // as imported by the generated file
+	}
+	return
+}
+
+// valueKind returns the kind of values of a type: a basic type (or a type declared
+// in the package whose underlying type is basic), or time.Time.
+func (p *pkgInfo) valueKind(typ ast.Expr, file *ast.File) (kind string, bits int, err error) {
+	switch x := typ.(type) {
+	case *ast.Ident:
+		if ts := p.specs[x.Name]; ts != nil {
+			if _, ok := ts.Type.(*ast.Ident); ok {
+				return p.valueKind(ts.Type, p.files[x.Name])
+			}
+		} else if bk, ok := builtinKinds[x.Name]; ok {
+			return bk.kind, bk.bits, nil
+		}
+	case *ast.SelectorExpr:
+		if pkg, ok := x.X.(*ast.Ident); ok && x.Sel.Name == "Time" && importName(file, "time") == pkg.Name {
+			return timeKind, 0, nil
+		}
+	}
+	err = fmt.Errorf("type: %s not supported", types.ExprString(typ))
+	return
+}
+
+// importName returns the name a file refers to an imported package by.
+func importName(file *ast.File, path string) string {
+	for _, is := range file.Imports {
+		if p, _ := strconv.Unquote(is.Path.Value); p == path {
+			if is.Name != nil {
+				return is.Name.Name
+			}
+			return path[strings.LastIndex(path, "/")+1:]
+		}
+	}
+	return ""
+}
+
+// appendFVC parses the value of a store= or index= option, as the db package does.
+func appendFVC(s string, fvca []db.FieldValueChecker) []db.FieldValueChecker {
+	for _, s2 := range strings.Split(s, "|") {
+		switch s2 {
+		case "y":
+			fvca = append(fvca, db.ALWAYS_FVC)
+		case "!y":
+			fvca = append(fvca, db.NOT_ALWAYS_FVC)
+		case "z":
+			fvca = append(fvca, db.EMPTY_FVC)
+		case "!z":
+			fvca = append(fvca, db.NOT_EMPTY_FVC)
+		}
+	}
+	return fvca
+}
+
+// cond returns the expression for whether a value is stored or indexed,
+// given the expressions for whether it is empty or not.
+func cond(fvcs []db.FieldValueChecker, empty, notEmpty string) string {
+	e, n := db.CheckFieldValue(true, fvcs...), db.CheckFieldValue(false, fvcs...)
+	switch {
+	case e && n:
+		return "true"
+	case e:
+		return empty
+	case n:
+		return notEmpty
+	}
+	return "false"
+}
+
+// emptyExprs returns the expressions for whether a value v of the field is empty or not.
+func (fd *field) emptyExprs(v string) (empty, notEmpty string) {
+	switch fd.kind {
+	case stringKind:
+		return v + ` == ""`, v + ` != ""`
+	case boolKind:
+		return "!" + v, v
+	case timeKind:
+		return v + " == (time.Time{})", v + " != (time.Time{})"
+	}
+	return v + " == 0", v + " != 0"
+}
+
+// indexEmptyExprs returns the expressions for whether a value v of the field is empty or not,
+// when checking if it is indexed. As in the db package, a number or bool is first converted
+// to int64, float64 or bool, and is only empty if the field is of that type.
+func (fd *field) indexEmptyExprs(v string) (empty, notEmpty string) {
+	switch fd.kind {
+	case intKind, uintKind, floatKind, boolKind:
+		if fd.valueExpr(v) != v {
+			return "false", "true"
+		}
+	}
+	return fd.emptyExprs(v)
+}
+
+// valueExpr returns the expression for a value v of the field, as stored in a PropertyList.
+func (fd *field) valueExpr(v string) string {
+	var t string
+	switch fd.kind {
+	case intKind, uintKind:
+		t = "int64"
+	case floatKind:
+		t = "float64"
+	case stringKind, boolKind:
+		t = fd.kind
+	default:
+		return v
+	}
+	if fd.typ == t {
+		return v
+	}
+	return t + "(" + v + ")"
+}
+
+// loadCall returns the type returned by the db.PropXXX function for the field, and the call to it.
+func (fd *field) loadCall() (typ string, call string) {
+	switch fd.kind {
+	case intKind:
+		return "int64", fmt.Sprintf("db.PropInt(p.Name, p.Value, %d)", fd.bits)
+	case uintKind:
+		return "uint64", fmt.Sprintf("db.PropUint(p.Name, p.Value, %d)", fd.bits)
+	case floatKind:
+		return "float64", fmt.Sprintf("db.PropFloat(p.Name, p.Value, %d)", fd.bits)
+	case stringKind:
+		return "string", "db.PropString(p.Name, p.Value)"
+	case boolKind:
+		return "bool", "db.PropBool(p.Name, p.Value)"
+	}
+	return "time.Time", "db.PropTime(p.Name, p.Value)"
+}
+
+type generator struct {
+	buf bytes.Buffer
+}
+
+func (g *generator) p(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+	g.buf.WriteByte('\n')
+}
+
+func (g *generator) header(cmdline string, pkg string, sis []*structInfo) {
+	g.p("// Code generated by \"%s\"; DO NOT EDIT.", cmdline)
+	g.p("")
+	g.p("package %s", pkg)
+	g.p("")
+	g.p("import (")
+	for _, si := range sis {
+		if si.usesTime() {
+			g.p("%q", "time")
+			g.p("")
+			break
+		}
+	}
+	g.p("%q", dbImportPath)
+	g.p(")")
+}
+
+func (si *structInfo) usesTime() bool {
+	for _, fd := range si.fields {
+		if !fd.marshal && fd.kind == timeKind {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *generator) toProperties(si *structInfo) {
+	g.p("")
+	g.p("// ToProperties implements db.PropertiesMarshaler.")
+	g.p("func (x *%s) ToProperties(m *db.PropertyList, indexesOnly bool) (err error) {", si.name)
+	for i, fd := range si.fields {
+		fv := "x." + fd.name
+		if fd.marshal {
+			bs := fmt.Sprintf("bs%d", i)
+			g.p("var %s []byte", bs)
+			g.p("if err = db.EncodeTagged(%q, &%s, %s); err != nil {", si.codec, bs, fv)
+			g.p("return")
+			g.p("}")
+			if store := cond(fd.store, "len("+bs+") == 0", "len("+bs+") != 0"); store != "false" {
+				g.p("if %s != nil && %s && !indexesOnly {", bs, store)
+				g.p("*m = append(*m, db.Property{Name: %q, Value: %s, NoIndex: true})", fd.dbName, bs)
+				g.p("}")
+			}
+			continue
+		}
+		empty, notEmpty := fd.emptyExprs(fv)
+		store := cond(fd.store, empty, notEmpty)
+		if store == "false" {
+			continue
+		}
+		if store != "true" {
+			g.p("if %s {", store)
+		}
+		empty, notEmpty = fd.indexEmptyExprs(fv)
+		idx := cond(fd.index, empty, notEmpty)
+		if fd.kind == stringKind && idx != "false" {
+			if idx == "true" {
+				idx = fmt.Sprintf("len(%s) <= 500", fv)
+			} else {
+				idx = fmt.Sprintf("%s && len(%s) <= 500", idx, fv)
+			}
+		}
+		switch idx {
+		case "true":
+			g.p("*m = append(*m, db.Property{Name: %q, Value: %s})", fd.dbName, fd.valueExpr(fv))
+		case "false":
+			g.p("if !indexesOnly {")
+			g.p("*m = append(*m, db.Property{Name: %q, Value: %s, NoIndex: true})", fd.dbName, fd.valueExpr(fv))
+			g.p("}")
+		default:
+			g.p("if idx := %s; !indexesOnly || idx {", idx)
+			g.p("*m = append(*m, db.Property{Name: %q, Value: %s, NoIndex: !idx})", fd.dbName, fd.valueExpr(fv))
+			g.p("}")
+		}
+		if store != "true" {
+			g.p("}")
+		}
+	}
+	g.p("return")
+	g.p("}")
+}
+
+func (g *generator) fromProperties(si *structInfo) {
+	g.p("")
+	g.p("// FromProperties implements db.PropertiesUnmarshaler.")
+	g.p("func (x *%s) FromProperties(m *db.PropertyList) (err error) {", si.name)
+	if len(si.fields) > 0 {
+		g.p("// for each field, the first property found is used")
+		g.p("var done [%d]bool", len(si.fields))
+	}
+	g.p("for i := range *m {")
+	g.p("p := &(*m)[i]")
+	g.p("switch p.Name {")
+	for i, fd := range si.fields {
+		fv := "x." + fd.name
+		g.p("case %q:", fd.dbName)
+		g.p("if done[%d] {", i)
+		g.p("continue")
+		g.p("}")
+		g.p("done[%d] = true", i)
+		if fd.marshal {
+			g.p("var bs []byte")
+			g.p("if bs, err = db.PropBytes(p.Name, p.Value); err != nil {")
+			g.p("return")
+			g.p("}")
+			g.p("if err = db.DecodeTagged(bs, &%s); err != nil {", fv)
+			g.p("return")
+			g.p("}")
+			continue
+		}
+		vtyp, call := fd.loadCall()
+		g.p("var v %s", vtyp)
+		g.p("if v, err = %s; err != nil {", call)
+		g.p("return")
+		g.p("}")
+		v := "v"
+		if fd.typ != vtyp {
+			v = fd.typ + "(v)"
+		}
+		g.p("%s = %s", fv, v)
+	}
+	g.p("}")
+	g.p("}")
+	g.p("return")
+	g.p("}")
+}
+
+// generate returns the formatted source of the ToProperties and FromProperties
+// methods for the structs.
+func generate(cmdline string, p *pkgInfo, sis []*structInfo) ([]byte, error) {
+	g := new(generator)
+	g.header(cmdline, p.name, sis)
+	for _, si := range sis {
+		g.toProperties(si)
+		g.fromProperties(si)
+	}
+	bs, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return g.buf.Bytes(), fmt.Errorf("error formatting generated code: %v", err)
+	}
+	return bs, nil
+}
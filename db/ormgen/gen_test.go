@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestGenerateFixture checks that the generated code of the fixture package is up to date
+// (the fixture tests check that it gives the same results as reflection).
+func TestGenerateFixture(t *testing.T) {
+	dir := filepath.Join("internal", "fixture")
+	outfile := filepath.Join(dir, "props_ormgen.go")
+	p, err := parsePackage(dir, outfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := p.entityTypes()
+	sis := make([]*structInfo, len(names))
+	for i, name := range names {
+		if sis[i], err = p.structInfo(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bs, err := generate("ormgen -type Entity,Note", p, sis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs2, err := ioutil.ReadFile(outfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, bs2) {
+		t.Errorf("%s is out of date: run go generate in %s", outfile, dir)
+	}
+}
+
+func TestSliceNotSupported(t *testing.T) {
+	typ, err := parser.ParseExpr("[]string")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = new(pkgInfo).newField("Tags", []string{"dbname=tg"}, typ, nil); err == nil {
+		t.Errorf("expected error for a slice field, got nil")
+	}
+}
@@ -0,0 +1,48 @@
+// Package fixture holds db entity types with methods generated by ormgen,
+// to test that they give the same results as reflection.
+package fixture
+
+import (
+	"time"
+)
+
+//go:generate go run github.com/ugorji/go-serverapp/db/ormgen -type Entity,Note
+
+// Level is a number type declared in the package.
+type Level int32
+
+// Label is a string type declared in the package.
+type Label string
+
+// Stamps is embedded in Entity.
+type Stamps struct {
+	Created time.Time `db:"dbname=c"`
+	Updated time.Time `db:"dbname=u,index=!y"`
+}
+
+type Entity struct {
+	_struct bool `db:"keyf=Id,kind=FxE,codec=json"`
+	Stamps
+	Id     int64             `db:"dbname=id"`
+	Count  int               `db:"dbname=n,store=y"`
+	Small  int8              `db:"dbname=s"`
+	Size   uint32            `db:"dbname=sz,store=y"`
+	Big    uint64            `db:"dbname=b,store=y,index=z"`
+	Total  int64             `db:"dbname=t,store=y"`
+	Ratio  float32           `db:"dbname=r,store=y"`
+	Score  float64           `db:"dbname=sc,store=y"`
+	Name   string            `db:"dbname=nm"`
+	Notes  string            `db:"dbname=no,index=!y"`
+	Label  Label             `db:"dbname=l,store=y"`
+	Level  Level             `db:"dbname=lv,store=y"`
+	Active bool              `db:"dbname=a,store=y"`
+	Attrs  map[string]string `db:"dbname=at,ftype=marshal"`
+	Temp   string            // not a db field
+}
+
+type Note struct {
+	_struct bool   `db:"keyf=Id,kind=FxN,version=2"`
+	Id      int64  `db:"dbname=id"`
+	Text    string `db:"dbname=x,store=y,index=z"`
+	Done    bool   `db:"dbname=d"`
+}
@@ -0,0 +1,50 @@
+package fixture
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go-serverapp/db"
+)
+
+func TestPropertiesMarshaler(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	for i, d := range []interface{}{
+		&Entity{},
+		&Entity{
+			Stamps: Stamps{Created: now, Updated: now.Add(time.Hour)},
+			Id:     1, Count: -2, Small: 3, Size: 4, Big: 5, Total: 6, Ratio: 0.5, Score: 1.25,
+			Name: "name", Notes: "notes", Label: "label", Level: 7, Active: true,
+			Attrs: map[string]string{"k": "v"}, Temp: "temp",
+		},
+		&Entity{Id: 2, Name: strings.Repeat("x", 501), Label: Label(strings.Repeat("y", 501))},
+		&Note{},
+		&Note{Id: 1, Text: "text", Done: true},
+	} {
+		if err := db.CheckPropertiesMarshaler(d); err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+}
+
+// TestZeroIndexed checks that a zero number is only left out of the indexes
+// if the field is an int64 or float64 (as its value is converted to one of these).
+func TestZeroIndexed(t *testing.T) {
+	var m db.PropertyList
+	if err := db.OrmFromIntf(&Entity{}, &m, true); err != nil {
+		t.Fatal(err)
+	}
+	indexed := make(map[string]bool)
+	for _, p := range m {
+		indexed[p.Name] = !p.NoIndex
+	}
+	for name, b := range map[string]bool{
+		"n": true, "sz": true, "r": true, "lv": true,
+		"t": false, "sc": false, "l": false, "a": false, "b": false,
+	} {
+		if indexed[name] != b {
+			t.Errorf("property: %s: expected indexed: %v, got: %v", name, b, indexed[name])
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Code generated by "ormgen -type Entity,Note"; DO NOT EDIT.
+
+package fixture
+
+import (
+	"time"
+
+	"github.com/ugorji/go-serverapp/db"
+)
+
+// ToProperties implements db.PropertiesMarshaler.
+func (x *Entity) ToProperties(m *db.PropertyList, indexesOnly bool) (err error) {
+	if x.Created != (time.Time{}) {
+		if idx := x.Created != (time.Time{}); !indexesOnly || idx {
+			*m = append(*m, db.Property{Name: "c", Value: x.Created, NoIndex: !idx})
+		}
+	}
+	if x.Updated != (time.Time{}) {
+		if !indexesOnly {
+			*m = append(*m, db.Property{Name: "u", Value: x.Updated, NoIndex: true})
+		}
+	}
+	if x.Id != 0 {
+		if idx := x.Id != 0; !indexesOnly || idx {
+			*m = append(*m, db.Property{Name: "id", Value: x.Id, NoIndex: !idx})
+		}
+	}
+	*m = append(*m, db.Property{Name: "n", Value: int64(x.Count)})
+	if x.Small != 0 {
+		*m = append(*m, db.Property{Name: "s", Value: int64(x.Small)})
+	}
+	*m = append(*m, db.Property{Name: "sz", Value: int64(x.Size)})
+	if !indexesOnly {
+		*m = append(*m, db.Property{Name: "b", Value: int64(x.Big), NoIndex: true})
+	}
+	if idx := x.Total != 0; !indexesOnly || idx {
+		*m = append(*m, db.Property{Name: "t", Value: x.Total, NoIndex: !idx})
+	}
+	*m = append(*m, db.Property{Name: "r", Value: float64(x.Ratio)})
+	if idx := x.Score != 0; !indexesOnly || idx {
+		*m = append(*m, db.Property{Name: "sc", Value: x.Score, NoIndex: !idx})
+	}
+	if x.Name != "" {
+		if idx := x.Name != "" && len(x.Name) <= 500; !indexesOnly || idx {
+			*m = append(*m, db.Property{Name: "nm", Value: x.Name, NoIndex: !idx})
+		}
+	}
+	if x.Notes != "" {
+		if !indexesOnly {
+			*m = append(*m, db.Property{Name: "no", Value: x.Notes, NoIndex: true})
+		}
+	}
+	if idx := x.Label != "" && len(x.Label) <= 500; !indexesOnly || idx {
+		*m = append(*m, db.Property{Name: "l", Value: string(x.Label), NoIndex: !idx})
+	}
+	*m = append(*m, db.Property{Name: "lv", Value: int64(x.Level)})
+	if idx := x.Active; !indexesOnly || idx {
+		*m = append(*m, db.Property{Name: "a", Value: x.Active, NoIndex: !idx})
+	}
+	var bs15 []byte
+	if err = db.EncodeTagged("json", &bs15, x.Attrs); err != nil {
+		return
+	}
+	if bs15 != nil && len(bs15) != 0 && !indexesOnly {
+		*m = append(*m, db.Property{Name: "at", Value: bs15, NoIndex: true})
+	}
+	return
+}
+
+// FromProperties implements db.PropertiesUnmarshaler.
+func (x *Entity) FromProperties(m *db.PropertyList) (err error) {
+	// for each field, the first property found is used
+	var done [16]bool
+	for i := range *m {
+		p := &(*m)[i]
+		switch p.Name {
+		case "c":
+			if done[0] {
+				continue
+			}
+			done[0] = true
+			var v time.Time
+			if v, err = db.PropTime(p.Name, p.Value); err != nil {
+				return
+			}
+			x.Created = v
+		case "u":
+			if done[1] {
+				continue
+			}
+			done[1] = true
+			var v time.Time
+			if v, err = db.PropTime(p.Name, p.Value); err != nil {
+				return
+			}
+			x.Updated = v
+		case "id":
+			if done[2] {
+				continue
+			}
+			done[2] = true
+			var v int64
+			if v, err = db.PropInt(p.Name, p.Value, 64); err != nil {
+				return
+			}
+			x.Id = v
+		case "n":
+			if done[3] {
+				continue
+			}
+			done[3] = true
+			var v int64
+			if v, err = db.PropInt(p.Name, p.Value, 0); err != nil {
+				return
+			}
+			x.Count = int(v)
+		case "s":
+			if done[4] {
+				continue
+			}
+			done[4] = true
+			var v int64
+			if v, err = db.PropInt(p.Name, p.Value, 8); err != nil {
+				return
+			}
+			x.Small = int8(v)
+		case "sz":
+			if done[5] {
+				continue
+			}
+			done[5] = true
+			var v uint64
+			if v, err = db.PropUint(p.Name, p.Value, 32); err != nil {
+				return
+			}
+			x.Size = uint32(v)
+		case "b":
+			if done[6] {
+				continue
+			}
+			done[6] = true
+			var v uint64
+			if v, err = db.PropUint(p.Name, p.Value, 64); err != nil {
+				return
+			}
+			x.Big = v
+		case "t":
+			if done[7] {
+				continue
+			}
+			done[7] = true
+			var v int64
+			if v, err = db.PropInt(p.Name, p.Value, 64); err != nil {
+				return
+			}
+			x.Total = v
+		case "r":
+			if done[8] {
+				continue
+			}
+			done[8] = true
+			var v float64
+			if v, err = db.PropFloat(p.Name, p.Value, 32); err != nil {
+				return
+			}
+			x.Ratio = float32(v)
+		case "sc":
+			if done[9] {
+				continue
+			}
+			done[9] = true
+			var v float64
+			if v, err = db.PropFloat(p.Name, p.Value, 64); err != nil {
+				return
+			}
+			x.Score = v
+		case "nm":
+			if done[10] {
+				continue
+			}
+			done[10] = true
+			var v string
+			if v, err = db.PropString(p.Name, p.Value); err != nil {
+				return
+			}
+			x.Name = v
+		case "no":
+			if done[11] {
+				continue
+			}
+			done[11] = true
+			var v string
+			if v, err = db.PropString(p.Name, p.Value); err != nil {
+				return
+			}
+			x.Notes = v
+		case "l":
+			if done[12] {
+				continue
+			}
+			done[12] = true
+			var v string
+			if v, err = db.PropString(p.Name, p.Value); err != nil {
+				return
+			}
+			x.Label = Label(v)
+		case "lv":
+			if done[13] {
+				continue
+			}
+			done[13] = true
+			var v int64
+			if v, err = db.PropInt(p.Name, p.Value, 32); err != nil {
+				return
+			}
+			x.Level = Level(v)
+		case "a":
+			if done[14] {
+				continue
+			}
+			done[14] = true
+			var v bool
+			if v, err = db.PropBool(p.Name, p.Value); err != nil {
+				return
+			}
+			x.Active = v
+		case "at":
+			if done[15] {
+				continue
+			}
+			done[15] = true
+			var bs []byte
+			if bs, err = db.PropBytes(p.Name, p.Value); err != nil {
+				return
+			}
+			if err = db.DecodeTagged(bs, &x.Attrs); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// ToProperties implements db.PropertiesMarshaler.
+func (x *Note) ToProperties(m *db.PropertyList, indexesOnly bool) (err error) {
+	if x.Id != 0 {
+		if idx := x.Id != 0; !indexesOnly || idx {
+			*m = append(*m, db.Property{Name: "id", Value: x.Id, NoIndex: !idx})
+		}
+	}
+	if idx := x.Text == "" && len(x.Text) <= 500; !indexesOnly || idx {
+		*m = append(*m, db.Property{Name: "x", Value: x.Text, NoIndex: !idx})
+	}
+	if x.Done {
+		if idx := x.Done; !indexesOnly || idx {
+			*m = append(*m, db.Property{Name: "d", Value: x.Done, NoIndex: !idx})
+		}
+	}
+	return
+}
+
+// FromProperties implements db.PropertiesUnmarshaler.
+func (x *Note) FromProperties(m *db.PropertyList) (err error) {
+	// for each field, the first property found is used
+	var done [3]bool
+	for i := range *m {
+		p := &(*m)[i]
+		switch p.Name {
+		case "id":
+			if done[0] {
+				continue
+			}
+			done[0] = true
+			var v int64
+			if v, err = db.PropInt(p.Name, p.Value, 64); err != nil {
+				return
+			}
+			x.Id = v
+		case "x":
+			if done[1] {
+				continue
+			}
+			done[1] = true
+			var v string
+			if v, err = db.PropString(p.Name, p.Value); err != nil {
+				return
+			}
+			x.Text = v
+		case "d":
+			if done[2] {
+				continue
+			}
+			done[2] = true
+			var v bool
+			if v, err = db.PropBool(p.Name, p.Value); err != nil {
+				return
+			}
+			x.Done = v
+		}
+	}
+	return
+}
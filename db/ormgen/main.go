@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	typeNames = flag.String("type", "", "comma-separated list of type names (default: all types with a _struct field)")
+	output    = flag.String("output", "", "output file name (default: <dir>/props_ormgen.go)")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: ormgen [flags] [directory]\n")
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("ormgen: ")
+	flag.Usage = usage
+	flag.Parse()
+	if err := run(flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) (err error) {
+	dir := "."
+	switch len(args) {
+	case 0:
+	case 1:
+		dir = args[0]
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	outfile := *output
+	if outfile == "" {
+		outfile = filepath.Join(dir, "props_ormgen.go")
+	}
+	p, err := parsePackage(dir, outfile)
+	if err != nil {
+		return
+	}
+	var names []string
+	if *typeNames != "" {
+		names = strings.Split(*typeNames, ",")
+	} else if names = p.entityTypes(); len(names) == 0 {
+		return fmt.Errorf("no types with a _struct field found in: %s", dir)
+	}
+	sis := make([]*structInfo, len(names))
+	for i, name := range names {
+		if sis[i], err = p.structInfo(strings.TrimSpace(name)); err != nil {
+			return
+		}
+	}
+	cmdline := "ormgen " + strings.Join(os.Args[1:], " ")
+	bs, err := generate(cmdline, p, sis)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(outfile, bs, 0644)
+}
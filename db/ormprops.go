@@ -0,0 +1,201 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/ugorji/go-common/errorutil"
+)
+
+// PropertiesMarshaler is implemented by a type which converts itself to a PropertyList
+// without reflection. It is typically generated by the ormgen command.
+//
+// OrmFromIntf uses it in place of reflection. It must produce the same PropertyList
+// (see CheckPropertiesMarshaler). The version property is added by OrmFromIntf.
+type PropertiesMarshaler interface {
+	ToProperties(m *PropertyList, indexesOnly bool) error
+}
+
+// PropertiesUnmarshaler is implemented by a type which populates itself from a PropertyList
+// without reflection. It is typically generated by the ormgen command.
+//
+// OrmToIntf uses it in place of reflection, after running any migrations.
+type PropertiesUnmarshaler interface {
+	FromProperties(m *PropertyList) error
+}
+
+// PropTypeError returns the error for a property whose value is not of the type expected.
+func PropTypeError(name string, v interface{}, expected string) error {
+	return fmt.Errorf("set fail. value %v of type %T for property: %s cannot be set into value of type %s "+
+		"(if the field was retyped, bump the version and register a migration)", v, v, name, expected)
+}
+
+func propOverflowError(name string, v interface{}, kind string, bitSize int) error {
+	return fmt.Errorf("set fail. value %v for property: %s overflows value of %s%d", v, name, kind, bitSize)
+}
+
+// PropInt returns the value of a property loaded into a signed integer field of the given
+// bit size (0 means the size of int). It is an error if the value overflows it.
+func PropInt(name string, v interface{}, bitSize int) (i int64, err error) {
+	switch x := v.(type) {
+	case int64:
+		i = x
+	case int:
+		i = int64(x)
+	case int32:
+		i = int64(x)
+	case int16:
+		i = int64(x)
+	case int8:
+		i = int64(x)
+	default:
+		return 0, PropTypeError(name, v, "int")
+	}
+	if bitSize == 0 {
+		bitSize = strconv.IntSize
+	}
+	if bitSize < 64 && (i<<(64-uint(bitSize)))>>(64-uint(bitSize)) != i {
+		err = propOverflowError(name, v, "int", bitSize)
+	}
+	return
+}
+
+// PropUint returns the value of a property loaded into an unsigned integer field of the given
+// bit size (0 means the size of uint). Unsigned values are stored as int64.
+// It is an error if the value overflows it.
+func PropUint(name string, v interface{}, bitSize int) (u uint64, err error) {
+	switch x := v.(type) {
+	case int64:
+		u = uint64(x)
+	case uint64:
+		u = x
+	case int:
+		u = uint64(x)
+	case uint:
+		u = uint64(x)
+	case int32:
+		u = uint64(x)
+	case uint32:
+		u = uint64(x)
+	case int16:
+		u = uint64(x)
+	case uint16:
+		u = uint64(x)
+	case int8:
+		u = uint64(x)
+	case uint8:
+		u = uint64(x)
+	case uintptr:
+		u = uint64(x)
+	default:
+		return 0, PropTypeError(name, v, "uint")
+	}
+	if bitSize == 0 {
+		bitSize = strconv.IntSize
+	}
+	if bitSize < 64 && u >= 1<<uint(bitSize) {
+		err = propOverflowError(name, v, "uint", bitSize)
+	}
+	return
+}
+
+// PropFloat returns the value of a property loaded into a float field of the given bit size.
+// It is an error if the value overflows it.
+func PropFloat(name string, v interface{}, bitSize int) (f float64, err error) {
+	switch x := v.(type) {
+	case float64:
+		f = x
+	case float32:
+		f = float64(x)
+	default:
+		return 0, PropTypeError(name, v, "float")
+	}
+	if bitSize == 32 && math.Abs(f) > math.MaxFloat32 && !math.IsInf(f, 0) {
+		err = propOverflowError(name, v, "float", bitSize)
+	}
+	return
+}
+
+// PropString returns the value of a property loaded into a string field.
+func PropString(name string, v interface{}) (string, error) {
+	if x, ok := v.(string); ok {
+		return x, nil
+	}
+	return "", PropTypeError(name, v, "string")
+}
+
+// PropBool returns the value of a property loaded into a bool field.
+func PropBool(name string, v interface{}) (bool, error) {
+	if x, ok := v.(bool); ok {
+		return x, nil
+	}
+	return false, PropTypeError(name, v, "bool")
+}
+
+// PropTime returns the value of a property loaded into a time.Time field.
+func PropTime(name string, v interface{}) (time.Time, error) {
+	if x, ok := v.(time.Time); ok {
+		return x, nil
+	}
+	return time.Time{}, PropTypeError(name, v, "time.Time")
+}
+
+// PropBytes returns the value of a property loaded into a marshal field.
+func PropBytes(name string, v interface{}) ([]byte, error) {
+	if x, ok := v.([]byte); ok {
+		return x, nil
+	}
+	return nil, PropTypeError(name, v, "[]byte")
+}
+
+// CheckPropertiesMarshaler checks that the PropertiesMarshaler and PropertiesUnmarshaler
+// methods of d (a pointer to a struct) give the same results as reflection.
+//
+// It is meant to be called from the tests of the package which holds the generated code,
+// with a populated value of each generated type.
+func CheckPropertiesMarshaler(d interface{}) (err error) {
+	defer errorutil.OnError(&err)
+	pm, ok := d.(PropertiesMarshaler)
+	if !ok {
+		return fmt.Errorf("CheckPropertiesMarshaler: %T is not a PropertiesMarshaler", d)
+	}
+	if _, ok = d.(PropertiesUnmarshaler); !ok {
+		return fmt.Errorf("CheckPropertiesMarshaler: %T is not a PropertiesUnmarshaler", d)
+	}
+	tm, err := GetStructMeta(d)
+	if err != nil {
+		return
+	}
+	var props PropertyList
+	for _, indexesOnly := range []bool{false, true} {
+		var pl1, pl2 PropertyList
+		if err = pm.ToProperties(&pl1, indexesOnly); err != nil {
+			return
+		}
+		if err = ormFromIntf(d, &pl2, indexesOnly, tm); err != nil {
+			return
+		}
+		if !reflect.DeepEqual(pl1, pl2) {
+			return fmt.Errorf("CheckPropertiesMarshaler: %T: indexesOnly: %v: ToProperties: %v, reflection: %v",
+				d, indexesOnly, pl1, pl2)
+		}
+		if !indexesOnly {
+			props = pl2
+		}
+	}
+	rt := reflect.TypeOf(d).Elem()
+	d1, d2 := reflect.New(rt).Interface(), reflect.New(rt).Interface()
+	if err = d1.(PropertiesUnmarshaler).FromProperties(&props); err != nil {
+		return
+	}
+	if err = ormToIntf(&props, d2, tm); err != nil {
+		return
+	}
+	if !reflect.DeepEqual(d1, d2) {
+		return fmt.Errorf("CheckPropertiesMarshaler: %T: FromProperties: %+v, reflection: %+v", d, d1, d2)
+	}
+	return
+}
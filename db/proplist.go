@@ -0,0 +1,100 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// propJSON is the serialized form of a Property.
+// The type of the value is recorded, so it is decoded back into the same type.
+type propJSON struct {
+	Name     string          `json:"n"`
+	Type     string          `json:"t"`
+	Value    json.RawMessage `json:"v,omitempty"`
+	NoIndex  bool            `json:"x,omitempty"`
+	Multiple bool            `json:"m,omitempty"`
+}
+
+// EncodePropertyList encodes a PropertyList, preserving the types of its values.
+//
+// Supported value types are those which OrmFromIntf puts in a PropertyList
+// i.e. nil, int64, float64, string, bool, time.Time and []byte.
+func EncodePropertyList(l PropertyList) (bs []byte, err error) {
+	pjs := make([]propJSON, len(l))
+	for i, p := range l {
+		pj := &pjs[i]
+		pj.Name, pj.NoIndex, pj.Multiple = p.Name, p.NoIndex, p.Multiple
+		switch p.Value.(type) {
+		case nil:
+			pj.Type = "n"
+			continue
+		case int64:
+			pj.Type = "i"
+		case float64:
+			pj.Type = "f"
+		case string:
+			pj.Type = "s"
+		case bool:
+			pj.Type = "b"
+		case time.Time:
+			pj.Type = "t"
+		case []byte:
+			pj.Type = "y"
+		default:
+			err = fmt.Errorf("EncodePropertyList: Unsupported type: %T for property: %v", p.Value, p.Name)
+			return
+		}
+		if pj.Value, err = json.Marshal(p.Value); err != nil {
+			return
+		}
+	}
+	return json.Marshal(pjs)
+}
+
+// DecodePropertyList decodes a PropertyList encoded by EncodePropertyList.
+func DecodePropertyList(bs []byte) (l PropertyList, err error) {
+	var pjs []propJSON
+	if err = json.Unmarshal(bs, &pjs); err != nil {
+		return
+	}
+	l = make(PropertyList, len(pjs))
+	for i, pj := range pjs {
+		p := &l[i]
+		p.Name, p.NoIndex, p.Multiple = pj.Name, pj.NoIndex, pj.Multiple
+		switch pj.Type {
+		case "n":
+			continue
+		case "i":
+			var v int64
+			err = json.Unmarshal(pj.Value, &v)
+			p.Value = v
+		case "f":
+			var v float64
+			err = json.Unmarshal(pj.Value, &v)
+			p.Value = v
+		case "s":
+			var v string
+			err = json.Unmarshal(pj.Value, &v)
+			p.Value = v
+		case "b":
+			var v bool
+			err = json.Unmarshal(pj.Value, &v)
+			p.Value = v
+		case "t":
+			var v time.Time
+			err = json.Unmarshal(pj.Value, &v)
+			p.Value = v
+		case "y":
+			var v []byte
+			err = json.Unmarshal(pj.Value, &v)
+			p.Value = v
+		default:
+			err = fmt.Errorf("DecodePropertyList: Unsupported type: %s for property: %v", pj.Type, pj.Name)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-serverapp/app"
+)
+
+// Query is a builder for a query against the datastore of an app.
+//
+// Each method returns a new Query, so a Query can be used as the base for others.
+//
+// For example:
+//   var users []*User
+//   cursor, err := db.NewQuery("U").Filter("em", "=", email).Order("-created").Limit(10).GetAll(ctx, &users)
+type Query struct {
+	kind     string
+	parent   app.Key
+	opts     app.QueryOpts
+	filters  []*app.QueryFilter
+	useCache bool
+	err      error
+}
+
+// NewQuery returns a Query for entities of the given kind.
+func NewQuery(kind string) *Query {
+	return &Query{kind: kind, useCache: true}
+}
+
+func (q *Query) clone() *Query {
+	q2 := *q
+	q2.filters = append([]*app.QueryFilter(nil), q.filters...)
+	return &q2
+}
+
+// Ancestor limits the results to entities with the given ancestor.
+func (q *Query) Ancestor(parent app.Key) *Query {
+	q = q.clone()
+	q.parent = parent
+	return q
+}
+
+// Shape limits the results to entities with the given shape.
+func (q *Query) Shape(shape string) *Query {
+	q = q.clone()
+	q.opts.Shape = shape
+	return q
+}
+
+// Filter adds a filter on a datastore property (not the field name).
+// op is one of =, >, >=, < or <=.
+func (q *Query) Filter(name string, op string, value interface{}) *Query {
+	q = q.clone()
+	qop := app.ToQueryFilterOp(op)
+	if qop == 0 && q.err == nil {
+		q.err = fmt.Errorf("Query: invalid op: %s for filter on: %s", op, name)
+	}
+	q.filters = append(q.filters, &app.QueryFilter{Name: name, Op: qop, Value: value})
+	return q
+}
+
+// Order adds to the order of the results. A - prefix denotes descending order
+// e.g. Order("-created").Order("name") or Order("-created,name").
+func (q *Query) Order(order string) *Query {
+	q = q.clone()
+	if q.opts.Order == "" {
+		q.opts.Order = order
+	} else if order != "" {
+		q.opts.Order = q.opts.Order + "," + order
+	}
+	return q
+}
+
+// Limit sets the maximum number of results. A value <= 0 means no limit.
+func (q *Query) Limit(limit int) *Query {
+	q = q.clone()
+	q.opts.Limit = limit
+	return q
+}
+
+// Offset sets the number of results to skip.
+func (q *Query) Offset(offset int) *Query {
+	q = q.clone()
+	q.opts.Offset = offset
+	return q
+}
+
+// Start sets the cursor from which results are returned (e.g. from a previous run).
+func (q *Query) Start(cursor string) *Query {
+	q = q.clone()
+	q.opts.StartCursor = cursor
+	return q
+}
+
+// End sets the cursor up to which results are returned.
+func (q *Query) End(cursor string) *Query {
+	q = q.clone()
+	q.opts.EndCursor = cursor
+	return q
+}
+
+// UseCache sets whether the caches are used (default: true).
+// It is still subject to the driver (see app.LowLevelDriver.UseCache).
+func (q *Query) UseCache(useCache bool) *Query {
+	q = q.clone()
+	q.useCache = useCache
+	return q
+}
+
+func (q *Query) String() string {
+	return QueryAsString(q.parent, q.kind, &q.opts, q.filters...)
+}
+
+// KeysOnly runs the query, and returns the keys of the results,
+// along with the cursor for the end of the results.
+//
+// If caches are used, it goes through QuerySupport, so results are cached
+// in the query cache if the kind is configured for the instance cache.
+func (q *Query) KeysOnly(ctx app.Context) (keys []app.Key, cursor string, err error) {
+	defer errorutil.OnError(&err)
+	if q.err != nil {
+		err = q.err
+		return
+	}
+	dr := app.AppDriver(ctx.AppUUID())
+	opts := q.opts
+	if !dr.UseCache(ctx, q.useCache) {
+		return dr.Query(ctx, q.parent, q.kind, &opts, q.filters...)
+	}
+	var res []app.Key
+	var endCursor string
+	var ran bool
+	nextFn := func() (k app.Key, cur string, err error) {
+		if !ran {
+			ran = true
+			if res, endCursor, err = dr.Query(ctx, q.parent, q.kind, &opts, q.filters...); err != nil {
+				return
+			}
+		}
+		if len(res) == 0 {
+			return nil, endCursor, io.EOF
+		}
+		k, res = res[0], res[1:]
+		return k, endCursor, nil
+	}
+	return QuerySupport(ctx, q.String(), q.kind, opts.Shape, nextFn)
+}
+
+// Count runs the query, and returns the number of results.
+//
+// The drivers have no count path, so it loads the keys of all the results (as KeysOnly
+// does) just to count them. Its cost grows with the number of results; use a Limit to bound it.
+func (q *Query) Count(ctx app.Context) (n int, err error) {
+	keys, _, err := q.KeysOnly(ctx)
+	n = len(keys)
+	return
+}
+
+// GetAll runs the query, and loads the results (using Gets, so caches are used)
+// into dst, which must be a pointer to a slice of struct pointers (e.g. *[]*User)
+// or of interfaces (e.g. *[]interface{}).
+//
+// Results which are not found when loaded (e.g. deleted since the query ran) are skipped.
+// It returns the cursor for the end of the results.
+func (q *Query) GetAll(ctx app.Context, dst interface{}) (cursor string, err error) {
+	defer errorutil.OnError(&err)
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		err = fmt.Errorf("GetAll: dst must be a pointer to a slice; got: %T", dst)
+		return
+	}
+	sv := rv.Elem()
+	et := sv.Type().Elem()
+	isPtr := et.Kind() == reflect.Ptr && et.Elem().Kind() == reflect.Struct
+	if !isPtr && et.Kind() != reflect.Interface {
+		err = fmt.Errorf("GetAll: dst must be a pointer to a slice of struct pointers or interfaces; got: %T", dst)
+		return
+	}
+	keys, cursor, err := q.KeysOnly(ctx)
+	if err != nil {
+		return
+	}
+	if len(keys) == 0 {
+		sv.Set(reflect.MakeSlice(sv.Type(), 0, 0))
+		return
+	}
+	ents := make([]interface{}, len(keys))
+	if isPtr {
+		for i := range ents {
+			ents[i] = reflect.New(et.Elem()).Interface()
+		}
+	}
+	dr := app.AppDriver(ctx.AppUUID())
+	var merr errorutil.Multi
+	if err = Gets(ctx, dr.UseCache(ctx, q.useCache), keys, ents); err != nil {
+		var ok bool
+		if merr, ok = errorutil.Base(err).(errorutil.Multi); !ok {
+			return
+		}
+		err = nil
+	}
+	sv2 := reflect.MakeSlice(sv.Type(), 0, len(ents))
+	for i := range ents {
+		if merr != nil && merr[i] != nil {
+			if !IsNotFoundError(merr[i]) {
+				err = merr[i]
+				return
+			}
+			log.Debug(app.CtxCtx(ctx), "GetAll: skipping result not found: %v", keys[i])
+			continue
+		}
+		ev := reflect.ValueOf(ents[i])
+		if !ev.IsValid() || !ev.Type().AssignableTo(et) {
+			err = fmt.Errorf("GetAll: cannot assign %T to element of %T", ents[i], dst)
+			return
+		}
+		sv2 = reflect.Append(sv2, ev)
+	}
+	sv.Set(sv2)
+	return
+}
@@ -0,0 +1,86 @@
+package sqldb
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db/memdb"
+)
+
+type blobWriter struct {
+	d   *Driver
+	ctx app.Context
+	ct  string
+	buf bytes.Buffer
+}
+
+type blobReader struct {
+	*bytes.Reader
+}
+
+func (w *blobWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+func (w *blobWriter) Finish() (key string, err error) {
+	if key, err = memdb.NewBlobKey(); err != nil {
+		return
+	}
+	_, err = w.d.DB.ExecContext(app.CtxCtx(w.ctx),
+		w.d.bind(`INSERT INTO %s (k, ct, fname, created, size, data) VALUES (?, ?, ?, ?, ?, ?)`, w.d.table("blobs")),
+		key, w.ct, "", time.Now().UTC(), int64(w.buf.Len()), w.buf.Bytes())
+	return
+}
+
+func (r blobReader) Close() error {
+	return nil
+}
+
+func (d *Driver) blob(ctx app.Context, key string, withData bool) (bi *app.BlobInfo, data []byte, err error) {
+	bi = &app.BlobInfo{Key: key}
+	cols := "ct, fname, created, size"
+	dsts := []interface{}{&bi.ContentType, &bi.Filename, &bi.CreationTime, &bi.Size}
+	if withData {
+		cols += ", data"
+		dsts = append(dsts, &data)
+	}
+	err = d.DB.QueryRowContext(app.CtxCtx(ctx), d.bind(`SELECT %s FROM %s WHERE k = ?`, cols, d.table("blobs")),
+		key).Scan(dsts...)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("No Blob found for key: %s", key)
+	}
+	return
+}
+
+func (d *Driver) BlobWriter(ctx app.Context, contentType string) (app.BlobWriter, error) {
+	return &blobWriter{d: d, ctx: ctx, ct: contentType}, nil
+}
+
+func (d *Driver) BlobReader(ctx app.Context, key string) (app.BlobReader, error) {
+	_, data, err := d.blob(ctx, key, true)
+	if err != nil {
+		return nil, err
+	}
+	return blobReader{bytes.NewReader(data)}, nil
+}
+
+func (d *Driver) BlobInfo(ctx app.Context, key string) (*app.BlobInfo, error) {
+	bi, _, err := d.blob(ctx, key, false)
+	if err != nil {
+		return nil, err
+	}
+	return bi, nil
+}
+
+func (d *Driver) BlobServe(ctx app.Context, key string, response http.ResponseWriter) (err error) {
+	bi, data, err := d.blob(ctx, key, true)
+	if err != nil {
+		return
+	}
+	memdb.ServeBlob(response, bi, data)
+	return
+}
@@ -0,0 +1,144 @@
+package sqldb
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ugorji/go-serverapp/db/memdb"
+)
+
+// ColType is the type of a column which holds a property value.
+type ColType int
+
+const (
+	_ ColType = iota
+	IntCol
+	FloatCol
+	StringCol
+	BoolCol
+	TimeCol
+	BytesCol
+)
+
+// Dialect captures the differences between SQL databases.
+type Dialect struct {
+	Name string
+	// Placeholder returns the bind parameter for the n'th (1-based) argument.
+	Placeholder func(n int) string
+	// Types maps a ColType to the sql type used when creating a column.
+	Types map[ColType]string
+}
+
+// SQLite is the dialect for sqlite3.
+var SQLite = &Dialect{
+	Name:        "sqlite3",
+	Placeholder: func(n int) string { return "?" },
+	Types: map[ColType]string{
+		IntCol:    "INTEGER",
+		FloatCol:  "REAL",
+		StringCol: "TEXT",
+		BoolCol:   "BOOLEAN",
+		TimeCol:   "TIMESTAMP",
+		BytesCol:  "BLOB",
+	},
+}
+
+// Postgres is the dialect for postgresql.
+var Postgres = &Dialect{
+	Name:        "postgres",
+	Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	Types: map[ColType]string{
+		IntCol:    "BIGINT",
+		FloatCol:  "DOUBLE PRECISION",
+		StringCol: "TEXT",
+		BoolCol:   "BOOLEAN",
+		TimeCol:   "TIMESTAMP WITH TIME ZONE",
+		BytesCol:  "BYTEA",
+	},
+}
+
+// colTypeOf returns the ColType for a property value (0 if unsupported).
+func colTypeOf(v interface{}) ColType {
+	switch memdb.NormValue(v).(type) {
+	case int64:
+		return IntCol
+	case float64:
+		return FloatCol
+	case string:
+		return StringCol
+	case bool:
+		return BoolCol
+	case time.Time:
+		return TimeCol
+	case []byte:
+		return BytesCol
+	}
+	return 0
+}
+
+// colTypeFromSQL returns the ColType for a sql type name got from the database.
+func (d *Dialect) colTypeFromSQL(s string) ColType {
+	s = strings.ToUpper(s)
+	for t, s2 := range d.Types {
+		if s == s2 {
+			return t
+		}
+	}
+	switch {
+	case strings.Contains(s, "INT"):
+		return IntCol
+	case strings.Contains(s, "REAL"), strings.Contains(s, "DOUBLE"), strings.Contains(s, "FLOAT"):
+		return FloatCol
+	case strings.Contains(s, "BOOL"):
+		return BoolCol
+	case strings.Contains(s, "TIME"), strings.Contains(s, "DATE"):
+		return TimeCol
+	case strings.Contains(s, "BLOB"), strings.Contains(s, "BYTEA"), strings.Contains(s, "BINARY"):
+		return BytesCol
+	}
+	return StringCol
+}
+
+// multiCol returns the column in the multi-valued table which holds values of the type.
+func multiCol(t ColType) string {
+	switch t {
+	case IntCol:
+		return "vi"
+	case FloatCol:
+		return "vf"
+	case BoolCol:
+		return "vb"
+	case TimeCol:
+		return "vt"
+	case BytesCol:
+		return "vy"
+	}
+	return "vs"
+}
+
+// normColValue converts a value scanned from a column into the type of the column,
+// accommodating drivers which return text as []byte or bool as int64.
+func normColValue(t ColType, v interface{}) interface{} {
+	switch x := v.(type) {
+	case []byte:
+		if t == StringCol {
+			return string(x)
+		}
+	case int64:
+		if t == BoolCol {
+			return x != 0
+		}
+	case string:
+		if t == TimeCol {
+			if t2, err := time.Parse(time.RFC3339Nano, x); err == nil {
+				return t2
+			}
+		}
+	}
+	return memdb.NormValue(v)
+}
+
+func quote(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,38 @@
+/*
+Package sqldb provides an implementation of app.LowLevelDriver which persists
+entities and blobs to a relational database through database/sql.
+
+It works with any driver registered with database/sql. The differences between
+databases (placeholders and column types) are captured in a Dialect.
+SQLite and Postgres dialects are provided.
+
+Typical usage:
+   sqlDB, err = sql.Open("sqlite3", "app.db")
+   lld, err = sqldb.New(sqlDB, sqldb.SQLite, "")
+   gapp, err = app.NewApp(false, "1001", "views.json", lld)
+
+TABLES
+
+Each kind is mapped to 2 tables:
+ - e_<kind>: one row per entity.
+   Columns: k (the key), shape, parent, props (the full encoded db.PropertyList),
+   and a typed column p_<name> for each single-valued indexed property.
+ - m_<kind>: one row per value of a multi-valued (Multiple=true) indexed property.
+   Columns: k, name, and one typed column per value type (vi, vf, vs, vb, vt, vy).
+
+Columns are added as new properties are seen (ALTER TABLE ... ADD COLUMN).
+Properties with NoIndex=true are only kept in props, and cannot be queried.
+
+Ids are allocated from the seq table, and blobs are stored in the blobs table.
+
+QUERIES
+
+A kind is required. Filters on single-valued properties are done against their
+columns, while filters on multi-valued properties match if any value matches.
+Order is as in memdb (e.g. "-created,name"), and only single-valued properties
+can be ordered on.
+
+Cursors hold the ordered values and key of the last returned entity, so
+pages are stable even as entities are put or deleted in between.
+*/
+package sqldb
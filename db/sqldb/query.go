@@ -0,0 +1,243 @@
+package sqldb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db/memdb"
+)
+
+// queryBuilder accumulates the sql and arguments of a query.
+type queryBuilder struct {
+	d    *Driver
+	b    strings.Builder
+	args []interface{}
+}
+
+func (q *queryBuilder) w(s ...string) {
+	for _, s2 := range s {
+		q.b.WriteString(s2)
+	}
+}
+
+// arg adds an argument, and returns its placeholder.
+func (q *queryBuilder) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return q.d.Dialect.Placeholder(len(q.args))
+}
+
+// cursorCond writes the condition for rows after the cursor (if after),
+// or rows up to and including the cursor (if !after), given the order of the query.
+func (q *queryBuilder) cursorCond(ords []memdb.OrderBy, c *memdb.Cursor, after bool) {
+	cols := make([]string, 0, len(ords)+1)
+	descs := make([]bool, 0, len(ords)+1)
+	vals := make([]interface{}, 0, len(ords)+1)
+	for i, o := range ords {
+		cols = append(cols, "e."+propCol(o.Name))
+		descs = append(descs, o.Desc)
+		vals = append(vals, c.Vals[i])
+	}
+	cols = append(cols, "e.k")
+	descs = append(descs, false)
+	vals = append(vals, c.Key)
+	q.w(" AND (")
+	for i := range cols {
+		if i > 0 {
+			q.w(" OR ")
+		}
+		q.w("(")
+		for j := 0; j < i; j++ {
+			q.w(cols[j], " = ", q.arg(vals[j]), " AND ")
+		}
+		op := ">"
+		if descs[i] == after {
+			op = "<"
+		}
+		q.w(cols[i], " ", op, " ", q.arg(vals[i]), ")")
+	}
+	if !after {
+		q.w(" OR (")
+		for j := range cols {
+			if j > 0 {
+				q.w(" AND ")
+			}
+			q.w(cols[j], " = ", q.arg(vals[j]))
+		}
+		q.w(")")
+	}
+	q.w(")")
+}
+
+// Query runs the query in sql, and returns the matching keys.
+//
+// Filters on single-valued properties are done against their columns, while filters
+// on multi-valued properties are done against the table which holds their values.
+// Only single-valued properties can be used in the order.
+//
+// Cursors hold the ordered values and key of the last returned row (see memdb.Cursor),
+// so paging is not affected by entities put or deleted in between.
+func (d *Driver) Query(ctx app.Context, parent app.Key, kind string, opts *app.QueryOpts,
+	filters ...*app.QueryFilter,
+) (res []app.Key, endCursor string, err error) {
+	defer errorutil.OnError(&err)
+	if kind == "" {
+		err = fmt.Errorf("Query: kind is required by driver: %s", DriverName)
+		return
+	}
+	if opts == nil {
+		opts = new(app.QueryOpts)
+	}
+	c := app.CtxCtx(ctx)
+	pk, err := memdb.ToKey(parent)
+	if err != nil {
+		return
+	}
+	ks, err := d.schema(c, kind)
+	if err != nil {
+		return
+	}
+	ords := memdb.ParseOrder(opts.Order)
+	q := &queryBuilder{d: d}
+	d.schemaMu.RLock()
+	ok, err := d.buildQuery(q, ks, pk, ords, opts, filters)
+	d.schemaMu.RUnlock()
+	if err != nil {
+		return
+	}
+	endCursor = opts.StartCursor
+	if !ok {
+		// a filter is on a property which no entity of this kind has
+		return
+	}
+	log.Debug(c, "Query: %s, args: %v", q.b.String(), q.args)
+	rows, err := d.DB.QueryContext(c, q.b.String(), q.args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	var last *memdb.Cursor
+	skip := 0
+	if opts.Limit <= 0 {
+		skip = opts.Offset
+	}
+	for rows.Next() {
+		vals := make([]interface{}, len(ords)+1)
+		ptrs := make([]interface{}, len(vals))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		kstr := normColValue(StringCol, vals[0]).(string)
+		var k *memdb.Key
+		if k, err = memdb.ParseKey(kstr); err != nil {
+			return
+		}
+		res = append(res, k)
+		last = &memdb.Cursor{Key: kstr, Vals: make([]interface{}, len(ords))}
+		for i, o := range ords {
+			last.Vals[i] = normColValue(ks.cols[o.Name], vals[i+1])
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if last != nil {
+		endCursor, err = memdb.EncodeCursor(ords, last)
+	}
+	return
+}
+
+// buildQuery writes the sql for the query. It returns false if no entity can match.
+// It must be called with the schemaMu held.
+func (d *Driver) buildQuery(q *queryBuilder, ks *kindSchema, pk *memdb.Key,
+	ords []memdb.OrderBy, opts *app.QueryOpts, filters []*app.QueryFilter,
+) (ok bool, err error) {
+	q.w("SELECT e.k")
+	for _, o := range ords {
+		if _, ok2 := ks.cols[o.Name]; !ok2 {
+			if ks.multi[o.Name] {
+				err = fmt.Errorf("Query: cannot order by multi-valued property: %s", o.Name)
+				return
+			}
+			return
+		}
+		q.w(", e.", propCol(o.Name))
+	}
+	q.w(" FROM ", d.table("e_"+ks.kind), " e WHERE 1 = 1")
+	if opts.Shape != "" {
+		q.w(" AND e.shape = ", q.arg(opts.Shape))
+	}
+	if pk != nil {
+		r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+		q.w(" AND e.k LIKE ", q.arg(r.Replace(pk.String())+"/%"), ` ESCAPE '\'`)
+	}
+	for _, f := range filters {
+		op := f.Op.String()
+		if op == "" {
+			err = fmt.Errorf("Query: invalid op: %v for filter on: %s", f.Op, f.Name)
+			return
+		}
+		v := memdb.NormValue(f.Value)
+		t := colTypeOf(v)
+		if t == 0 {
+			err = fmt.Errorf("Query: unsupported type: %T for filter on: %s", f.Value, f.Name)
+			return
+		}
+		_, isCol := ks.cols[f.Name]
+		isMulti := ks.multi[f.Name]
+		if !isCol && !isMulti {
+			return
+		}
+		q.w(" AND (")
+		if isCol {
+			q.w("e.", propCol(f.Name), " ", op, " ", q.arg(v))
+		}
+		if isCol && isMulti {
+			q.w(" OR ")
+		}
+		if isMulti {
+			q.w("EXISTS (SELECT 1 FROM ", d.table("m_"+ks.kind), " m WHERE m.k = e.k AND m.name = ",
+				q.arg(f.Name), " AND m.", multiCol(t), " ", op, " ", q.arg(v), ")")
+		}
+		q.w(")")
+	}
+	for _, o := range ords {
+		q.w(" AND e.", propCol(o.Name), " IS NOT NULL")
+	}
+	if opts.StartCursor != "" {
+		var c *memdb.Cursor
+		if c, err = memdb.DecodeCursor(ords, opts.StartCursor); err != nil {
+			return
+		}
+		q.cursorCond(ords, c, true)
+	}
+	if opts.EndCursor != "" {
+		var c *memdb.Cursor
+		if c, err = memdb.DecodeCursor(ords, opts.EndCursor); err != nil {
+			return
+		}
+		q.cursorCond(ords, c, false)
+	}
+	q.w(" ORDER BY ")
+	for _, o := range ords {
+		q.w("e.", propCol(o.Name))
+		if o.Desc {
+			q.w(" DESC")
+		}
+		q.w(", ")
+	}
+	q.w("e.k")
+	if opts.Limit > 0 {
+		q.w(" LIMIT ", q.arg(opts.Limit), " OFFSET ", q.arg(opts.Offset))
+	}
+	ok = true
+	return
+}
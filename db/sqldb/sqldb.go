@@ -0,0 +1,434 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-common/logging"
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db"
+	"github.com/ugorji/go-serverapp/db/memdb"
+)
+
+var log = logging.PkgLogger()
+
+const DriverName = "sqldb"
+
+const idSeqName = "ids"
+
+var _ app.LowLevelDriver = (*Driver)(nil)
+
+// Driver implements app.LowLevelDriver, persisting entities and blobs
+// to a relational database through database/sql.
+type Driver struct {
+	memdb.Base
+	DB          *sql.DB
+	Dialect     *Dialect
+	TablePrefix string
+
+	schemaMu sync.RWMutex
+	kinds    map[string]*kindSchema
+}
+
+// kindSchema holds what we know about the tables for a kind.
+type kindSchema struct {
+	kind  string
+	cols  map[string]ColType // property name to type of its (single-valued) column
+	multi map[string]bool    // names of multi-valued properties
+}
+
+// New returns a Driver which uses the given sql.DB.
+// It creates the tables for id allocation and blobs if they do not exist.
+func New(sqldb *sql.DB, dialect *Dialect, tablePrefix string) (d *Driver, err error) {
+	defer errorutil.OnError(&err)
+	if dialect == nil {
+		dialect = SQLite
+	}
+	d = &Driver{
+		Base:        memdb.NewBase(),
+		DB:          sqldb,
+		Dialect:     dialect,
+		TablePrefix: tablePrefix,
+		kinds:       make(map[string]*kindSchema),
+	}
+	ty := dialect.Types
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (name %s PRIMARY KEY, n %s NOT NULL)`,
+			d.table("seq"), ty[StringCol], ty[IntCol]),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (k %s PRIMARY KEY, ct %s, fname %s, created %s, size %s, data %s)`,
+			d.table("blobs"), ty[StringCol], ty[StringCol], ty[StringCol], ty[TimeCol], ty[IntCol], ty[BytesCol]),
+	}
+	for _, s := range stmts {
+		if _, err = sqldb.Exec(s); err != nil {
+			return
+		}
+	}
+	var n int64
+	err = sqldb.QueryRow(d.bind(`SELECT COUNT(*) FROM %s WHERE name = ?`, d.table("seq")), idSeqName).Scan(&n)
+	if err == nil && n == 0 {
+		_, err = sqldb.Exec(d.bind(`INSERT INTO %s (name, n) VALUES (?, ?)`, d.table("seq")), idSeqName, 0)
+	}
+	return
+}
+
+func (d *Driver) DriverName() string {
+	return DriverName
+}
+
+// table returns the quoted name of a table.
+func (d *Driver) table(name string) string {
+	return quote(d.TablePrefix + name)
+}
+
+// bind replaces each ? in the format with the dialect's placeholder, and then formats it.
+// Placeholders are replaced first, so that a ? within a quoted name is left alone.
+func (d *Driver) bind(format string, params ...interface{}) string {
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] == '?' {
+			n++
+			b.WriteString(d.Dialect.Placeholder(n))
+		} else {
+			b.WriteByte(format[i])
+		}
+	}
+	return fmt.Sprintf(b.String(), params...)
+}
+
+func propCol(name string) string {
+	return quote("p_" + name)
+}
+
+func (d *Driver) NewKey(ctx app.Context, kind string, shape string, intId int64, pkey app.Key) (key app.Key, err error) {
+	defer errorutil.OnError(&err)
+	k, err := memdb.NewIncompleteKey(kind, shape, intId, pkey)
+	if err != nil {
+		return
+	}
+	if intId < 0 {
+		if k.IntId, err = d.AllocateIds(ctx, 1); err != nil {
+			return
+		}
+	}
+	return k, nil
+}
+
+// AllocateIds reserves n ids (unique across all kinds), and returns the first one.
+func (d *Driver) AllocateIds(ctx app.Context, n int) (first int64, err error) {
+	defer errorutil.OnError(&err)
+	c := app.CtxCtx(ctx)
+	tx, err := d.DB.BeginTx(c, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	seqt := d.table("seq")
+	// update first, so the write lock is got before the read
+	if _, err = tx.ExecContext(c, d.bind(`UPDATE %s SET n = n + ? WHERE name = ?`, seqt), n, idSeqName); err != nil {
+		return
+	}
+	var last int64
+	if err = tx.QueryRowContext(c, d.bind(`SELECT n FROM %s WHERE name = ?`, seqt), idSeqName).Scan(&last); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	first = last - int64(n) + 1
+	return
+}
+
+// schema returns the kindSchema for the kind, creating its tables if they do not exist.
+func (d *Driver) schema(c context.Context, kind string) (ks *kindSchema, err error) {
+	d.schemaMu.RLock()
+	ks = d.kinds[kind]
+	d.schemaMu.RUnlock()
+	if ks != nil {
+		return
+	}
+	d.schemaMu.Lock()
+	defer d.schemaMu.Unlock()
+	if ks = d.kinds[kind]; ks != nil {
+		return
+	}
+	ty := d.Dialect.Types
+	et, mt := d.table("e_"+kind), d.table("m_"+kind)
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (k %s PRIMARY KEY, shape %s, parent %s, props %s)`,
+			et, ty[StringCol], ty[StringCol], ty[StringCol], ty[BytesCol]),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (k %s NOT NULL, name %s NOT NULL, `+
+			`vi %s, vf %s, vs %s, vb %s, vt %s, vy %s)`,
+			mt, ty[StringCol], ty[StringCol],
+			ty[IntCol], ty[FloatCol], ty[StringCol], ty[BoolCol], ty[TimeCol], ty[BytesCol]),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s (k)`, d.table("mk_"+kind), mt),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s (name, vi, vs)`, d.table("mv_"+kind), mt),
+	}
+	for _, s := range stmts {
+		if _, err = d.DB.ExecContext(c, s); err != nil {
+			return
+		}
+	}
+	ks = &kindSchema{kind: kind, cols: make(map[string]ColType), multi: make(map[string]bool)}
+	rows, err := d.DB.QueryContext(c, fmt.Sprintf(`SELECT * FROM %s WHERE 1 = 0`, et))
+	if err != nil {
+		return
+	}
+	cts, err := rows.ColumnTypes()
+	rows.Close()
+	if err != nil {
+		return
+	}
+	for _, ct := range cts {
+		if strings.HasPrefix(ct.Name(), "p_") {
+			ks.cols[ct.Name()[2:]] = d.Dialect.colTypeFromSQL(ct.DatabaseTypeName())
+		}
+	}
+	if rows, err = d.DB.QueryContext(c, fmt.Sprintf(`SELECT DISTINCT name FROM %s`, mt)); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return
+		}
+		ks.multi[s] = true
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	d.kinds[kind] = ks
+	return
+}
+
+// ensureCols adds columns for the single-valued indexed properties which do not have one yet.
+func (d *Driver) ensureCols(c context.Context, ks *kindSchema, props db.PropertyList) (err error) {
+	d.schemaMu.Lock()
+	defer d.schemaMu.Unlock()
+	for _, p := range props {
+		if p.NoIndex || p.Value == nil {
+			continue
+		}
+		if p.Multiple {
+			ks.multi[p.Name] = true
+			continue
+		}
+		if _, ok := ks.cols[p.Name]; ok {
+			continue
+		}
+		t := colTypeOf(p.Value)
+		if t == 0 {
+			return fmt.Errorf("Unsupported type: %T for property: %v", p.Value, p.Name)
+		}
+		_, err = d.DB.ExecContext(c, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`,
+			d.table("e_"+ks.kind), propCol(p.Name), d.Dialect.Types[t]))
+		if err != nil {
+			return
+		}
+		ks.cols[p.Name] = t
+	}
+	return
+}
+
+func (d *Driver) DatastoreGet(ctx app.Context, keys []app.Key, dst []interface{}) (err error) {
+	defer errorutil.OnError(&err)
+	c := app.CtxCtx(ctx)
+	merr := make(errorutil.Multi, len(keys))
+	var hasMiss bool
+	for i := range keys {
+		var k *memdb.Key
+		if k, err = memdb.ToKey(keys[i]); err != nil {
+			return
+		}
+		if _, err = d.schema(c, k.Kind); err != nil {
+			return
+		}
+		var bs []byte
+		err = d.DB.QueryRowContext(c, d.bind(`SELECT props FROM %s WHERE k = ?`, d.table("e_"+k.Kind)),
+			k.String()).Scan(&bs)
+		if err == sql.ErrNoRows {
+			err = nil
+			merr[i] = db.EntityNotFoundError(fmt.Sprintf("<Not_Found_In_Datastore> Key: %v", k))
+			hasMiss = true
+			continue
+		}
+		if err != nil {
+			return
+		}
+		var props db.PropertyList
+		if props, err = db.DecodePropertyList(bs); err != nil {
+			return
+		}
+		if err = db.OrmToIntf(&props, dst[i]); err != nil {
+			return
+		}
+	}
+	if hasMiss {
+		err = merr
+	}
+	return
+}
+
+func (d *Driver) DatastorePut(ctx app.Context, keys []app.Key, dst []interface{}, dprops []interface{},
+) (keys2 []app.Key, err error) {
+	defer errorutil.OnError(&err)
+	if len(keys) != len(dprops) {
+		err = fmt.Errorf("DatastorePut: lengths mismatch; keys: %v, props: %v", len(keys), len(dprops))
+		return
+	}
+	c := app.CtxCtx(ctx)
+	ks := make([]*memdb.Key, len(keys))
+	props := make([]db.PropertyList, len(keys))
+	schemas := make([]*kindSchema, len(keys))
+	var numIncomplete int
+	var maxId int64
+	for i := range keys {
+		if ks[i], err = memdb.ToKey(keys[i]); err != nil {
+			return
+		}
+		if props[i], err = memdb.ToPropertyList(dprops[i]); err != nil {
+			return
+		}
+		if ks[i].Incomplete() {
+			numIncomplete++
+		} else if ks[i].IntId > maxId {
+			maxId = ks[i].IntId
+		}
+		// DDL is done outside the transaction which writes the entities
+		if schemas[i], err = d.schema(c, ks[i].Kind); err != nil {
+			return
+		}
+		if err = d.ensureCols(c, schemas[i], props[i]); err != nil {
+			return
+		}
+	}
+	if numIncomplete > 0 {
+		var id int64
+		if id, err = d.AllocateIds(ctx, numIncomplete); err != nil {
+			return
+		}
+		for i, k := range ks {
+			if k.Incomplete() {
+				k2 := *k
+				k2.IntId = id
+				ks[i] = &k2
+				id++
+			}
+		}
+	}
+	tx, err := d.DB.BeginTx(c, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	for i, k := range ks {
+		if err = d.putTx(c, tx, schemas[i], k, props[i]); err != nil {
+			return
+		}
+	}
+	if maxId > 0 {
+		_, err = tx.ExecContext(c, d.bind(`UPDATE %s SET n = ? WHERE name = ? AND n < ?`, d.table("seq")),
+			maxId, idSeqName, maxId)
+		if err != nil {
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	keys2 = make([]app.Key, len(ks))
+	for i, k := range ks {
+		keys2[i] = k
+	}
+	log.Debug(c, "DatastorePut: keys: %v", keys2)
+	return
+}
+
+func (d *Driver) putTx(c context.Context, tx *sql.Tx, ks *kindSchema, k *memdb.Key, props db.PropertyList) (err error) {
+	bs, err := db.EncodePropertyList(props)
+	if err != nil {
+		return
+	}
+	et, mt := d.table("e_"+k.Kind), d.table("m_"+k.Kind)
+	kstr := k.String()
+	if _, err = tx.ExecContext(c, d.bind(`DELETE FROM %s WHERE k = ?`, et), kstr); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(c, d.bind(`DELETE FROM %s WHERE k = ?`, mt), kstr); err != nil {
+		return
+	}
+	cols := []string{"k", "shape", "parent", "props"}
+	args := []interface{}{kstr, k.Shape, k.Parent.String(), bs}
+	seen := make(map[string]bool)
+	for _, p := range props {
+		if p.NoIndex || p.Value == nil {
+			continue
+		}
+		if p.Multiple {
+			t := colTypeOf(p.Value)
+			if t == 0 {
+				return fmt.Errorf("Unsupported type: %T for property: %v", p.Value, p.Name)
+			}
+			_, err = tx.ExecContext(c, d.bind(`INSERT INTO %s (k, name, %s) VALUES (?, ?, ?)`, mt, multiCol(t)),
+				kstr, p.Name, memdb.NormValue(p.Value))
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if seen[p.Name] {
+			continue
+		}
+		seen[p.Name] = true
+		cols = append(cols, propCol(p.Name))
+		args = append(args, memdb.NormValue(p.Value))
+	}
+	qs := strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ")
+	_, err = tx.ExecContext(c, d.bind(`INSERT INTO %s (%s) VALUES (`+qs+`)`, et, strings.Join(cols, ", ")), args...)
+	return
+}
+
+func (d *Driver) DatastoreDelete(ctx app.Context, keys []app.Key) (err error) {
+	defer errorutil.OnError(&err)
+	c := app.CtxCtx(ctx)
+	ks := make([]*memdb.Key, len(keys))
+	for i := range keys {
+		if ks[i], err = memdb.ToKey(keys[i]); err != nil {
+			return
+		}
+		if _, err = d.schema(c, ks[i].Kind); err != nil {
+			return
+		}
+	}
+	tx, err := d.DB.BeginTx(c, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	for _, k := range ks {
+		for _, t := range []string{"e_", "m_"} {
+			if _, err = tx.ExecContext(c, d.bind(`DELETE FROM %s WHERE k = ?`, d.table(t+k.Kind)), k.String()); err != nil {
+				return
+			}
+		}
+	}
+	err = tx.Commit()
+	return
+}
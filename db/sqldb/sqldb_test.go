@@ -0,0 +1,95 @@
+package sqldb
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/ugorji/go-serverapp/app"
+	"github.com/ugorji/go-serverapp/db"
+	"github.com/ugorji/go-serverapp/internal/apptest"
+)
+
+type sqlEntity struct {
+	_struct bool `db:"keyf=Id,kind=SqE"`
+	Id      int64
+	Name    string `db:"dbname=n"`
+	Rank    int64  `db:"dbname=r"`
+}
+
+// newTestApp creates an app backed by a sqldb Driver on a new SQLite database
+// (in a temp dir), and returns a context for it.
+// It skips the test if SQLite is not usable (e.g. built without cgo).
+func newTestApp(t *testing.T) (d *Driver, ctx app.Context) {
+	sqlDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	if err = sqlDB.Ping(); err != nil {
+		t.Skipf("SQLite not usable: %v", err)
+	}
+	if d, err = New(sqlDB, SQLite, "t_"); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return d, apptest.NewContext(t, d)
+}
+
+func TestRoundTrip(t *testing.T) {
+	d, ctx := newTestApp(t)
+	names := []string{"a", "b", "c", "d", "e"}
+	keys := make([]app.Key, len(names))
+	for i, s := range names {
+		k, err := d.NewKey(ctx, "SqE", "", int64(i+1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = k
+		if err = db.Put(ctx, false, k, &sqlEntity{Id: int64(i + 1), Name: s, Rank: int64(i % 3)}); err != nil {
+			t.Fatalf("Put: %s: %v", s, err)
+		}
+	}
+
+	var v sqlEntity
+	if err := db.Get(ctx, false, keys[1], &v); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if v.Id != 2 || v.Name != "b" || v.Rank != 1 {
+		t.Fatalf("Get: expected: {2 b 1}, got: %+v", v)
+	}
+
+	// rank is 0, 1, 2, 0, 1: so r >= 1 matches b, e (rank 1) and c (rank 2)
+	res, _, err := d.Query(ctx, nil, "SqE", &app.QueryOpts{Order: "-r,n"},
+		&app.QueryFilter{Name: "r", Op: app.GTE, Value: int64(1)})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if expected := []app.Key{keys[2], keys[1], keys[4]}; !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Query: expected: %v, got: %v", expected, res)
+	}
+
+	// page through all, 2 at a time, putting an entity in between pages
+	var all []app.Key
+	opts := &app.QueryOpts{Order: "n", Limit: 2}
+	for i := 0; ; i++ {
+		res, cursor, err := d.Query(ctx, nil, "SqE", opts)
+		if err != nil {
+			t.Fatalf("Query: page %d: %v", i, err)
+		}
+		if len(res) == 0 {
+			break
+		}
+		all = append(all, res...)
+		if i == 0 {
+			if err = db.Put(ctx, false, keys[0], &sqlEntity{Id: 1, Name: "a", Rank: 9}); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		opts.StartCursor = cursor
+	}
+	if !reflect.DeepEqual(all, keys) {
+		t.Fatalf("Query with cursor: expected: %v, got: %v", keys, all)
+	}
+}
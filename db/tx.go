@@ -0,0 +1,73 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/ugorji/go-common/errorutil"
+	"github.com/ugorji/go-serverapp/app"
+)
+
+// TxAttempts is the number of times RunInTransaction will try to run a transaction,
+// if it fails to commit because of a conflict.
+var TxAttempts = 3
+
+// RunInTransaction runs fn within a transaction, using the app.TransactionalDriver
+// of the app. All calls within fn must use the tctx passed to it.
+//
+// Within the transaction, Gets bypass the caches, and the cache entries of entities
+// put or deleted are only removed after the transaction commits.
+//
+// If the transaction fails to commit because of a conflict, it is retried
+// (up to TxAttempts times). Consequently, fn must be safe to run more than once.
+func RunInTransaction(ctx app.Context, fn func(tctx app.Context) error) (err error) {
+	defer errorutil.OnError(&err)
+	if InTransaction(ctx) {
+		err = fmt.Errorf("RunInTransaction: nested transactions are not supported")
+		return
+	}
+	dr := app.AppDriver(ctx.AppUUID())
+	// The driver of a BaseApp is always transactional (and fails if its LowLevelDriver is not).
+	// This check is for custom app.Drivers.
+	tdr, ok := dr.(app.TransactionalDriver)
+	if !ok {
+		err = fmt.Errorf("RunInTransaction: transactions not supported by driver: %s", dr.DriverName())
+		return
+	}
+	for i := 1; ; i++ {
+		var keys []app.Key
+		err = tdr.RunInTransaction(ctx, func(tctx *app.TxContext) (err error) {
+			err = fn(tctx)
+			keys = tctx.Keys
+			return
+		})
+		if err == nil {
+			if len(keys) > 0 {
+				err = invalidate(ctx, keys...)
+			}
+			return
+		}
+		if !app.IsTxConflict(err) || i >= TxAttempts {
+			return
+		}
+		log.Debug(app.CtxCtx(ctx), "RunInTransaction: retrying after attempt: %d failed: %v", i, err)
+	}
+}
+
+// InTransaction returns true if ctx is within a transaction.
+func InTransaction(ctx app.Context) bool {
+	return app.TxFrom(ctx) != nil
+}
+
+// invalidate removes the cache entries for the keys, and makes the cached
+// queries for their kinds stale.
+// Within a transaction, this is only done after it commits.
+func invalidate(ctx app.Context, keys ...app.Key) (err error) {
+	if tctx := app.TxFrom(ctx); tctx != nil {
+		tctx.Keys = append(tctx.Keys, keys...)
+		return
+	}
+	if err = CacheDelete(ctx, keys...); err != nil {
+		return
+	}
+	return bumpQueryGens(ctx, keys...)
+}
@@ -1,3 +1,8 @@
 module github.com/ugorji/go-serverapp
 
 go 1.21
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/ugorji/go/codec v1.3.2
+)
@@ -0,0 +1,50 @@
+// Package apptest holds helpers for the tests of the app and db packages (and drivers).
+package apptest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ugorji/go-serverapp/app"
+)
+
+var appSeq uint64
+
+// NewApp creates an app backed by the driver, via app.NewAppIn,
+// with a minimal views.json and template in a temp dir.
+// Each app gets its own UUID, so a test can create many.
+func NewApp(t testing.TB, lld app.LowLevelDriver) (gapp *app.BaseApp) {
+	dir := t.TempDir()
+	for _, s := range []string{"resources", "templates"} {
+		if err := os.Mkdir(filepath.Join(dir, s), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for s, v := range map[string]string{
+		"resources/views.json": `{"Name": "Root"}`,
+		"templates/Root.thtml": `{{.Message}}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, s), []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gapp, err := app.NewAppIn(false, fmt.Sprintf("apptest-%s-%d", t.Name(), atomic.AddUint64(&appSeq, 1)), dir, "views.json", lld)
+	if err != nil {
+		t.Fatalf("NewAppIn: %v", err)
+	}
+	return
+}
+
+// NewContext creates an app backed by the driver (see NewApp),
+// and returns a new context for it.
+func NewContext(t testing.TB, lld app.LowLevelDriver) (ctx app.Context) {
+	gapp := NewApp(t, lld)
+	ctx, err := gapp.AppDriver.NewContext(nil, gapp.UUID, 1)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	return
+}
@@ -5,6 +5,11 @@ It adds clean seamless and easy to use support for:
 
   - access logging
   - pipelines
+  - metrics
+  - rate limiting
+  - adaptive load shedding
+  - graceful shutdown and restart
+  - request timeouts
   - template management
   - shared storage
   - ...
@@ -0,0 +1,195 @@
+/*
+ADAPTIVE LOAD SHEDDING
+
+By default, a Listener pauses accepting connections when the requests in flight reach
+a fixed max, and resumes when they fall below 95% of it. Meanwhile, new connections
+wait in the accept queue, so clients see stalls instead of errors.
+
+In adaptive mode (see Listener.SetAdaptive), the Listener limits the requests in flight
+to a limit which it adjusts from their latency, in the style of a gradient limiter:
+  - every Window, it computes the p99 latency of the requests completed in it
+  - the queueing delay is seen as the growth of the p99 latency over its baseline
+    (its lowest value across recent windows)
+  - if the p99 latency is within Tolerance times the baseline, the limit grows
+    by its square root (if it was used), else it shrinks in proportion (at most halved)
+  - the limit is kept within MinLimit and MaxLimit
+
+Requests over the limit are shed at once with a 503 (Service Unavailable) and a
+Retry-After header, and the Listener does not pause accepting connections
+(except via HardPause).
+
+The current limits and latencies are returned by Listener.Limits, and exported
+by MetricsPipe.AddListener.
+
+Typical usage:
+   lis = web.NewListener(l, 1000, web.OnPanicRecover)
+   lis.SetAdaptive(&web.AdaptiveConfig{MinLimit: 10})
+*/
+package web
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxAdaptiveSamples is the max number of latencies kept per window (via reservoir sampling).
+const maxAdaptiveSamples = 1024
+
+// adaptiveBaselineWindows is the number of windows after which the baseline latency is reset,
+// so it follows changes in the workload.
+const adaptiveBaselineWindows = 60
+
+// AdaptiveConfig configures the adaptive mode of a Listener.
+type AdaptiveConfig struct {
+	MinLimit   int32         // if 0, 1
+	MaxLimit   int32         // if 0, the max number of connections of the Listener
+	InitLimit  int32         // if 0, half way between MinLimit and MaxLimit
+	Window     time.Duration // if 0, 1 second
+	MinSamples int           // min requests in a window to adjust the limit (if 0, 10)
+	Tolerance  float64       // growth of the p99 latency over the baseline tolerated (if 0, 2)
+	RetryAfter time.Duration // sent to shed requests (if 0, 1 second)
+}
+
+// ListenerLimits is a snapshot of the limits of a Listener.
+type ListenerLimits struct {
+	MaxNumConn int32
+	Adaptive   bool
+	Limit      int32         // current adaptive limit (or MaxNumConn if not adaptive)
+	P99Latency time.Duration // p99 latency of the last window
+	Baseline   time.Duration // baseline p99 latency
+	Shed       uint64        // requests shed
+	RetryAfter time.Duration
+}
+
+type adaptiveLimiter struct {
+	cfg   AdaptiveConfig
+	limit int32  // atomically
+	shed  uint64 // atomically
+
+	mu        sync.Mutex
+	windowEnd time.Time
+	samples   []time.Duration
+	count     int
+	peak      int32 // max requests in flight in the window
+	p99       time.Duration
+	baseline  time.Duration
+	windows   int // since the baseline was reset
+}
+
+// SetAdaptive turns on the adaptive mode (see ADAPTIVE LOAD SHEDDING),
+// or turns it off if cfg is nil.
+func (s *Listener) SetAdaptive(cfg *AdaptiveConfig) {
+	if cfg == nil {
+		s.adaptive.Store((*adaptiveLimiter)(nil))
+		return
+	}
+	c := *cfg
+	if c.MinLimit <= 0 {
+		c.MinLimit = 1
+	}
+	if c.MaxLimit <= 0 {
+		c.MaxLimit = atomic.LoadInt32(&s.maxNumConnHi)
+	}
+	if c.MaxLimit < c.MinLimit {
+		c.MaxLimit = c.MinLimit
+	}
+	if c.InitLimit <= 0 {
+		c.InitLimit = (c.MinLimit + c.MaxLimit) / 2
+	}
+	if c.Window <= 0 {
+		c.Window = time.Second
+	}
+	if c.MinSamples <= 0 {
+		c.MinSamples = 10
+	}
+	if c.Tolerance <= 1 {
+		c.Tolerance = 2
+	}
+	if c.RetryAfter <= 0 {
+		c.RetryAfter = time.Second
+	}
+	a := &adaptiveLimiter{cfg: c, limit: clampInt32(c.InitLimit, c.MinLimit, c.MaxLimit)}
+	a.windowEnd = time.Now().Add(c.Window)
+	s.adaptive.Store(a)
+}
+
+func (s *Listener) adaptiveLimiter() (a *adaptiveLimiter) {
+	a, _ = s.adaptive.Load().(*adaptiveLimiter)
+	return
+}
+
+// Limits returns a snapshot of the limits of the listener.
+func (s *Listener) Limits() (x ListenerLimits) {
+	x.MaxNumConn = atomic.LoadInt32(&s.maxNumConnHi)
+	x.Limit = x.MaxNumConn
+	a := s.adaptiveLimiter()
+	if a == nil {
+		return
+	}
+	x.Adaptive = true
+	x.Limit = atomic.LoadInt32(&a.limit)
+	x.Shed = atomic.LoadUint64(&a.shed)
+	x.RetryAfter = a.cfg.RetryAfter
+	a.mu.Lock()
+	x.P99Latency, x.Baseline = a.p99, a.baseline
+	a.mu.Unlock()
+	return
+}
+
+// observe records the latency of a request, which started with n requests in flight,
+// and adjusts the limit at the end of a window.
+func (a *adaptiveLimiter) observe(d time.Duration, n int32, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.count++
+	if len(a.samples) < maxAdaptiveSamples {
+		a.samples = append(a.samples, d)
+	} else if i := rand.Intn(a.count); i < len(a.samples) {
+		a.samples[i] = d
+	}
+	if n > a.peak {
+		a.peak = n
+	}
+	if now.Before(a.windowEnd) {
+		return
+	}
+	a.windowEnd = now.Add(a.cfg.Window)
+	if len(a.samples) < a.cfg.MinSamples {
+		return // keep the samples for the next window
+	}
+	sort.Slice(a.samples, func(i, j int) bool { return a.samples[i] < a.samples[j] })
+	a.p99 = a.samples[(len(a.samples)-1)*99/100]
+	if a.p99 <= 0 {
+		a.p99 = 1
+	}
+	if a.windows++; a.baseline == 0 || a.p99 < a.baseline || a.windows >= adaptiveBaselineWindows {
+		a.baseline, a.windows = a.p99, 0
+	}
+	limit := float64(atomic.LoadInt32(&a.limit))
+	grad := math.Max(0.5, math.Min(1, a.cfg.Tolerance*float64(a.baseline)/float64(a.p99)))
+	newLimit := limit * grad
+	if grad == 1 && float64(a.peak) >= limit/2 {
+		newLimit += math.Sqrt(limit)
+	}
+	newLimit2 := clampInt32(int32(newLimit), a.cfg.MinLimit, a.cfg.MaxLimit)
+	if newLimit2 != int32(limit) {
+		log.Debug(nil, "Adaptive limit: %d -> %d (p99 latency: %v, baseline: %v, peak: %d)",
+			int32(limit), newLimit2, a.p99, a.baseline, a.peak)
+		atomic.StoreInt32(&a.limit, newLimit2)
+	}
+	a.samples, a.count, a.peak = a.samples[:0], 0, 0
+}
+
+func clampInt32(v, min, max int32) int32 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
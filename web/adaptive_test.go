@@ -0,0 +1,117 @@
+package web
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// observeWindow records n latencies of d (with peak requests in flight),
+// the last one at the end of the window, so the limit is adjusted.
+func observeWindow(a *adaptiveLimiter, n int, d time.Duration, peak int32) int32 {
+	end := a.windowEnd
+	for i := 0; i < n-1; i++ {
+		a.observe(d, peak, end.Add(-time.Nanosecond))
+	}
+	a.observe(d, peak, end)
+	return atomic.LoadInt32(&a.limit)
+}
+
+func TestAdaptiveObserve(t *testing.T) {
+	cfg := AdaptiveConfig{MinLimit: 4, MaxLimit: 30, InitLimit: 16, Window: time.Second, MinSamples: 10, Tolerance: 2}
+	a := &adaptiveLimiter{cfg: cfg, limit: cfg.InitLimit, windowEnd: time.Now()}
+	ms := time.Millisecond
+	for i, x := range []struct {
+		n       int
+		latency time.Duration
+		peak    int32
+		limit   int32
+	}{
+		{10, 10 * ms, 16, 20}, // baseline: grows by its square root (as it was used)
+		{10, 10 * ms, 5, 20},  // not used enough: kept
+		{5, 10 * ms, 20, 20},  // too few samples: kept
+		{5, 10 * ms, 20, 24},  // with those of the last window
+		{10, 20 * ms, 24, 28}, // within tolerance
+		{10, 30 * ms, 24, 18}, // over tolerance: shrinks in proportion
+		{10, 200 * ms, 24, 9}, // at most halved
+		{10, 200 * ms, 24, 4}, // not below MinLimit
+		{10, 10 * ms, 4, 6},   // recovers
+		{10, 10 * ms, 30, 8},
+		{10, 1 * ms, 30, 10}, // a lower baseline
+		{10, 1 * ms, 300, 13},
+		{10, 1 * ms, 300, 16},
+		{10, 1 * ms, 300, 20},
+		{10, 1 * ms, 300, 24},
+		{10, 1 * ms, 300, 28},
+		{10, 1 * ms, 300, 30}, // not above MaxLimit
+		{10, 1 * ms, 300, 30},
+		{10, 10 * ms, 300, 15}, // the baseline is the lowest p99 latency
+	} {
+		if limit := observeWindow(a, x.n, x.latency, x.peak); limit != x.limit {
+			t.Fatalf("window %d: expected limit: %d, got: %d (p99: %v, baseline: %v)", i, x.limit, limit, a.p99, a.baseline)
+		}
+	}
+}
+
+// blockPipe signals started, and blocks until release is closed.
+type blockPipe struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p blockPipe) ServeHttpPipe(w ResponseWriter, r *http.Request, f *Pipeline) {
+	p.started <- struct{}{}
+	<-p.release
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestAdaptiveShed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lis := NewListener(l, 10, 0)
+	lis.SetAdaptive(&AdaptiveConfig{MinLimit: 1, MaxLimit: 1, RetryAfter: 1500 * time.Millisecond})
+	// idle keep-alive connections do not count against the limit
+	lis.trackConnOnAccept = true
+	atomic.StoreInt32(&lis.numConn, 5)
+
+	p := blockPipe{make(chan struct{}), make(chan struct{})}
+	svr := &HTTPServer{Listener: lis}
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		w2 := AsResponseWriter(w)
+		NewPipeline(svr, p).Next(w2, httptest.NewRequest("GET", "/", nil))
+		w2.Flush()
+		return w
+	}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve() }()
+	select {
+	case <-p.started:
+	case w := <-done:
+		t.Fatalf("expected request in flight, got: %d", w.Code)
+	}
+
+	// over the limit
+	w := serve()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expected 503 with Retry-After: 2, got: %d, with Retry-After: %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if x := lis.Limits(); x.Shed != 1 || x.Limit != 1 {
+		t.Fatalf("expected 1 shed with limit 1, got: %+v", x)
+	}
+	close(p.release)
+	if w = <-done; w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for request in flight, got: %d", w.Code)
+	}
+	// under the limit again
+	go func() { <-p.started }()
+	if w = serve(); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 after the request in flight is done, got: %d", w.Code)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ugorji/go-common/runtimeutil"
 )
@@ -47,18 +48,22 @@ func (c *conn) Close() error {
 // so that users know that it was closed gracefully.
 //
 type Listener struct {
+	pauses            uint64 // kept first, for 64-bit alignment of atomic ops
+	unpauses          uint64
 	closed            uint32 // 0 or 1 atomically
 	paused            uint32 // 0 or 1 atomically
 	hardPaused        uint32 // 0 or 1 atomically
 	maxNumConnHi      int32
 	maxNumConnLo      int32
 	numConn           int32
+	numReq            int32 // requests in flight (numConn counts connections, if trackConnOnAccept)
 	l                 net.Listener
 	pausedCond        *sync.Cond
 	closedCond        *sync.Cond
 	zeroCond          *sync.Cond
 	panicFlags        OnPanicFlags
 	trackConnOnAccept bool
+	adaptive          atomic.Value // *adaptiveLimiter (see SetAdaptive)
 }
 
 // Return a new listener.
@@ -117,6 +122,12 @@ func (s *Listener) handlePanic() {
 }
 
 func (s *Listener) Run(onClosed, onPaused, onRun func()) {
+	s.RunOrShed(onClosed, onPaused, onClosed, onRun)
+}
+
+// RunOrShed is like Run, but in adaptive mode, it calls onShed instead of onRun
+// if the requests in flight are over the adaptive limit (see SetAdaptive).
+func (s *Listener) RunOrShed(onClosed, onPaused, onShed, onRun func()) {
 	//If closed, set Connection Closed Header, so that this connection is not reused.
 	if atomic.LoadUint32(&s.closed) == 1 {
 		onClosed()
@@ -131,10 +142,23 @@ func (s *Listener) Run(onClosed, onPaused, onRun func()) {
 		n = atomic.AddInt32(&s.numConn, 1)
 	}
 
+	// in adaptive mode, shed requests over the limit, instead of pausing Accept.
+	// The limit is on requests in flight, so idle keep-alive connections do not count.
+	nReq := atomic.AddInt32(&s.numReq, 1)
+	defer atomic.AddInt32(&s.numReq, -1)
+	a := s.adaptiveLimiter()
+	if a != nil && nReq > atomic.LoadInt32(&a.limit) {
+		atomic.AddUint64(&a.shed, 1)
+		defer s.afterRun()
+		onShed()
+		return
+	}
+
 	if atomic.LoadUint32(&s.hardPaused) == 1 || atomic.LoadUint32(&s.paused) == 1 {
 		onPaused()
-	} else if nHi := atomic.LoadInt32(&s.maxNumConnHi); n >= nHi {
+	} else if nHi := atomic.LoadInt32(&s.maxNumConnHi); a == nil && n >= nHi {
 		if atomic.CompareAndSwapUint32(&s.paused, 0, 1) {
+			atomic.AddUint64(&s.pauses, 1)
 			log.Warning(nil, "PAUSE: Reached max num connections threshold (%d): %d", nHi, n)
 		}
 	}
@@ -149,7 +173,15 @@ func (s *Listener) Run(onClosed, onPaused, onRun func()) {
 	//
 	// The onus is on the handlers to ensure that requests are completed in good time.
 	// All requests must be completed in good time.
+	// A TimeoutPipe can be used to bound the time a request holds its slot.
+	if a == nil {
+		onRun()
+		return
+	}
+	time0 := time.Now()
 	onRun()
+	time1 := time.Now()
+	a.observe(time1.Sub(time0), nReq, time1)
 }
 
 func (s *Listener) afterRun() {
@@ -161,6 +193,7 @@ func (s *Listener) afterRun() {
 	}
 	if nLo := atomic.LoadInt32(&s.maxNumConnLo); n <= nLo { //handle when Lo=0 (e.g. if Hi=1)
 		if atomic.CompareAndSwapUint32(&s.paused, 1, 0) {
+			atomic.AddUint64(&s.unpauses, 1)
 			log.Warning(nil, "UNPAUSE. Below max num connections threshold (%d): %d", nLo, n)
 			signalCond(s.pausedCond)
 		}
@@ -180,8 +213,12 @@ func (s *Listener) Accept() (c net.Conn, err error) {
 	// use condition to wait if numConn is at maxConn, and wait till below threshold.
 	// Do not wait till Accept returns before releasing lock.
 	waitCond(s.pausedCond, true, func() bool {
-		return atomic.LoadUint32(&s.hardPaused) == 1 || atomic.LoadUint32(&s.paused) == 1
+		return atomic.LoadUint32(&s.closed) == 0 &&
+			(atomic.LoadUint32(&s.hardPaused) == 1 || atomic.LoadUint32(&s.paused) == 1)
 	})
+	if atomic.LoadUint32(&s.closed) == 1 {
+		return nil, ClosedErr
+	}
 	c, err = s.l.Accept()
 	if s.trackConnOnAccept {
 		if err == nil && c != nil {
@@ -198,12 +235,29 @@ func (s *Listener) Close() (err error) {
 	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
 		return
 	}
-	err = s.l.Close() //This unblocks Accept.
+	err = s.closeListener()
 	//wait for all connections to close, ie wait till numConn==0.
 	waitCond(s.closedCond, true, func() bool { return atomic.LoadInt32(&s.numConn) > 0 })
 	return
 }
 
+// StopAccepting closes the listener without waiting for in-flight requests to complete.
+// Subsequent requests (on kept-alive connections) are rejected with a 503.
+//
+// It returns false if the listener was already closed.
+func (s *Listener) StopAccepting() (ok bool, err error) {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return
+	}
+	return true, s.closeListener()
+}
+
+func (s *Listener) closeListener() (err error) {
+	err = s.l.Close()        //This unblocks Accept.
+	signalCond(s.pausedCond) //This unblocks an Accept waiting while paused.
+	return
+}
+
 func (s *Listener) HardPause() {
 	if atomic.LoadUint32(&s.closed) == 1 {
 		return
@@ -226,6 +280,26 @@ func (s *Listener) ResumeFromHardPause() {
 	return
 }
 
+// ListenerStats is a snapshot of the state of a Listener.
+type ListenerStats struct {
+	InFlight   int32  // requests being served
+	Paused     bool   // paused because the max number of connections was reached
+	HardPaused bool   // paused by HardPause
+	Pauses     uint64 // times it paused because the max number of connections was reached
+	Unpauses   uint64 // times it resumed from such a pause
+}
+
+// Stats returns a snapshot of the state of the listener (e.g. for metrics).
+func (s *Listener) Stats() ListenerStats {
+	return ListenerStats{
+		InFlight:   atomic.LoadInt32(&s.numConn),
+		Paused:     atomic.LoadUint32(&s.paused) == 1,
+		HardPaused: atomic.LoadUint32(&s.hardPaused) == 1,
+		Pauses:     atomic.LoadUint64(&s.pauses),
+		Unpauses:   atomic.LoadUint64(&s.unpauses),
+	}
+}
+
 func (s *Listener) IsClosed() bool {
 	return atomic.LoadUint32(&s.closed) == 1
 }
@@ -0,0 +1,449 @@
+/*
+METRICS
+
+Metrics is a registry of counters, gauges and histograms, which it writes out
+in the Prometheus text exposition format.
+
+MetricsPipe records metrics for each request (counts by method and status code,
+latency, response sizes and requests in flight), and serves the registry on a
+configurable path. It should be the first of the HTTPServer Pipes,
+so it sees all requests and the size of the response actually written.
+
+Typical usage:
+   mp := web.NewMetricsPipe("/metrics")
+   mp.AddListener(lis)
+   mp.AddPool("gzip", gzipPipe)
+   mp.AddPool("buffer", bufferPipe)
+   httpWebSvr.Pipes = append([]web.Pipe{mp}, httpWebSvr.Pipes...)
+
+Applications can add their own metrics to mp.Metrics.
+*/
+package web
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	// DefLatencyBuckets are the buckets (in seconds) for request latencies.
+	DefLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// DefSizeBuckets are the buckets (in bytes) for response sizes.
+	DefSizeBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+)
+
+type metricType string
+
+const (
+	counterMetric   metricType = "counter"
+	gaugeMetric     metricType = "gauge"
+	histogramMetric metricType = "histogram"
+)
+
+// atomicFloat is a float64 which is updated atomically.
+type atomicFloat uint64
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := atomic.LoadUint64((*uint64)(f))
+		if atomic.CompareAndSwapUint64((*uint64)(f), old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64((*uint64)(f)))
+}
+
+// series holds the value of a metric for a set of label values.
+type series struct {
+	labels  string // formatted e.g. {method="GET",code="200"}
+	value   atomicFloat
+	count   uint64   // histogram only
+	buckets []uint64 // histogram only: count per bucket (not cumulative)
+	fn      func() float64
+}
+
+// metric is a family of series with the same name.
+type metric struct {
+	name    string
+	help    string
+	typ     metricType
+	labels  []string
+	buckets []float64 // histogram only
+	mu      sync.RWMutex
+	series  map[string]*series
+}
+
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric: %s expects %d label values: got: %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	m.mu.RLock()
+	s := m.series[key]
+	m.mu.RUnlock()
+	if s != nil {
+		return s
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s = m.series[key]; s == nil {
+		s = &series{labels: formatLabels(m.labels, labelValues)}
+		if m.typ == histogramMetric {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Counter is a metric whose value only goes up.
+type Counter struct{ m *metric }
+
+// Add adds v (which must be >= 0) to the counter for the label values.
+func (c Counter) Add(v float64, labelValues ...string) {
+	c.m.get(labelValues).value.add(v)
+}
+
+// Inc adds 1 to the counter for the label values.
+func (c Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge is a metric whose value can go up and down.
+type Gauge struct{ m *metric }
+
+// Add adds v to the gauge for the label values.
+func (g Gauge) Add(v float64, labelValues ...string) {
+	g.m.get(labelValues).value.add(v)
+}
+
+// Set sets the gauge for the label values.
+func (g Gauge) Set(v float64, labelValues ...string) {
+	atomic.StoreUint64((*uint64)(&g.m.get(labelValues).value), math.Float64bits(v))
+}
+
+// Histogram is a metric which counts observed values in buckets.
+type Histogram struct{ m *metric }
+
+// Observe records the value v for the label values.
+func (h Histogram) Observe(v float64, labelValues ...string) {
+	s := h.m.get(labelValues)
+	if i := sort.SearchFloat64s(h.m.buckets, v); i < len(s.buckets) {
+		atomic.AddUint64(&s.buckets[i], 1)
+	}
+	atomic.AddUint64(&s.count, 1)
+	s.value.add(v)
+}
+
+// Metrics is a registry of metrics, which it writes out in the Prometheus text format.
+// It is safe for concurrent use.
+type Metrics struct {
+	mu      sync.RWMutex
+	metrics map[string]*metric
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{metrics: make(map[string]*metric)}
+}
+
+// register returns the metric with the name, creating it if not registered.
+// It panics if a metric with the name is registered with a different type or labels.
+func (r *Metrics) register(name, help string, typ metricType, buckets []float64, labels []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m := r.metrics[name]; m != nil {
+		if m.typ != typ || strings.Join(m.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metric: %s already registered as a %s with labels: %v", name, m.typ, m.labels))
+		}
+		return m
+	}
+	m := &metric{name: name, help: help, typ: typ, labels: labels, series: make(map[string]*series)}
+	if typ == histogramMetric {
+		m.buckets = append([]float64(nil), buckets...)
+		sort.Float64s(m.buckets)
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// Counter returns the counter with the name and label names, registering it if needed.
+func (r *Metrics) Counter(name, help string, labels ...string) Counter {
+	return Counter{r.register(name, help, counterMetric, nil, labels)}
+}
+
+// Gauge returns the gauge with the name and label names, registering it if needed.
+func (r *Metrics) Gauge(name, help string, labels ...string) Gauge {
+	return Gauge{r.register(name, help, gaugeMetric, nil, labels)}
+}
+
+// Histogram returns the histogram with the name, buckets (upper bounds) and label names,
+// registering it if needed.
+func (r *Metrics) Histogram(name, help string, buckets []float64, labels ...string) Histogram {
+	return Histogram{r.register(name, help, histogramMetric, buckets, labels)}
+}
+
+// CounterFunc registers a counter whose value is got from fn when the metrics are written.
+// labelPairs are the label names and values (e.g. "pool", "gzip") for this series.
+func (r *Metrics) CounterFunc(name, help string, fn func() float64, labelPairs ...string) {
+	r.registerFunc(name, help, counterMetric, fn, labelPairs)
+}
+
+// GaugeFunc registers a gauge whose value is got from fn when the metrics are written.
+// labelPairs are the label names and values (e.g. "pool", "gzip") for this series.
+func (r *Metrics) GaugeFunc(name, help string, fn func() float64, labelPairs ...string) {
+	r.registerFunc(name, help, gaugeMetric, fn, labelPairs)
+}
+
+func (r *Metrics) registerFunc(name, help string, typ metricType, fn func() float64, labelPairs []string) {
+	if len(labelPairs)%2 != 0 {
+		panic(fmt.Sprintf("metric: %s: label names and values must be in pairs: %v", name, labelPairs))
+	}
+	var labels, values []string
+	for i := 0; i < len(labelPairs); i += 2 {
+		labels, values = append(labels, labelPairs[i]), append(values, labelPairs[i+1])
+	}
+	m := r.register(name, help, typ, nil, labels)
+	s := m.get(values)
+	m.mu.Lock()
+	s.fn = fn
+	m.mu.Unlock()
+}
+
+// WriteTo writes out the metrics in the Prometheus text exposition format, sorted by name.
+func (r *Metrics) WriteTo(w io.Writer) (n int64, err error) {
+	r.mu.RLock()
+	ms := make([]*metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		ms = append(ms, m)
+	}
+	r.mu.RUnlock()
+	sort.Slice(ms, func(i, j int) bool { return ms[i].name < ms[j].name })
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, m := range ms {
+		m.writeTo(cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.(*bufio.Writer).Flush()
+	}
+	return cw.n, cw.err
+}
+
+func (m *metric) writeTo(w *countWriter) {
+	type seriesFn struct {
+		*series
+		fn func() float64
+	}
+	m.mu.RLock()
+	ss := make([]seriesFn, 0, len(m.series))
+	for _, s := range m.series {
+		ss = append(ss, seriesFn{s, s.fn})
+	}
+	m.mu.RUnlock()
+	if len(ss) == 0 {
+		return
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].labels < ss[j].labels })
+	if m.help != "" {
+		w.printf("# HELP %s %s\n", m.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(m.help))
+	}
+	w.printf("# TYPE %s %s\n", m.name, m.typ)
+	for _, s := range ss {
+		if m.typ != histogramMetric {
+			v := s.value.load()
+			if s.fn != nil {
+				v = s.fn()
+			}
+			w.printf("%s%s %s\n", m.name, s.labels, formatFloat(v))
+			continue
+		}
+		var cum uint64
+		for i, b := range m.buckets {
+			cum += atomic.LoadUint64(&s.buckets[i])
+			w.printf("%s_bucket%s %d\n", m.name, withLabel(s.labels, "le", formatFloat(b)), cum)
+		}
+		count := atomic.LoadUint64(&s.count)
+		w.printf("%s_bucket%s %d\n", m.name, withLabel(s.labels, "le", "+Inf"), count)
+		w.printf("%s_sum%s %s\n", m.name, s.labels, formatFloat(s.value.load()))
+		w.printf("%s_count%s %d\n", m.name, s.labels, count)
+	}
+}
+
+// ServeHTTP writes out the metrics.
+func (r *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", MetricsContentType)
+	_, err := r.WriteTo(w)
+	log.IfError(nil, err, "Error writing metrics")
+}
+
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countWriter) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	var n int
+	n, w.err = fmt.Fprintf(w.w, format, args...)
+	w.n += int64(n)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(names[i])
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel adds a label to formatted labels.
+func withLabel(labels, name, value string) string {
+	l := name + `="` + value + `"`
+	if labels == "" {
+		return "{" + l + "}"
+	}
+	return labels[:len(labels)-1] + "," + l + "}"
+}
+
+//--------------------------------------
+
+// MetricsPipe records metrics for each request, and serves the metrics on Path.
+type MetricsPipe struct {
+	// Path is the path on which the metrics are served. If "", they are not served.
+	Path     string
+	Metrics  *Metrics
+	requests Counter
+	latency  Histogram
+	size     Histogram
+	inflight Gauge
+}
+
+// NewMetricsPipe returns a MetricsPipe with a new Metrics, which serves it on path.
+func NewMetricsPipe(path string) (s *MetricsPipe) {
+	m := NewMetrics()
+	s = &MetricsPipe{
+		Path:     path,
+		Metrics:  m,
+		requests: m.Counter("http_requests_total", "Number of HTTP requests, by method and status code.", "method", "code"),
+		latency: m.Histogram("http_request_duration_seconds", "Latency of HTTP requests in seconds, by method.",
+			DefLatencyBuckets, "method"),
+		size:     m.Histogram("http_response_size_bytes", "Size of HTTP responses in bytes.", DefSizeBuckets),
+		inflight: m.Gauge("http_requests_in_flight", "Number of HTTP requests being served."),
+	}
+	s.inflight.Set(0)
+	return
+}
+
+// AddListener adds metrics for the connections, pauses and limits of the listener,
+// labelled by its address (so many listeners can be added).
+func (s *MetricsPipe) AddListener(l *Listener) {
+	m := s.Metrics
+	addr := l.Addr().String()
+	m.GaugeFunc("web_listener_in_flight", "Number of requests in flight on the listener.",
+		func() float64 { return float64(l.Stats().InFlight) }, "listener", addr)
+	m.GaugeFunc("web_listener_paused", "1 if the listener is paused (max connections reached, or hard paused), else 0.",
+		func() float64 {
+			if st := l.Stats(); st.Paused || st.HardPaused {
+				return 1
+			}
+			return 0
+		}, "listener", addr)
+	m.CounterFunc("web_listener_pauses_total", "Number of times the listener paused, as max connections was reached.",
+		func() float64 { return float64(l.Stats().Pauses) }, "listener", addr)
+	m.CounterFunc("web_listener_unpauses_total", "Number of times the listener resumed from a pause.",
+		func() float64 { return float64(l.Stats().Unpauses) }, "listener", addr)
+	m.GaugeFunc("web_listener_limit", "Limit of requests in flight on the listener (adaptive, or max connections).",
+		func() float64 { return float64(l.Limits().Limit) }, "listener", addr)
+	m.GaugeFunc("web_listener_p99_latency_seconds", "p99 latency of requests, as seen by the adaptive limit.",
+		func() float64 { return l.Limits().P99Latency.Seconds() }, "listener", addr)
+	m.CounterFunc("web_listener_shed_total", "Number of requests shed, as over the adaptive limit.",
+		func() float64 { return float64(l.Limits().Shed) }, "listener", addr)
+}
+
+// AddPool adds metrics for the usage of the pool of a pipe (e.g. GzipPipe or BufferPipe).
+func (s *MetricsPipe) AddPool(name string, p interface{ PoolStats() PoolStats }) {
+	m := s.Metrics
+	m.CounterFunc("web_pool_gets_total", "Number of writers taken from the pool.",
+		func() float64 { return float64(p.PoolStats().Gets) }, "pool", name)
+	m.CounterFunc("web_pool_allocs_total", "Number of writers created, as the pool was empty.",
+		func() float64 { return float64(p.PoolStats().Allocs) }, "pool", name)
+	m.CounterFunc("web_pool_discards_total", "Number of writers dropped, as the pool was full.",
+		func() float64 { return float64(p.PoolStats().Discards) }, "pool", name)
+	m.GaugeFunc("web_pool_in_use", "Number of writers taken from the pool and not yet returned.",
+		func() float64 { st := p.PoolStats(); return float64(st.Gets) - float64(st.Puts) }, "pool", name)
+}
+
+func (s *MetricsPipe) ServeHttpPipe(w ResponseWriter, r *http.Request, f *Pipeline) {
+	if s.Path != "" && r.URL.Path == s.Path {
+		s.Metrics.ServeHTTP(w, r)
+		return
+	}
+	s.inflight.Add(1)
+	time0 := time.Now()
+	var done bool
+	// record the metrics in a defer, so requests whose handler panics are counted
+	defer func() {
+		s.inflight.Add(-1)
+		code := w.ResponseCode()
+		if !done && !w.IsHeaderWritten() {
+			code = http.StatusInternalServerError // the handler panicked
+		}
+		method := metricsMethod(r.Method)
+		s.latency.Observe(time.Since(time0).Seconds(), method)
+		s.size.Observe(float64(w.NumBytesWritten()))
+		s.requests.Inc(method, strconv.Itoa(code))
+	}()
+	f.Next(w, r)
+	done = true
+}
+
+// metricsMethod returns the method as a label value, so arbitrary methods
+// do not create new series.
+func metricsMethod(m string) string {
+	switch m {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE":
+		return m
+	}
+	return "OTHER"
+}
@@ -0,0 +1,65 @@
+package web
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type panicPipe struct{}
+
+func (panicPipe) ServeHttpPipe(w ResponseWriter, r *http.Request, f *Pipeline) {
+	panic("boom")
+}
+
+func TestMetricsPipePanic(t *testing.T) {
+	mp := NewMetricsPipe("")
+	func() {
+		defer func() {
+			if x := recover(); x == nil {
+				t.Fatalf("expected panic")
+			}
+		}()
+		w := AsResponseWriter(httptest.NewRecorder())
+		NewPipeline(mp, panicPipe{}).Next(w, httptest.NewRequest("GET", "/", nil))
+	}()
+	var buf bytes.Buffer
+	if _, err := mp.Metrics.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`http_requests_total{method="GET",code="500"} 1`,
+		`http_requests_in_flight 0`,
+		`http_request_duration_seconds_count{method="GET"} 1`,
+	} {
+		if !strings.Contains(buf.String(), s+"\n") {
+			t.Errorf("expected: %s, in metrics:\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestMetricsPipeListeners(t *testing.T) {
+	mp := NewMetricsPipe("")
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		mp.AddListener(NewListener(l, 10, 0))
+		addrs = append(addrs, l.Addr().String())
+	}
+	var buf bytes.Buffer
+	if _, err := mp.Metrics.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if s := `web_listener_limit{listener="` + addr + `"} 10`; !strings.Contains(buf.String(), s+"\n") {
+			t.Errorf("expected: %s, in metrics:\n%s", s, buf.String())
+		}
+	}
+}
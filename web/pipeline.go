@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"sync/atomic"
 
 	"github.com/ugorji/go-common/pool"
 )
@@ -132,10 +133,49 @@ func (t *gzipWriter) Close() (err error) {
 	return
 }
 
+// PoolStats holds the usage of the pool of writers of a pipe (e.g. GzipPipe, BufferPipe).
+type PoolStats struct {
+	Gets     uint64 // writers taken from the pool
+	Allocs   uint64 // writers created, because the pool was empty
+	Puts     uint64 // writers returned to the pool
+	Discards uint64 // writers dropped, because the pool was full
+}
+
+// poolStats is updated atomically by the pool functions.
+type poolStats PoolStats
+
+func (p *poolStats) update(v interface{}, a pool.Action, v2 interface{}) {
+	if p == nil {
+		return
+	}
+	switch a {
+	case pool.GET:
+		atomic.AddUint64(&p.Gets, 1)
+		if v == nil {
+			atomic.AddUint64(&p.Allocs, 1)
+		}
+	case pool.PUT:
+		atomic.AddUint64(&p.Puts, 1)
+		if v2 == nil {
+			atomic.AddUint64(&p.Discards, 1)
+		}
+	}
+}
+
+func (p *poolStats) snapshot() PoolStats {
+	return PoolStats{
+		Gets:     atomic.LoadUint64(&p.Gets),
+		Allocs:   atomic.LoadUint64(&p.Allocs),
+		Puts:     atomic.LoadUint64(&p.Puts),
+		Discards: atomic.LoadUint64(&p.Discards),
+	}
+}
+
 // GzipPipe will convert http responseWriter to write out the compressed
 // bits if accept-encoding contains gzip, and deciphered content-type
 // is text/* or matches typical text types (xml, html, json, javascript, css).
 type GzipPipe struct {
+	stats   poolStats
 	level   int
 	poolCap int
 	pool    *pool.T
@@ -153,12 +193,22 @@ func NewGzipPipe(level, initPoolLen, poolCap int) (s *GzipPipe) {
 		level = gzip.DefaultCompression
 	}
 	s.level = level
-	s.pool = NewGzipWriterPool(level, initPoolLen, poolCap)
+	s.pool = newGzipWriterPool(level, initPoolLen, poolCap, &s.stats)
 	return
 }
 
+// PoolStats returns the usage of the pool of gzip writers.
+func (s *GzipPipe) PoolStats() PoolStats {
+	return s.stats.snapshot()
+}
+
 func NewGzipWriterPool(level, initPoolLen, poolCap int) *pool.T {
+	return newGzipWriterPool(level, initPoolLen, poolCap, nil)
+}
+
+func newGzipWriterPool(level, initPoolLen, poolCap int, stats *poolStats) *pool.T {
 	fn := func(v interface{}, a pool.Action, l int) (v2 interface{}, err error) {
+		defer func() { stats.update(v, a, v2) }()
 		v2 = v
 		switch a {
 		case pool.GET:
@@ -226,6 +276,7 @@ func (t *bufWriter) Close() (err error) {
 // Some pipes may need to determine the content type before converting
 // the result (e.g. gzip pipe). BufferPipe helps here.
 type BufferPipe struct {
+	stats   poolStats
 	size    int
 	poolCap int
 	pool    *pool.T
@@ -234,6 +285,7 @@ type BufferPipe struct {
 func NewBufferPipe(size, initPoolLen, poolCap int) (s *BufferPipe) {
 	s = &BufferPipe{size: size, poolCap: poolCap}
 	fn := func(v interface{}, a pool.Action, l int) (v2 interface{}, err error) {
+		defer func() { s.stats.update(v, a, v2) }()
 		v2 = v
 		switch a {
 		case pool.GET:
@@ -251,6 +303,11 @@ func NewBufferPipe(size, initPoolLen, poolCap int) (s *BufferPipe) {
 	return
 }
 
+// PoolStats returns the usage of the pool of buffers.
+func (s *BufferPipe) PoolStats() PoolStats {
+	return s.stats.snapshot()
+}
+
 func (s *BufferPipe) ServeHttpPipe(w ResponseWriter, r *http.Request, f *Pipeline) {
 	bw := pool.Must(s.pool.Get(0)).(*bufio.Writer)
 	bw.Reset(w)
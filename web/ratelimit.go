@@ -0,0 +1,199 @@
+/*
+RATE LIMITING
+
+RateLimitPipe limits the rate of requests of each client, with a token bucket per key
+(e.g. the remote IP address, or the value of a header). A bucket holds up to Burst tokens,
+and is refilled at Rate tokens per second. Each request takes a token: if there is none,
+the request is rejected with a 429 (Too Many Requests) and a Retry-After header.
+If Rate is 0, a bucket is only refilled once unused for RateLimitIdle
+(ie a client gets Burst requests per idle hour).
+
+Responses get the headers:
+  - X-RateLimit-Limit: the Burst
+  - X-RateLimit-Remaining: the tokens left in the bucket
+  - X-RateLimit-Reset: the seconds till the bucket is full
+
+The buckets are kept in a RateLimitStore. The default keeps them in memory
+(ie per process). A store shared by many processes can be built on an app.Cache
+(see app.CacheRateLimitStore).
+
+Within an app, the app.RateLimit Middleware limits the requests to a route
+(e.g. keyed by the name of the route, see app.RouteRateLimitKey).
+
+Typical usage:
+   rl := web.NewRateLimitPipe(web.RateLimit{Rate: 10, Burst: 20}, web.RemoteIPKey)
+   httpWebSvr.Pipes = append(httpWebSvr.Pipes, rl)
+*/
+package web
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit is the rate and burst of a token bucket.
+type RateLimit struct {
+	Rate  float64 // tokens added per second (if 0, refilled once unused for RateLimitIdle)
+	Burst int     // max tokens in the bucket (at least 1)
+}
+
+// RateLimitResult is the result of taking a token from a bucket.
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // time till a token is available, if not Allowed
+	Reset      time.Duration // time till the bucket is full
+}
+
+// RateLimitStore keeps the token buckets.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// RateLimitPipe is a Pipe which limits the rate of requests per key.
+type RateLimitPipe struct {
+	Limit RateLimit
+	Key   func(r *http.Request) string // if it returns "", the request is not limited
+	Store RateLimitStore
+}
+
+// NewRateLimitPipe returns a RateLimitPipe which keeps its buckets in memory.
+func NewRateLimitPipe(limit RateLimit, key func(r *http.Request) string) *RateLimitPipe {
+	return &RateLimitPipe{Limit: limit, Key: key, Store: NewMemRateLimitStore()}
+}
+
+// RemoteIPKey keys requests by the IP address of the client.
+func RemoteIPKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// HeaderKey keys requests by the value of a header (e.g. an api key).
+// Requests without the header are not limited.
+func HeaderKey(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if v := r.Header.Get(name); v != "" {
+			return name + ":" + v
+		}
+		return ""
+	}
+}
+
+func (s *RateLimitPipe) ServeHttpPipe(w ResponseWriter, r *http.Request, f *Pipeline) {
+	if x := s.Allow(r.Context(), w.Header(), s.Key(r)); !x.Allowed {
+		http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	f.Next(w, r)
+}
+
+// Allow takes a token from the bucket of the key, and sets the rate limit headers
+// (and Retry-After if not allowed) in h.
+//
+// If the key is "", or the store fails, the request is allowed (and the error logged).
+func (s *RateLimitPipe) Allow(ctx context.Context, h http.Header, key string) (x RateLimitResult) {
+	if key == "" {
+		x.Allowed = true
+		return
+	}
+	limit := s.Limit
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	x, err := s.Store.Take(ctx, key, limit, time.Now())
+	if err != nil {
+		log.IfError(nil, err, "Error taking rate limit token for: %s", key)
+		x.Allowed = true
+		return
+	}
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(x.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(ceilSeconds(x.Reset), 10))
+	if !x.Allowed {
+		h.Set("Retry-After", strconv.FormatInt(ceilSeconds(x.RetryAfter), 10))
+	}
+	return
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+//--------------------------------------
+
+// RateLimitIdle is the time after which an unused bucket which is not refilled
+// over time (ie Rate is 0) is full again.
+const RateLimitIdle = time.Hour
+
+type memBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when the bucket will be full (so it can be dropped)
+}
+
+// MemRateLimitStore is a RateLimitStore which keeps the buckets in memory.
+// Buckets are dropped once they are full (ie same as a new bucket).
+// Buckets which are not refilled over time (ie Rate is 0) are full (and dropped)
+// once unused for RateLimitIdle, so the store does not grow without bound.
+type MemRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memBucket
+	lastSweep time.Time
+}
+
+func NewMemRateLimitStore() *MemRateLimitStore {
+	return &MemRateLimitStore{buckets: make(map[string]*memBucket)}
+}
+
+func (s *MemRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (
+	x RateLimitResult, err error) {
+	burst := float64(limit.Burst)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	b := s.buckets[key]
+	if b == nil || !now.Before(b.full) {
+		b = &memBucket{tokens: burst}
+		s.buckets[key] = b
+	} else if limit.Rate > 0 {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		x.Allowed = true
+	} else if limit.Rate > 0 {
+		x.RetryAfter = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	} else {
+		x.RetryAfter = RateLimitIdle
+	}
+	x.Remaining = int(b.tokens)
+	if limit.Rate > 0 {
+		x.Reset = time.Duration((burst - b.tokens) / limit.Rate * float64(time.Second))
+	} else if b.tokens < burst {
+		x.Reset = RateLimitIdle
+	}
+	b.full = now.Add(x.Reset)
+	return
+}
+
+// sweep drops the full (or idle) buckets, at most once a minute.
+func (s *MemRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for k, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemRateLimitStoreSweep(t *testing.T) {
+	s := NewMemRateLimitStore()
+	now := time.Now()
+	for key, limit := range map[string]RateLimit{
+		"never":  {Rate: 0, Burst: 2},
+		"refill": {Rate: 1, Burst: 2},
+	} {
+		for i, allowed := range []bool{true, true, false} {
+			x, err := s.Take(context.Background(), key, limit, now)
+			if err != nil || x.Allowed != allowed {
+				t.Fatalf("%s: take %d: expected allowed: %v, got: %v (error: %v)", key, i, allowed, x.Allowed, err)
+			}
+		}
+	}
+	s.Take(context.Background(), "other", RateLimit{Rate: 1, Burst: 2}, now.Add(time.Minute))
+	if _, ok := s.buckets["never"]; !ok {
+		t.Fatalf("bucket which is never refilled dropped before it is idle")
+	}
+	if _, ok := s.buckets["refill"]; ok {
+		t.Fatalf("full bucket not dropped")
+	}
+	s.Take(context.Background(), "other", RateLimit{Rate: 1, Burst: 2}, now.Add(RateLimitIdle))
+	if _, ok := s.buckets["never"]; ok {
+		t.Fatalf("idle bucket which is never refilled not dropped")
+	}
+}
+
+func TestMemRateLimitStoreNoRefill(t *testing.T) {
+	s := NewMemRateLimitStore()
+	now := time.Now()
+	limit := RateLimit{Rate: 0, Burst: 2}
+	for i, x := range []struct {
+		after     time.Duration
+		allowed   bool
+		remaining int
+	}{
+		{0, true, 1},
+		{time.Minute, true, 0},
+		{30 * time.Minute, false, 0},
+		{RateLimitIdle - time.Second, false, 0}, // kept exhausted while used
+		{2*RateLimitIdle - 2*time.Second, false, 0},
+		{3*RateLimitIdle - 2*time.Second, true, 1}, // full once unused for RateLimitIdle
+	} {
+		r, err := s.Take(context.Background(), "k", limit, now.Add(x.after))
+		if err != nil || r.Allowed != x.allowed || r.Remaining != x.remaining || r.Reset != RateLimitIdle {
+			t.Fatalf("take %d: expected allowed: %v, remaining: %d, got: %+v (error: %v)", i, x.allowed, x.remaining, r, err)
+		}
+		if !x.allowed && r.RetryAfter != RateLimitIdle {
+			t.Fatalf("take %d: expected Retry-After: %v, got: %v", i, RateLimitIdle, r.RetryAfter)
+		}
+	}
+}
+
+func TestRateLimitPipe(t *testing.T) {
+	rl := NewRateLimitPipe(RateLimit{Rate: 1, Burst: 2}, HeaderKey("X-Api-Key"))
+	for i, x := range []struct {
+		key                     string
+		code                    int
+		limit, remaining, reset string
+		retryAfter              string
+	}{
+		{"a", 200, "2", "1", "1", ""},
+		{"a", 200, "2", "0", "2", ""},
+		{"a", 429, "2", "0", "2", "1"},
+		{"b", 200, "2", "1", "1", ""},
+		{"", 200, "", "", "", ""}, // not limited
+		{"", 200, "", "", "", ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if x.key != "" {
+			req.Header.Set("X-Api-Key", x.key)
+		}
+		w := httptest.NewRecorder()
+		w2 := AsResponseWriter(w)
+		NewPipeline(rl, okPipe{}).Next(w2, req)
+		w2.Flush()
+		h := w.Header()
+		if w.Code != x.code || h.Get("X-RateLimit-Limit") != x.limit || h.Get("X-RateLimit-Remaining") != x.remaining ||
+			h.Get("X-RateLimit-Reset") != x.reset || h.Get("Retry-After") != x.retryAfter {
+			t.Fatalf("request %d: expected: %d, limit: %q, remaining: %q, reset: %q, retry after: %q, got: %d, %v",
+				i, x.code, x.limit, x.remaining, x.reset, x.retryAfter, w.Code, h)
+		}
+	}
+}
+
+// okPipe writes a 200.
+type okPipe struct{}
+
+func (okPipe) ServeHttpPipe(w ResponseWriter, r *http.Request, f *Pipeline) {
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,153 @@
+/*
+RESTART
+
+A server can restart without dropping connections, by handing its listening sockets
+to a new process (e.g. a new binary on deploy).
+
+On a restart signal (SIGHUP or SIGUSR2 by default, on unix), a Runner starts a child
+process (the same executable and arguments), passing it the socket of its Listener
+via ExtraFiles and the ListenFdsEnvVar environment variable. It then shuts down
+gracefully ie it stops accepting connections and drains in-flight requests,
+while the child accepts connections on the same socket.
+
+The child gets the socket by calling Listen, which returns the inherited listener
+if there is one, else a new one. Listeners are inherited in the order they were
+passed to StartChild, and returned by Listen in that order.
+
+Typical usage:
+   l, err = web.Listen("tcp", ":8080")
+   lis = web.NewListener(l, 1000, web.OnPanicRecover)
+   ...
+   _, err = web.NewRunner(svr, lis).Serve()
+*/
+package web
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// ListenFdsEnvVar is the environment variable which tells a child process
+// how many listening sockets it inherited, starting at file descriptor 3.
+const ListenFdsEnvVar = "WEB_LISTEN_FDS"
+
+var inherited struct {
+	sync.Mutex
+	once sync.Once
+	ls   []net.Listener
+	err  error
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// File returns a duplicate of the file of the underlying socket
+// (e.g. to pass it to a child process).
+func (s *Listener) File() (f *os.File, err error) {
+	x, ok := s.l.(filer)
+	if !ok {
+		return nil, fmt.Errorf("Listener of type: %T does not support File", s.l)
+	}
+	return x.File()
+}
+
+// InheritedListeners returns the listeners inherited from a parent process
+// (see StartChild) which have not been returned by Listen.
+func InheritedListeners() (ls []net.Listener, err error) {
+	inherited.once.Do(loadInheritedListeners)
+	inherited.Lock()
+	ls, err = inherited.ls, inherited.err
+	inherited.Unlock()
+	return
+}
+
+func loadInheritedListeners() {
+	s := os.Getenv(ListenFdsEnvVar)
+	if s == "" {
+		return
+	}
+	// unset it, so it is not inherited by processes we start (which do not get our files).
+	os.Unsetenv(ListenFdsEnvVar)
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		inherited.err = fmt.Errorf("Invalid value: %q for %s: %v", s, ListenFdsEnvVar, err)
+		return
+	}
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), "listener-"+strconv.Itoa(i))
+		l, err := net.FileListener(f)
+		// FileListener dups the file, so close it regardless
+		log.IfError(nil, f.Close(), "Error closing inherited file: %d", 3+i)
+		if err != nil {
+			inherited.err = fmt.Errorf("Error inheriting listener: %d: %v", i, err)
+			return
+		}
+		log.Info(nil, "Inherited listener: %d: %v", i, l.Addr())
+		inherited.ls = append(inherited.ls, l)
+	}
+}
+
+// Listen returns the next listener inherited from a parent process, if any,
+// else it announces on the local network address (see net.Listen).
+func Listen(network, addr string) (l net.Listener, err error) {
+	inherited.once.Do(loadInheritedListeners)
+	inherited.Lock()
+	if err = inherited.err; err == nil && len(inherited.ls) > 0 {
+		l, inherited.ls = inherited.ls[0], inherited.ls[1:]
+	}
+	inherited.Unlock()
+	if err != nil || l != nil {
+		return
+	}
+	return net.Listen(network, addr)
+}
+
+// StartChild starts a copy of this process (same executable, arguments and environment)
+// which inherits the listeners. The child gets them by calling Listen in the same order.
+//
+// The child is waited on in another goroutine, so callers must not Wait on p.
+func StartChild(ls ...net.Listener) (p *os.Process, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	files := make([]*os.File, 0, len(ls))
+	defer func() {
+		for _, f := range files {
+			closeFile(f, f.Name())
+		}
+	}()
+	for _, l := range ls {
+		x, ok := l.(filer)
+		if !ok {
+			return nil, fmt.Errorf("Listener of type: %T does not support File", l)
+		}
+		var f *os.File
+		if f, err = x.File(); err != nil {
+			return
+		}
+		files = append(files, f)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), ListenFdsEnvVar+"="+strconv.Itoa(len(files)))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	log.Info(nil, "Started child process: %d, with %d listeners", cmd.Process.Pid, len(files))
+	// reap the child when it exits (e.g. if it fails early), so it is not left a zombie.
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Warning(nil, "Child process: %d exited: %v", cmd.Process.Pid, err)
+		} else {
+			log.Info(nil, "Child process: %d exited", cmd.Process.Pid)
+		}
+	}()
+	return cmd.Process, nil
+}
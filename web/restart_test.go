@@ -0,0 +1,104 @@
+//go:build !windows
+
+package web
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// restartChildEnvVar is set when the test binary is re-executed as a child by StartChild.
+const restartChildEnvVar = "WEB_TEST_RESTART_CHILD"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(restartChildEnvVar) != "" {
+		os.Exit(runRestartChild())
+	}
+	os.Exit(m.Run())
+}
+
+// runRestartChild serves one request on the inherited listener, then exits.
+func runRestartChild() int {
+	if s, _ := os.LookupEnv(ListenFdsEnvVar); s != "1" {
+		return 2
+	}
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 3
+	}
+	done := make(chan struct{}, 1)
+	svr := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "child")
+		done <- struct{}{}
+	})}
+	go svr.Serve(l)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		return 4
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if svr.Shutdown(ctx) != nil {
+		return 5
+	}
+	return 0
+}
+
+func TestStartChild(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String() + "/"
+	svr := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "parent")
+	})}
+	go svr.Serve(l)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 10 * time.Second}
+	get := func() string {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		return string(b)
+	}
+	if s := get(); s != "parent" {
+		t.Fatalf("before handoff: expected: parent, got: %q", s)
+	}
+
+	os.Setenv(restartChildEnvVar, "1")
+	p, err := StartChild(l)
+	os.Unsetenv(restartChildEnvVar)
+	if err != nil {
+		t.Fatalf("StartChild: %v", err)
+	}
+	// stop serving, as the parent does on a restart (this closes the listener)
+	if err = svr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if s := get(); s != "child" {
+		t.Fatalf("after handoff: expected: child, got: %q", s)
+	}
+
+	// the child exits after serving a request, and is reaped by StartChild
+	for tend := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if err = p.Signal(syscall.Signal(0)); errors.Is(err, os.ErrProcessDone) {
+			break
+		}
+		if time.Now().After(tend) {
+			t.Fatalf("child process: %d not reaped (signal 0: %v)", p.Pid, err)
+		}
+	}
+}
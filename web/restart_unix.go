@@ -0,0 +1,10 @@
+//go:build !windows
+
+package web
+
+import (
+	"os"
+	"syscall"
+)
+
+var defRestartSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR2}
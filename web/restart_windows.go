@@ -0,0 +1,6 @@
+package web
+
+import "os"
+
+// windows does not support passing listeners to a child process (via ExtraFiles).
+var defRestartSignals []os.Signal
@@ -0,0 +1,271 @@
+/*
+SERVE
+
+Runner serves an http.Server on a Listener until it receives a shutdown signal
+(SIGTERM or SIGINT by default), and then shuts down gracefully:
+
+  - it stops accepting connections (requests on kept-alive connections get a 503)
+  - it drains in-flight requests, up to the DrainTimeout (a second signal cuts this short)
+  - it closes the connections (forcibly, for those still in-flight)
+  - it flushes and closes the AccessLoggers
+  - it runs the registered shutdown hooks, in the order they were registered
+
+On a restart signal, it first starts a child process which inherits the socket
+of its Listener (see RESTART).
+
+A ShutdownReport is logged at the end, including the requests which were cut off
+(if the Handler of the http.Server is an HTTPServer) and the hooks which failed.
+
+Typical usage:
+   httpWebSvr := &web.HTTPServer{Listener: lis}
+   svr := &http.Server{Handler: httpWebSvr, ReadTimeout: 30 * time.Second}
+   x := web.NewRunner(svr, lis)
+   x.AccessLoggers = append(x.AccessLoggers, accessLogger)
+   x.OnShutdown("datastore", func(ctx context.Context) error { return db.Close() })
+   _, err = x.Serve()
+*/
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// DefDrainTimeout is the time a Runner waits for in-flight requests at shutdown.
+	DefDrainTimeout = 30 * time.Second
+	// DefHookTimeout is the time a Runner gives all shutdown hooks to complete.
+	DefHookTimeout = 10 * time.Second
+)
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Runner serves an http.Server on a Listener, and shuts them down gracefully.
+type Runner struct {
+	Server         *http.Server
+	Listener       *Listener
+	DrainTimeout   time.Duration // if 0, DefDrainTimeout
+	HookTimeout    time.Duration // if 0, DefHookTimeout
+	Signals        []os.Signal   // if nil, SIGTERM and SIGINT
+	RestartSignals []os.Signal   // if nil, SIGHUP and SIGUSR2 on unix (see RESTART)
+	AccessLoggers  []*AccessLogger
+
+	mu       sync.Mutex
+	hooks    []shutdownHook
+	stopc    chan struct{}
+	stopOnce sync.Once
+}
+
+// ShutdownReport describes a graceful shutdown, including what was cut off.
+type ShutdownReport struct {
+	Reason     string             // signal received, Shutdown, restart, or error from serving
+	Drained    bool               // all in-flight requests completed within the DrainTimeout
+	DrainTime  time.Duration      // time taken to drain (or till cut off)
+	CutOff     int32              // in-flight requests which were cut off
+	Requests   []*InFlightRequest // requests which were cut off (if the Handler is an HTTPServer)
+	HookErrors []error            // errors from the shutdown hooks (or closing AccessLoggers)
+}
+
+func (x *ShutdownReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Shutdown (%s): ", x.Reason)
+	if x.Drained {
+		fmt.Fprintf(&b, "drained in-flight requests in %v", x.DrainTime)
+	} else {
+		fmt.Fprintf(&b, "cut off %d in-flight requests after %v", x.CutOff, x.DrainTime)
+	}
+	for _, v := range x.Requests {
+		fmt.Fprintf(&b, "\n  - request %d: %s %s%s, running for %v",
+			v.Seq, v.Method, v.Host, v.Path, time.Since(v.Start))
+	}
+	for _, err := range x.HookErrors {
+		fmt.Fprintf(&b, "\n  - error: %v", err)
+	}
+	return b.String()
+}
+
+// NewRunner returns a Runner for the http.Server and the Listener it serves on.
+func NewRunner(svr *http.Server, l *Listener) *Runner {
+	return &Runner{Server: svr, Listener: l}
+}
+
+// Serve serves the http.Server on the Listener until a shutdown signal is received,
+// and then shuts down gracefully (see Runner). It is a convenience for NewRunner(...).Serve().
+func Serve(svr *http.Server, l *Listener, drainTimeout time.Duration, accessLoggers ...*AccessLogger) (err error) {
+	x := NewRunner(svr, l)
+	x.DrainTimeout = drainTimeout
+	x.AccessLoggers = accessLoggers
+	_, err = x.Serve()
+	return
+}
+
+// OnShutdown registers a hook to run at shutdown, after in-flight requests are drained.
+// Hooks run in the order they were registered, and share the HookTimeout.
+func (x *Runner) OnShutdown(name string, fn func(ctx context.Context) error) {
+	x.mu.Lock()
+	x.hooks = append(x.hooks, shutdownHook{name, fn})
+	x.mu.Unlock()
+}
+
+// Shutdown triggers a graceful shutdown, as if a shutdown signal was received.
+func (x *Runner) Shutdown() {
+	x.stopOnce.Do(func() { close(x.stopChan()) })
+}
+
+func (x *Runner) stopChan() (c chan struct{}) {
+	x.mu.Lock()
+	if x.stopc == nil {
+		x.stopc = make(chan struct{})
+	}
+	c = x.stopc
+	x.mu.Unlock()
+	return
+}
+
+// Serve serves until a shutdown signal is received (or Shutdown is called, or serving fails),
+// and then shuts down gracefully. It returns the error from serving, if any.
+func (x *Runner) Serve() (report *ShutdownReport, err error) {
+	sigs := x.Signals
+	if sigs == nil {
+		sigs = []os.Signal{syscall.SIGTERM, os.Interrupt}
+	}
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, sigs...)
+	defer signal.Stop(sigc)
+
+	rsigs := x.RestartSignals
+	if rsigs == nil {
+		rsigs = defRestartSignals
+	}
+	rsigc := make(chan os.Signal, 1)
+	if len(rsigs) > 0 {
+		signal.Notify(rsigc, rsigs...)
+		defer signal.Stop(rsigc)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- x.Server.Serve(x.Listener) }()
+
+	report = new(ShutdownReport)
+	for report.Reason == "" {
+		select {
+		case sig := <-sigc:
+			report.Reason = "signal: " + sig.String()
+		case sig := <-rsigc:
+			// if the child cannot be started, keep serving
+			p, err2 := StartChild(x.Listener)
+			if err2 != nil {
+				log.IfError(nil, err2, "Error restarting on signal: %v", sig)
+				continue
+			}
+			report.Reason = fmt.Sprintf("restart on signal: %v: child process: %d", sig, p.Pid)
+		case <-x.stopChan():
+			report.Reason = "Shutdown"
+		case err = <-errc:
+			if err == ClosedErr || err == http.ErrServerClosed {
+				err = nil
+				report.Reason = "listener closed"
+			} else {
+				report.Reason = fmt.Sprintf("serve: %v", err)
+			}
+		}
+	}
+	log.Info(nil, "Shutting down gracefully: %s", report.Reason)
+	x.shutdown(report, sigc)
+	if report.Drained && len(report.HookErrors) == 0 {
+		log.Info(nil, "%v", report)
+	} else {
+		log.Warning(nil, "%v", report)
+	}
+	return
+}
+
+func (x *Runner) shutdown(report *ShutdownReport, sigc chan os.Signal) {
+	drainTimeout, hookTimeout := x.DrainTimeout, x.HookTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = DefDrainTimeout
+	}
+	if hookTimeout <= 0 {
+		hookTimeout = DefHookTimeout
+	}
+	time0 := time.Now()
+	_, err := x.Listener.StopAccepting()
+	log.IfError(nil, err, "Error closing listener")
+	x.Server.SetKeepAlivesEnabled(false)
+
+	// drain: a second signal cuts it short
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-sigc:
+			log.Warning(nil, "Received signal: %v while draining: cutting off in-flight requests", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	zeroc := make(chan struct{})
+	go func() {
+		x.Listener.WaitZeroInflight()
+		close(zeroc)
+	}()
+	// Shutdown closes idle connections, and waits for active ones to become idle.
+	err = x.Server.Shutdown(ctx)
+	if err == nil {
+		select {
+		case <-zeroc:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	report.DrainTime = time.Since(time0)
+	if err == nil {
+		report.Drained = true
+	} else {
+		report.CutOff = x.Listener.Stats().InFlight
+		if hs, ok := x.Server.Handler.(*HTTPServer); ok {
+			report.Requests = hs.InFlight()
+		}
+		log.IfError(nil, x.Server.Close(), "Error closing connections")
+	}
+
+	for _, al := range x.AccessLoggers {
+		if err = al.Close(); err != nil {
+			report.HookErrors = append(report.HookErrors, fmt.Errorf("access log: %s: %v", al.name, err))
+		}
+	}
+
+	x.mu.Lock()
+	hooks := x.hooks
+	x.mu.Unlock()
+	ctx2, cancel2 := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel2()
+	for _, h := range hooks {
+		log.Debug(nil, "Running shutdown hook: %s", h.name)
+		if err = runShutdownHook(ctx2, h); err != nil {
+			report.HookErrors = append(report.HookErrors, fmt.Errorf("hook: %s: %v", h.name, err))
+		}
+	}
+}
+
+func runShutdownHook(ctx context.Context, h shutdownHook) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("panic: %v", x)
+		}
+	}()
+	return h.fn(ctx)
+}
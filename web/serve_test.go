@@ -0,0 +1,177 @@
+//go:build !windows
+
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runnerTest serves a blockPipe with a Runner, and records the shutdown hooks run.
+type runnerTest struct {
+	x     *Runner
+	p     blockPipe
+	url   string
+	hooks []string
+}
+
+func newRunnerTest(t *testing.T, drainTimeout, hookTimeout time.Duration) (rt *runnerTest) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := NewListener(l, 100, 0)
+	rt = &runnerTest{p: blockPipe{make(chan struct{}, 1), make(chan struct{})}, url: "http://" + l.Addr().String()}
+	svr := &http.Server{Handler: &HTTPServer{Listener: lis, Pipes: []Pipe{rt.p}}}
+	rt.x = NewRunner(svr, lis)
+	rt.x.DrainTimeout, rt.x.HookTimeout = drainTimeout, hookTimeout
+	rt.x.Signals = []os.Signal{syscall.SIGUSR1}
+	rt.x.RestartSignals = []os.Signal{}
+	return
+}
+
+// hook registers a shutdown hook, which records that it ran and then calls fn.
+func (rt *runnerTest) hook(name string, fn func(ctx context.Context) error) {
+	rt.x.OnShutdown(name, func(ctx context.Context) error {
+		rt.hooks = append(rt.hooks, name)
+		return fn(ctx)
+	})
+}
+
+// serve serves until shutdown, with a request in flight when cutOff is called.
+// It returns the report, and the status code of the request (0 if it failed).
+func (rt *runnerTest) serve(t *testing.T, cutOff func()) (report *ShutdownReport, code int) {
+	type result struct {
+		report *ShutdownReport
+		err    error
+	}
+	servec := make(chan result, 1)
+	go func() {
+		report, err := rt.x.Serve()
+		servec <- result{report, err}
+	}()
+	codec := make(chan int, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Get(rt.url + "/slow")
+		if err != nil {
+			codec <- 0
+			return
+		}
+		resp.Body.Close()
+		codec <- resp.StatusCode
+	}()
+	select {
+	case <-rt.p.started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("request not started")
+	}
+	rt.x.Shutdown()
+	// wait till it stops accepting ie it is draining
+	for tend := time.Now().Add(10 * time.Second); !rt.x.Listener.IsClosed(); time.Sleep(time.Millisecond) {
+		if time.Now().After(tend) {
+			t.Fatal("listener not closed after Shutdown")
+		}
+	}
+	cutOff()
+	var res result
+	select {
+	case res = <-servec:
+	case <-time.After(10 * time.Second):
+		close(rt.p.release)
+		t.Fatal("Serve did not return after Shutdown")
+	}
+	if res.err != nil {
+		t.Fatalf("Serve: %v", res.err)
+	}
+	code = <-codec
+	return res.report, code
+}
+
+func TestRunnerShutdown(t *testing.T) {
+	hookErr := errors.New("hook failed")
+	for _, x := range []struct {
+		name    string
+		drain   time.Duration
+		drained bool
+		cutOff  func(rt *runnerTest)
+	}{
+		{"drained", 10 * time.Second, true, func(rt *runnerTest) {
+			time.Sleep(20 * time.Millisecond)
+			close(rt.p.release)
+		}},
+		{"timeout", 50 * time.Millisecond, false, func(rt *runnerTest) {}},
+		{"signal", 10 * time.Second, false, func(rt *runnerTest) {
+			syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		}},
+	} {
+		rt := newRunnerTest(t, x.drain, 50*time.Millisecond)
+		rt.hook("first", func(ctx context.Context) error { return nil })
+		rt.hook("failed", func(ctx context.Context) error { return hookErr })
+		rt.hook("panicked", func(ctx context.Context) error { panic("oops") })
+		rt.hook("slow", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		rt.hook("late", func(ctx context.Context) error { return nil })
+
+		time0 := time.Now()
+		report, code := rt.serve(t, func() { x.cutOff(rt) })
+		if !x.drained {
+			close(rt.p.release)
+		}
+		if report.Reason != "Shutdown" || report.Drained != x.drained {
+			t.Fatalf("%s: expected reason: Shutdown, drained: %v, got: %v", x.name, x.drained, report)
+		}
+		if d := time.Since(time0); report.DrainTime > d || d > 5*time.Second {
+			t.Fatalf("%s: expected drain time within %v, got: %v", x.name, d, report.DrainTime)
+		}
+		if x.drained {
+			if code != http.StatusOK || report.CutOff != 0 || len(report.Requests) != 0 {
+				t.Fatalf("%s: expected 200 with none cut off, got: %d, %v", x.name, code, report)
+			}
+			if s := report.String(); !strings.HasPrefix(s, "Shutdown (Shutdown): drained in-flight requests in ") {
+				t.Fatalf("%s: unexpected report: %s", x.name, s)
+			}
+		} else {
+			if code != 0 || report.CutOff != 1 || len(report.Requests) != 1 ||
+				report.Requests[0].Method != "GET" || report.Requests[0].Path != "/slow" {
+				t.Fatalf("%s: expected request cut off, got: %d, %v", x.name, code, report)
+			}
+			if s := report.String(); !strings.Contains(s, "cut off 1 in-flight requests after ") ||
+				!strings.Contains(s, ": GET 127.0.0.1:") {
+				t.Fatalf("%s: unexpected report: %s", x.name, s)
+			}
+		}
+
+		// hooks run in order, and share the HookTimeout
+		if exp := []string{"first", "failed", "panicked", "slow"}; !reflect.DeepEqual(rt.hooks, exp) {
+			t.Fatalf("%s: expected hooks run: %v, got: %v", x.name, exp, rt.hooks)
+		}
+		var errs []string
+		for _, err := range report.HookErrors {
+			errs = append(errs, err.Error())
+		}
+		exp := []string{
+			"hook: failed: " + hookErr.Error(),
+			"hook: panicked: panic: oops",
+			"hook: slow: " + context.DeadlineExceeded.Error(),
+			"hook: late: " + context.DeadlineExceeded.Error(),
+		}
+		if !reflect.DeepEqual(errs, exp) {
+			t.Fatalf("%s: expected hook errors: %q, got: %q", x.name, exp, errs)
+		}
+		if s := report.String(); !strings.HasSuffix(s, fmt.Sprintf("\n  - error: %s", exp[3])) {
+			t.Fatalf("%s: expected hook errors in report, got: %s", x.name, s)
+		}
+	}
+}
@@ -2,6 +2,9 @@ package web
 
 import (
 	"net/http"
+	"sort"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -23,7 +26,28 @@ var log = logging.PkgLogger()
 type HTTPServer struct {
 	Pipes []Pipe
 	*Listener
-	seq uint64
+	seq      uint64
+	inflight sync.Map // seq -> *InFlightRequest
+}
+
+// InFlightRequest describes a request being served by an HTTPServer.
+type InFlightRequest struct {
+	Seq    uint64
+	Method string
+	Host   string
+	Path   string
+	Start  time.Time
+}
+
+// InFlight returns the requests being served, oldest first
+// (e.g. to report which requests were cut off at shutdown).
+func (s *HTTPServer) InFlight() (v []*InFlightRequest) {
+	s.inflight.Range(func(_, x interface{}) bool {
+		v = append(v, x.(*InFlightRequest))
+		return true
+	})
+	sort.Slice(v, func(i, j int) bool { return v[i].Seq < v[j].Seq })
+	return
 }
 
 // // Return a new server.
@@ -69,14 +93,20 @@ func (s *HTTPServer) ServeHttpPipe(w ResponseWriter, r *http.Request, f *Pipelin
 	onPaused := func() {
 		w.Header().Set("Connection", "close")
 	}
-	onRun := func() {
-		f.Next(w, r)
+	onShed := func() {
+		w.Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(s.Listener.Limits().RetryAfter), 10))
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
 	}
 	// add a seq num to the id, so we can correlate requests in the log file
 	n := atomic.AddUint64(&s.seq, 1)
 	time0 := time.Now()
+	onRun := func() {
+		s.inflight.Store(n, &InFlightRequest{n, r.Method, r.Host, r.URL.Path, time0})
+		defer s.inflight.Delete(n)
+		f.Next(w, r)
+	}
 	log.Debug(nil, "Request %d: %s%s", n, r.Host, r.URL.Path)
-	s.Listener.Run(onClosed, onPaused, onRun)
+	s.Listener.RunOrShed(onClosed, onPaused, onShed, onRun)
 	log.Debug(nil, "Request %d: %s%s, %d bytes, response: %d, in %v",
 		n, r.Host, r.URL.Path, w.NumBytesWritten(), w.ResponseCode(), time.Since(time0))
 }
@@ -0,0 +1,216 @@
+/*
+TIMEOUTS
+
+TimeoutPipe sets a deadline on each request (globally, or per request via TimeoutFor),
+on the context of the request (ie r.Context()), so handlers can stop their work once it
+is cancelled. Pipes after it (and the handler) run in another goroutine, so that the
+pipe can return at the deadline and free the slot of the request in the Listener.
+
+At the deadline, if the response is not committed (see ResponseWriter.IsHeaderWritten),
+the pipe writes a 503 (or the configured Code e.g. 504). Else the response is cut short.
+Either way, further writes by the handler are discarded (and return http.ErrHandlerTimeout).
+
+Typical usage:
+   tp := &web.TimeoutPipe{Timeout: 30 * time.Second}
+   httpWebSvr.Pipes = append(httpWebSvr.Pipes, tp)
+*/
+package web
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ugorji/go-common/runtimeutil"
+)
+
+// TimeoutPipe is a Pipe which sets a deadline on requests.
+type TimeoutPipe struct {
+	Timeout    time.Duration
+	TimeoutFor func(r *http.Request) time.Duration // if nil or it returns 0, Timeout is used
+	Code       int                                 // if 0, 503 (Service Unavailable)
+}
+
+func (s *TimeoutPipe) ServeHttpPipe(w ResponseWriter, r *http.Request, f *Pipeline) {
+	d := s.Timeout
+	if s.TimeoutFor != nil {
+		if d2 := s.TimeoutFor(r); d2 > 0 {
+			d = d2
+		}
+	}
+	if d <= 0 {
+		f.Next(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+	err := RunWithDeadline(w, r.WithContext(ctx), f.Next)
+	if err == nil {
+		return
+	}
+	log.Warning(nil, "Request: %s%s: %v after %v (response committed: %v)",
+		r.Host, r.URL.Path, err, d, w.IsHeaderWritten())
+	if w.IsHeaderWritten() {
+		return
+	}
+	code := s.Code
+	if code == 0 {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Connection", "close")
+	http.Error(w, http.StatusText(code), code)
+}
+
+// RunWithDeadline runs fn in another goroutine, until it returns or the context
+// of the request is done. In the latter case, it returns the error of the context,
+// and discards any further writes by fn to its ResponseWriter.
+//
+// fn gets its own copy of the headers, so the caller can write a response
+// if it is not committed (see ResponseWriter.IsHeaderWritten).
+//
+// A panic in fn is re-raised in the calling goroutine (or logged, if after the deadline).
+func RunWithDeadline(w ResponseWriter, r *http.Request, fn func(ResponseWriter, *http.Request)) (err error) {
+	tw := &timeoutWriter{w: w, h: cloneHeader(w.Header())}
+	done := make(chan interface{}, 1)
+	go func() {
+		var x interface{}
+		defer func() {
+			if x = recover(); x != nil && tw.timedOutNow() {
+				log.Error(nil, "Panic after deadline: %v\n%s", x, runtimeutil.Stack(nil, false))
+			}
+			done <- x
+		}()
+		fn(tw, r)
+	}()
+	var x interface{}
+	select {
+	case x = <-done:
+	case <-r.Context().Done():
+		tw.mu.Lock()
+		select {
+		case x = <-done: // fn returned just as the deadline passed
+		default:
+			tw.timedOut = true
+			err = r.Context().Err()
+		}
+		tw.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	if x != nil {
+		panic(x)
+	}
+	tw.mu.Lock()
+	tw.syncHeader()
+	tw.mu.Unlock()
+	return
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, v := range h {
+		h2[k] = append([]string(nil), v...)
+	}
+	return h2
+}
+
+// timeoutWriter guards a ResponseWriter, discarding writes after the deadline.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	w        ResponseWriter
+	h        http.Header
+	timedOut bool
+}
+
+func (t *timeoutWriter) timedOutNow() (b bool) {
+	t.mu.Lock()
+	b = t.timedOut
+	t.mu.Unlock()
+	return
+}
+
+// syncHeader copies the headers set by the handler to the underlying ResponseWriter.
+// It must be called with the lock held, before the response is committed.
+func (t *timeoutWriter) syncHeader() {
+	if t.w.IsHeaderWritten() {
+		return
+	}
+	h := t.w.Header()
+	for k := range h {
+		if _, ok := t.h[k]; !ok {
+			delete(h, k)
+		}
+	}
+	for k, v := range t.h {
+		h[k] = v
+	}
+}
+
+func (t *timeoutWriter) Header() http.Header {
+	return t.h
+}
+
+func (t *timeoutWriter) WriteHeader(code int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return
+	}
+	t.syncHeader()
+	t.w.WriteHeader(code)
+}
+
+func (t *timeoutWriter) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	t.syncHeader()
+	return t.w.Write(b)
+}
+
+func (t *timeoutWriter) Flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return
+	}
+	t.syncHeader()
+	t.w.Flush()
+}
+
+func (t *timeoutWriter) CloseNotify() <-chan bool {
+	return t.w.CloseNotify()
+}
+
+func (t *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	return t.w.Hijack()
+}
+
+func (t *timeoutWriter) IsHeaderWritten() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.w.IsHeaderWritten()
+}
+
+func (t *timeoutWriter) NumBytesWritten() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.w.NumBytesWritten()
+}
+
+func (t *timeoutWriter) ResponseCode() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.w.ResponseCode()
+}
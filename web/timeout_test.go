@@ -0,0 +1,91 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type pipeFunc func(w ResponseWriter, r *http.Request)
+
+func (fn pipeFunc) ServeHttpPipe(w ResponseWriter, r *http.Request, f *Pipeline) {
+	fn(w, r)
+}
+
+func TestTimeoutPipe(t *testing.T) {
+	for _, x := range []struct {
+		name      string
+		code      int  // of the TimeoutPipe
+		slow      bool // handler runs past the deadline
+		commit    bool // handler commits the response before the deadline
+		expCode   int
+		expBody   string
+		expHeader string // X-Handler
+	}{
+		{"fast", 0, false, true, 200, "ok", "1"},
+		{"timeout", 0, true, false, 503, "Service Unavailable\n", ""},
+		{"timeout with code", 504, true, false, 504, "Gateway Timeout\n", ""},
+		{"committed", 504, true, true, 200, "ok", "1"},
+	} {
+		release := make(chan struct{})
+		werrc := make(chan error, 1)
+		handler := pipeFunc(func(w ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Handler", "1")
+			if x.commit {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("ok"))
+				w.Flush()
+			}
+			if !x.slow {
+				werrc <- nil
+				return
+			}
+			// a write after the deadline is discarded
+			<-r.Context().Done()
+			<-release
+			_, err := w.Write([]byte(" late"))
+			werrc <- err
+		})
+		tp := &TimeoutPipe{Timeout: 20 * time.Millisecond, Code: x.code}
+		w := httptest.NewRecorder()
+		w2 := AsResponseWriter(w)
+		NewPipeline(tp, handler).Next(w2, httptest.NewRequest("GET", "/", nil))
+		w2.Flush()
+		close(release)
+		werr := <-werrc
+
+		if w.Code != x.expCode || w.Body.String() != x.expBody || w.Header().Get("X-Handler") != x.expHeader {
+			t.Errorf("%s: expected: %d %q, with X-Handler: %q, got: %d %q, with X-Handler: %q",
+				x.name, x.expCode, x.expBody, x.expHeader, w.Code, w.Body.String(), w.Header().Get("X-Handler"))
+		}
+		if exp := x.slow && !x.commit; (w.Header().Get("Connection") == "close") != exp {
+			t.Errorf("%s: expected Connection: close: %v, got: %v", x.name, exp, w.Header())
+		}
+		if x.slow && werr != http.ErrHandlerTimeout {
+			t.Errorf("%s: expected write after the deadline to return: %v, got: %v", x.name, http.ErrHandlerTimeout, werr)
+		}
+	}
+}
+
+func TestTimeoutPipeTimeoutFor(t *testing.T) {
+	tp := &TimeoutPipe{Timeout: time.Hour, TimeoutFor: func(r *http.Request) time.Duration {
+		if r.URL.Path == "/slow" {
+			return time.Millisecond
+		}
+		return 0
+	}}
+	for path, code := range map[string]int{"/": 200, "/slow": 503} {
+		handler := pipeFunc(func(w ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		})
+		w := httptest.NewRecorder()
+		w2 := AsResponseWriter(w)
+		NewPipeline(tp, handler).Next(w2, httptest.NewRequest("GET", path, nil))
+		w2.Flush()
+		if w.Code != code {
+			t.Errorf("%s: expected: %d, got: %d", path, code, w.Code)
+		}
+	}
+}